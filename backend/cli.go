@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/storage"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"os"
+	"time"
+)
+
+// runCommand handles maintenance subcommands given on the command line.
+// It reports false when the process should start the server as usual.
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	switch args[0] {
+	case "rotate-keys":
+		rotateKeysCommand(args[1:])
+		return true
+	case "clear-allowlists":
+		clearAllowlistsCommand()
+		return true
+	case "migrate-storage":
+		migrateStorageCommand(args[1:])
+		return true
+	}
+	return false
+}
+
+func rotateKeysCommand(args []string) {
+	fs := flag.NewFlagSet("rotate-keys", flag.ExitOnError)
+	purpose := fs.String("purpose", "", "key purpose to rotate (session, download, challenge, share); empty rotates all")
+	grace := fs.Duration("grace", config.DefaultKeyGracePeriod, "how long tokens signed with the previous key stay valid")
+	fs.Parse(args)
+
+	var purposes []string
+	if *purpose != "" {
+		purposes = []string{*purpose}
+	}
+	keys, err := config.RotateSigningKeys(purposes, *grace)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to rotate keys: %v\n", err)
+		os.Exit(1)
+	}
+	for _, k := range keys {
+		state := "active"
+		if k.ExpiresAt != 0 {
+			state = "retires " + time.Unix(k.ExpiresAt, 0).Format(time.RFC3339)
+		}
+		fmt.Printf("%-10s %s  %s\n", k.Purpose, k.ID, state)
+	}
+}
+
+// clearAllowlistsCommand opens the privileged routes to every network again,
+// for an admin who locked themselves out. Trusted proxies are kept.
+func clearAllowlistsCommand() {
+	if err := config.OpenStorage(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open storage: %v\n", err)
+		os.Exit(1)
+	}
+	defer storage.Current().Close()
+	err := utils.WithFileLock(config.SystemConfigFile, func() error {
+		var sysConfig models.SystemConfig
+		if err := utils.ReadJSONUnlocked(config.SystemConfigFile, &sysConfig); err != nil {
+			return err
+		}
+		if sysConfig.Network == nil {
+			return nil
+		}
+		sysConfig.Network.Allowlists = nil
+		return utils.WriteJSONUnlocked(config.SystemConfigFile, sysConfig)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to clear allowlists: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("Network allowlists cleared")
+}
+
+// migrateStorageCommand copies all documents from one storage backend to
+// another. The server has to be stopped while it runs, and STORAGE_BACKEND
+// set to the new backend afterwards. The source is left untouched.
+func migrateStorageCommand(args []string) {
+	fs := flag.NewFlagSet("migrate-storage", flag.ExitOnError)
+	from := fs.String("from", config.StorageBackend, "backend to copy from (json, bolt)")
+	to := fs.String("to", "", "backend to copy to (json, bolt)")
+	force := fs.Bool("force", false, "replace documents the target has already")
+	fs.Parse(args)
+
+	if *to == "" || *to == *from {
+		fmt.Fprintln(os.Stderr, "Choose a target backend different from the source with -to")
+		os.Exit(1)
+	}
+	layout := config.StorageLayout()
+	src, err := storage.Open(*from, layout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open %s storage: %v\n", *from, err)
+		os.Exit(1)
+	}
+	defer src.Close()
+	dst, err := storage.Open(*to, layout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open %s storage: %v\n", *to, err)
+		os.Exit(1)
+	}
+	defer dst.Close()
+
+	if existing, err := dst.Keys(); err != nil || (len(existing) > 0 && !*force) {
+		if err == nil {
+			err = fmt.Errorf("it holds %d documents already, use -force to replace them", len(existing))
+		}
+		fmt.Fprintf(os.Stderr, "Refusing to migrate into %s storage: %v\n", *to, err)
+		os.Exit(1)
+	}
+	n, err := storage.Copy(dst, src)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Migration failed after %d documents: %v\n", n, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Copied %d documents from %s to %s storage, start the server with STORAGE_BACKEND=%s\n", n, *from, *to, *to)
+}
@@ -4,6 +4,8 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"flatnasgo-backend/storage"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
@@ -25,6 +27,12 @@ var (
 	PublicDir            string
 	ConfigVersionsDir    string
 	SecretKey            []byte
+	// StorageBackend is where the documents of DataDir are kept, "json"
+	// files or the embedded "bolt" database. Set with STORAGE_BACKEND.
+	StorageBackend string
+	// MigrationBackupsDir keeps documents as they were before a schema
+	// migration rewrote them, on disk whatever the storage backend.
+	MigrationBackupsDir string
 )
 
 func Init() {
@@ -51,11 +59,53 @@ func Init() {
 	IconCacheDir = filepath.Join(DataDir, "icon-cache")
 	PublicDir = filepath.Join(BaseDir, "server", "public")
 	ConfigVersionsDir = filepath.Join(DataDir, "config_versions")
+	MigrationBackupsDir = filepath.Join(DataDir, "migration-backups")
+	StorageBackend = strings.TrimSpace(os.Getenv("STORAGE_BACKEND"))
+	if StorageBackend == "" {
+		StorageBackend = storage.BackendJSON
+	}
 
 	ensureDirs()
+	loadSecretKey()
+	loadSigningKeys()
+}
+
+// StorageLayout lists the files that belong to the storage backend. Keys,
+// caches and the default dashboard template stay on disk whichever backend
+// is used.
+func StorageLayout() storage.Layout {
+	return storage.Layout{
+		Dir: DataDir,
+		Files: map[string]string{
+			"transfer/index.json": filepath.Join(DocDir, "transfer", "index.json"),
+		},
+		Skip: []string{"default.json", "keys.json", "icon-cache", "audit", "migration-backups"},
+	}
+}
+
+// OpenStorage opens the configured storage backend and makes sure the
+// system config and the single user dashboard exist in it.
+func OpenStorage() error {
+	s, err := storage.Open(StorageBackend, StorageLayout())
+	if err != nil {
+		return err
+	}
+	if StorageBackend != storage.BackendJSON {
+		// Starting on an empty database would look like all data was lost
+		keys, err := s.Keys()
+		if err != nil {
+			s.Close()
+			return err
+		}
+		if _, statErr := os.Stat(SystemConfigFile); len(keys) == 0 && statErr == nil {
+			s.Close()
+			return fmt.Errorf("the %s database is empty but JSON data exists, run \"migrate-storage -to %s\" first", StorageBackend, StorageBackend)
+		}
+	}
+	storage.Use(s, StorageLayout())
 	ensureSystemConfig()
 	ensureDataFile()
-	loadSecretKey()
+	return nil
 }
 
 func ensureDirs() {
@@ -67,46 +117,14 @@ func ensureDirs() {
 	}
 }
 
+// ensureSystemConfig creates the system config of a new installation. Keys
+// missing from older configs are back-filled by the migrations package.
 func ensureSystemConfig() {
-	if _, err := os.Stat(SystemConfigFile); err == nil {
-		data, err := os.ReadFile(SystemConfigFile)
-		if err != nil {
-			log.Printf("Failed to read system config: %v", err)
-			return
-		}
-		var current map[string]interface{}
-		if err := json.Unmarshal(data, &current); err != nil {
-			log.Printf("Failed to parse system config: %v", err)
-			return
-		}
-		changed := false
-		if v, ok := current["authMode"].(string); !ok || strings.TrimSpace(v) == "" {
-			current["authMode"] = "single"
-			changed = true
-		}
-		if _, ok := current["enableDocker"].(bool); !ok {
-			current["enableDocker"] = true
-			changed = true
-		}
-		if _, ok := current["allowRegistration"].(bool); !ok {
-			current["allowRegistration"] = false
-			changed = true
-		}
-		if !changed {
-			return
-		}
-		updated, err := json.MarshalIndent(current, "", "  ")
-		if err != nil {
-			log.Printf("Failed to marshal system config: %v", err)
-			return
-		}
-		if err := os.WriteFile(SystemConfigFile, updated, 0644); err != nil {
-			log.Printf("Failed to write system config: %v", err)
-		}
-		return
-	} else if !os.IsNotExist(err) {
+	if exists, err := storage.Exists(SystemConfigFile); err != nil {
 		log.Printf("Failed to check system config: %v", err)
 		return
+	} else if exists {
+		return
 	}
 	defaultConfig := map[string]interface{}{
 		"authMode":           "single",
@@ -118,21 +136,21 @@ func ensureSystemConfig() {
 		log.Printf("Failed to marshal system config: %v", err)
 		return
 	}
-	if err := os.WriteFile(SystemConfigFile, data, 0644); err != nil {
+	if err := storage.WriteFile(SystemConfigFile, data); err != nil {
 		log.Printf("Failed to write system config: %v", err)
 	}
 }
 
 func ensureDataFile() {
 	dataFile := filepath.Join(DataDir, "data.json")
-	if _, err := os.Stat(dataFile); err == nil {
-		return
-	} else if !os.IsNotExist(err) {
+	if exists, err := storage.Exists(dataFile); err != nil {
 		log.Printf("Failed to check data file: %v", err)
 		return
+	} else if exists {
+		return
 	}
 
-	defaultData, err := os.ReadFile(DefaultFile)
+	defaultData, err := storage.ReadFile(DefaultFile)
 	if err != nil {
 		if os.IsNotExist(err) {
 			log.Printf("Default template not found: %s", DefaultFile)
@@ -142,7 +160,7 @@ func ensureDataFile() {
 		return
 	}
 
-	if err := os.WriteFile(dataFile, defaultData, 0644); err != nil {
+	if err := storage.WriteFile(dataFile, defaultData); err != nil {
 		log.Printf("Failed to initialize data file: %v", err)
 	}
 }
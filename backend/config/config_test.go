@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestLoadSecretKeyTrimsWhitespace(t *testing.T) {
@@ -22,3 +23,40 @@ func TestLoadSecretKeyTrimsWhitespace(t *testing.T) {
 		t.Fatalf("expected trimmed secret, got %q", string(SecretKey))
 	}
 }
+
+func TestRotateSigningKeysKeepsPreviousKeyDuringGrace(t *testing.T) {
+	DataDir = t.TempDir()
+	SecretKey = []byte("legacy")
+	keys = keyring{}
+	keysLoaded = false
+
+	loadSigningKeys()
+	oldID, _ := ActiveSigningKey(KeyPurposeSession)
+	if oldID == "" {
+		t.Fatalf("expected an active session key")
+	}
+
+	if _, err := RotateSigningKeys([]string{KeyPurposeSession}, time.Hour); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	newID, _ := ActiveSigningKey(KeyPurposeSession)
+	if newID == oldID {
+		t.Fatalf("expected a new active key")
+	}
+	if _, ok := VerificationKey(KeyPurposeSession, oldID); !ok {
+		t.Fatalf("expected previous key to verify during grace")
+	}
+	if _, ok := VerificationKey(KeyPurposeDownload, oldID); ok {
+		t.Fatalf("expected session key to be rejected for downloads")
+	}
+	if _, ok := VerificationKey(KeyPurposeSession, ""); !ok {
+		t.Fatalf("expected legacy key to verify until every purpose is rotated")
+	}
+
+	if _, err := RotateSigningKeys(nil, 0); err != nil {
+		t.Fatalf("rotate all: %v", err)
+	}
+	if _, ok := VerificationKey(KeyPurposeSession, ""); ok {
+		t.Fatalf("expected legacy key to be retired")
+	}
+}
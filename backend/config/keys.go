@@ -0,0 +1,280 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Token purposes. Every purpose is signed with its own key so a token minted
+// for one use can never verify as another.
+const (
+	KeyPurposeSession   = "session"   // Access tokens, also used for socket auth
+	KeyPurposeDownload  = "download"  // Transfer download links
+	KeyPurposeChallenge = "challenge" // Short lived login challenges (2FA, proof-of-work)
+	KeyPurposeShare     = "share"     // Read-only dashboard share links
+)
+
+var KeyPurposes = []string{KeyPurposeSession, KeyPurposeDownload, KeyPurposeChallenge, KeyPurposeShare}
+
+// DefaultKeyGracePeriod is how long a rotated out key keeps verifying tokens.
+const DefaultKeyGracePeriod = 24 * time.Hour
+
+var ErrUnknownKeyPurpose = errors.New("unknown key purpose")
+
+type SigningKey struct {
+	ID        string `json:"id"`
+	Purpose   string `json:"purpose"`
+	Secret    string `json:"secret,omitempty"`
+	CreatedAt int64  `json:"createdAt"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"` // Set when rotated out, 0 while active
+}
+
+// keyring is persisted in keys.json. Tokens without a key ID were signed with
+// the legacy secret.key, which keeps verifying until LegacyExpiresAt.
+type keyring struct {
+	LegacyExpiresAt int64        `json:"legacyExpiresAt,omitempty"`
+	Keys            []SigningKey `json:"keys"`
+}
+
+var (
+	KeysFile    string
+	keys        keyring
+	keysLoaded  bool
+	keysModTime time.Time
+	keysMu      sync.Mutex
+)
+
+func newSigningKey(purpose string) (SigningKey, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return SigningKey{}, err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return SigningKey{}, err
+	}
+	return SigningKey{
+		ID:        hex.EncodeToString(id),
+		Purpose:   purpose,
+		Secret:    hex.EncodeToString(secret),
+		CreatedAt: time.Now().Unix(),
+	}, nil
+}
+
+func isKeyPurpose(purpose string) bool {
+	for _, p := range KeyPurposes {
+		if p == purpose {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadKeysLocked picks up changes written by another process, such as the
+// rotate-keys command, without restarting the server.
+func reloadKeysLocked() {
+	if KeysFile == "" {
+		return
+	}
+	info, err := os.Stat(KeysFile)
+	if err != nil {
+		return
+	}
+	if keysLoaded && info.ModTime().Equal(keysModTime) {
+		return
+	}
+	data, err := os.ReadFile(KeysFile)
+	if err != nil {
+		log.Printf("Failed to read signing keys: %v", err)
+		return
+	}
+	var loaded keyring
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		log.Printf("Failed to parse signing keys: %v", err)
+		return
+	}
+	keys = loaded
+	keysLoaded = true
+	keysModTime = info.ModTime()
+}
+
+func saveKeysLocked() error {
+	now := time.Now().Unix()
+	kept := keys.Keys[:0]
+	for _, k := range keys.Keys {
+		if k.ExpiresAt == 0 || k.ExpiresAt > now {
+			kept = append(kept, k)
+		}
+	}
+	keys.Keys = kept
+
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tempFile := KeysFile + ".tmp"
+	if err := os.WriteFile(tempFile, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tempFile, KeysFile); err != nil {
+		return err
+	}
+	keysLoaded = true
+	if info, err := os.Stat(KeysFile); err == nil {
+		keysModTime = info.ModTime()
+	}
+	return nil
+}
+
+// loadSigningKeys makes sure every purpose has an active key.
+func loadSigningKeys() {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+
+	KeysFile = filepath.Join(DataDir, "keys.json")
+	reloadKeysLocked()
+
+	changed := false
+	for _, purpose := range KeyPurposes {
+		if _, ok := activeKeyLocked(purpose); ok {
+			continue
+		}
+		key, err := newSigningKey(purpose)
+		if err != nil {
+			log.Fatal(err)
+		}
+		keys.Keys = append(keys.Keys, key)
+		changed = true
+	}
+	if changed {
+		if err := saveKeysLocked(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func activeKeyLocked(purpose string) (SigningKey, bool) {
+	var active SigningKey
+	found := false
+	for _, k := range keys.Keys {
+		if k.Purpose == purpose && k.ExpiresAt == 0 && (!found || k.CreatedAt > active.CreatedAt) {
+			active = k
+			found = true
+		}
+	}
+	return active, found
+}
+
+// ActiveSigningKey returns the key ID and secret new tokens of purpose are
+// signed with. Without a keyring (e.g. in tests) the legacy secret is used
+// and the key ID is empty.
+func ActiveSigningKey(purpose string) (string, []byte) {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	reloadKeysLocked()
+	if k, ok := activeKeyLocked(purpose); ok {
+		return k.ID, []byte(k.Secret)
+	}
+	return "", SecretKey
+}
+
+// VerificationKey resolves the secret for a token of purpose signed with kid.
+// Rotated out keys verify until their grace period ends.
+func VerificationKey(purpose, kid string) ([]byte, bool) {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	reloadKeysLocked()
+	now := time.Now().Unix()
+	if kid == "" {
+		if len(SecretKey) == 0 || (keys.LegacyExpiresAt != 0 && keys.LegacyExpiresAt <= now) {
+			return nil, false
+		}
+		return SecretKey, true
+	}
+	for _, k := range keys.Keys {
+		if k.ID == kid && k.Purpose == purpose && (k.ExpiresAt == 0 || k.ExpiresAt > now) {
+			return []byte(k.Secret), true
+		}
+	}
+	return nil, false
+}
+
+// RotateSigningKeys creates a new active key for each purpose (all purposes
+// when none is given) and retires the previous ones after grace. Rotating
+// every purpose also retires the legacy secret.key.
+func RotateSigningKeys(purposes []string, grace time.Duration) ([]SigningKey, error) {
+	all := len(purposes) == 0
+	if all {
+		purposes = KeyPurposes
+	}
+	for _, p := range purposes {
+		if !isKeyPurpose(p) {
+			return nil, ErrUnknownKeyPurpose
+		}
+	}
+
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	reloadKeysLocked()
+
+	retireAt := time.Now().Add(grace).Unix()
+	for _, purpose := range purposes {
+		for i := range keys.Keys {
+			if keys.Keys[i].Purpose == purpose && keys.Keys[i].ExpiresAt == 0 {
+				keys.Keys[i].ExpiresAt = retireAt
+			}
+		}
+		key, err := newSigningKey(purpose)
+		if err != nil {
+			return nil, err
+		}
+		keys.Keys = append(keys.Keys, key)
+	}
+	if all && (keys.LegacyExpiresAt == 0 || keys.LegacyExpiresAt > retireAt) {
+		keys.LegacyExpiresAt = retireAt
+	}
+	if err := saveKeysLocked(); err != nil {
+		return nil, err
+	}
+	return listSigningKeysLocked(), nil
+}
+
+// ListSigningKeys returns the keyring without secrets.
+func ListSigningKeys() []SigningKey {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	reloadKeysLocked()
+	return listSigningKeysLocked()
+}
+
+func listSigningKeysLocked() []SigningKey {
+	list := make([]SigningKey, 0, len(keys.Keys))
+	for _, k := range keys.Keys {
+		k.Secret = ""
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Purpose != list[j].Purpose {
+			return list[i].Purpose < list[j].Purpose
+		}
+		return list[i].CreatedAt > list[j].CreatedAt
+	})
+	return list
+}
+
+// LegacyKeyExpiresAt reports when tokens without a key ID stop verifying,
+// 0 meaning never.
+func LegacyKeyExpiresAt() int64 {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	reloadKeysLocked()
+	return keys.LegacyExpiresAt
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"errors"
+	"flatnasgo-backend/middleware"
+	"flatnasgo-backend/models"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxAPITokensPerUser = 50
+	maxAPITokenNameLen  = 64
+)
+
+var errTooManyAPITokens = errors.New("too many API tokens")
+
+type CreateAPITokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expiresInDays"` // 0 means the token does not expire
+}
+
+func GetAPITokens(c *gin.Context) {
+	tokens := middleware.ListAPITokens(c.GetString("username"))
+	c.JSON(http.StatusOK, gin.H{"success": true, "tokens": tokens})
+}
+
+// CreateAPIToken issues a personal access token for scripts. The token is
+// returned once; only its hash is kept.
+func CreateAPIToken(c *gin.Context) {
+	var req CreateAPITokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > maxAPITokenNameLen {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid token name"})
+		return
+	}
+	if len(req.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one scope is required"})
+		return
+	}
+	scopes := []string{}
+	seen := map[string]bool{}
+	for _, s := range req.Scopes {
+		if !models.IsValidPermission(s) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid scope: " + s})
+			return
+		}
+		// A token can never carry more than its owner holds
+		if !middleware.HasPermission(c, s) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Scope not allowed: " + s})
+			return
+		}
+		if !seen[s] {
+			seen[s] = true
+			scopes = append(scopes, s)
+		}
+	}
+	if req.ExpiresInDays < 0 || req.ExpiresInDays > 3650 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expiry"})
+		return
+	}
+
+	secret, err := randomHex(24)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	token := middleware.APITokenPrefix + secret
+
+	now := time.Now()
+	record := models.APIToken{
+		ID:        id,
+		Username:  c.GetString("username"),
+		Name:      req.Name,
+		Prefix:    token[:len(middleware.APITokenPrefix)+6],
+		TokenHash: middleware.HashAPIToken(token),
+		Scopes:    scopes,
+		CreatedAt: now.Unix(),
+	}
+	if req.ExpiresInDays > 0 {
+		record.ExpiresAt = now.AddDate(0, 0, req.ExpiresInDays).Unix()
+	}
+
+	err = middleware.UpdateAPITokens(func(tokens []models.APIToken) ([]models.APIToken, error) {
+		count := 0
+		for _, t := range tokens {
+			if t.Username == record.Username {
+				count++
+			}
+		}
+		if count >= maxAPITokensPerUser {
+			return nil, errTooManyAPITokens
+		}
+		return append(tokens, record), nil
+	})
+	if err != nil {
+		if errors.Is(err, errTooManyAPITokens) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Too many tokens"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save token"})
+		return
+	}
+
+	audit(c, "token.create", record.Username, gin.H{"id": record.ID, "name": record.Name, "scopes": record.Scopes})
+	record.TokenHash = ""
+	c.JSON(http.StatusOK, gin.H{"success": true, "token": token, "info": record})
+}
+
+// deleteAPIToken removes the token with id, restricted to owner unless owner
+// is empty.
+func deleteAPIToken(id, owner string) bool {
+	found := false
+	middleware.UpdateAPITokens(func(tokens []models.APIToken) ([]models.APIToken, error) {
+		kept := tokens[:0]
+		for _, t := range tokens {
+			if t.ID == id && (owner == "" || t.Username == owner) {
+				found = true
+				continue
+			}
+			kept = append(kept, t)
+		}
+		return kept, nil
+	})
+	return found
+}
+
+func DeleteAPIToken(c *gin.Context) {
+	if !deleteAPIToken(c.Param("id"), c.GetString("username")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	}
+	audit(c, "token.delete", c.GetString("username"), gin.H{"id": c.Param("id")})
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// GetAllAPITokens lists the tokens of every user, or of ?username= only.
+func GetAllAPITokens(c *gin.Context) {
+	tokens := middleware.ListAPITokens(c.Query("username"))
+	c.JSON(http.StatusOK, gin.H{"success": true, "tokens": tokens})
+}
+
+func AdminDeleteAPIToken(c *gin.Context) {
+	if !deleteAPIToken(c.Param("id"), "") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	}
+	audit(c, "token.delete", "", gin.H{"id": c.Param("id")})
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
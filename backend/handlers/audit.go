@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	auditFileName       = "audit.log"
+	auditMaxFileSize    = 5 << 20 // Rotate once the current file grows past this
+	auditMaxRotated     = 10      // Rotated files kept besides the current one
+	defaultAuditLimit   = 100
+	maxAuditQueryLimit  = 1000
+	auditRotatedPrefix  = "audit-"
+	auditRotatedPattern = auditRotatedPrefix + "*.log"
+)
+
+var auditMu sync.Mutex
+
+func getAuditDir() string {
+	return filepath.Join(config.DataDir, "audit")
+}
+
+// rotateAuditLog moves the current file aside once it is too big and drops
+// the oldest rotated files. Callers hold auditMu.
+func rotateAuditLog(dir string) {
+	current := filepath.Join(dir, auditFileName)
+	info, err := os.Stat(current)
+	if err != nil || info.Size() < auditMaxFileSize {
+		return
+	}
+	rotated := filepath.Join(dir, fmt.Sprintf("%s%d.log", auditRotatedPrefix, time.Now().UnixNano()))
+	if err := os.Rename(current, rotated); err != nil {
+		log.Printf("Failed to rotate audit log: %v", err)
+		return
+	}
+	old, _ := filepath.Glob(filepath.Join(dir, auditRotatedPattern))
+	sort.Strings(old)
+	for len(old) > auditMaxRotated {
+		os.Remove(old[0])
+		old = old[1:]
+	}
+}
+
+// appendAuditEntry writes entry as one JSON line. The log is append only;
+// nothing in the app edits or removes entries except rotation.
+func appendAuditEntry(entry models.AuditEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to encode audit entry: %v", err)
+		return
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	dir := getAuditDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Printf("Failed to create audit dir: %v", err)
+		return
+	}
+	rotateAuditLog(dir)
+	f, err := os.OpenFile(filepath.Join(dir, auditFileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Failed to open audit log: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write audit log: %v", err)
+	}
+}
+
+// audit records action done by the signed in user on target.
+func audit(c *gin.Context, action, target string, details map[string]interface{}) {
+	appendAuditEntry(models.AuditEntry{
+		Time:     time.Now().UnixMilli(),
+		Action:   action,
+		Username: c.GetString("username"),
+		Target:   target,
+		IP:       c.ClientIP(),
+		Details:  details,
+	})
+}
+
+// auditLogin records a sign-in attempt. Nobody is signed in yet, so the
+// account tried is both actor and target.
+func auditLogin(c *gin.Context, username, action string, details map[string]interface{}) {
+	appendAuditEntry(models.AuditEntry{
+		Time:     time.Now().UnixMilli(),
+		Action:   action,
+		Username: username,
+		Target:   username,
+		IP:       c.ClientIP(),
+		Details:  details,
+	})
+}
+
+// auditFiles lists the log files from newest to oldest.
+func auditFiles() []string {
+	dir := getAuditDir()
+	rotated, _ := filepath.Glob(filepath.Join(dir, auditRotatedPattern))
+	sort.Sort(sort.Reverse(sort.StringSlice(rotated)))
+	return append([]string{filepath.Join(dir, auditFileName)}, rotated...)
+}
+
+type auditFilter struct {
+	user   string
+	action string
+	since  int64 // Unix milliseconds, 0 for no bound
+	until  int64
+}
+
+func (f *auditFilter) match(e *models.AuditEntry) bool {
+	if f.user != "" && e.Username != f.user && e.Target != f.user {
+		return false
+	}
+	if f.action != "" && e.Action != f.action && !strings.HasPrefix(e.Action, f.action+".") {
+		return false
+	}
+	if f.since > 0 && e.Time < f.since {
+		return false
+	}
+	if f.until > 0 && e.Time > f.until {
+		return false
+	}
+	return true
+}
+
+// queryAuditLog returns up to limit entries matching f, newest first.
+func queryAuditLog(f auditFilter, limit int) []models.AuditEntry {
+	auditMu.Lock()
+	files := auditFiles()
+	auditMu.Unlock()
+
+	entries := []models.AuditEntry{}
+	for _, path := range files {
+		file, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		var matched []models.AuditEntry
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1<<20)
+		for scanner.Scan() {
+			var e models.AuditEntry
+			if json.Unmarshal(scanner.Bytes(), &e) == nil && f.match(&e) {
+				matched = append(matched, e)
+			}
+		}
+		file.Close()
+		for i := len(matched) - 1; i >= 0; i-- {
+			entries = append(entries, matched[i])
+			if len(entries) >= limit {
+				return entries
+			}
+		}
+	}
+	return entries
+}
+
+func parseAuditTime(s string) (int64, bool) {
+	if s == "" {
+		return 0, true
+	}
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || sec < 0 {
+		return 0, false
+	}
+	return sec * 1000, true
+}
+
+// GetAuditLog returns audit entries, newest first. ?user= matches the actor
+// or the target, ?action= an action or its prefix (e.g. "login"), ?since= and
+// ?until= are Unix seconds.
+func GetAuditLog(c *gin.Context) {
+	since, okSince := parseAuditTime(c.Query("since"))
+	until, okUntil := parseAuditTime(c.Query("until"))
+	if !okSince || !okUntil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid time range"})
+		return
+	}
+	limit := defaultAuditLimit
+	if s := c.Query("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		if n > maxAuditQueryLimit {
+			n = maxAuditQueryLimit
+		}
+		limit = n
+	}
+	if until > 0 {
+		until += 999 // Include the whole second
+	}
+
+	entries := queryAuditLog(auditFilter{
+		user:   c.Query("user"),
+		action: strings.TrimSuffix(c.Query("action"), "."),
+		since:  since,
+		until:  until,
+	}, limit)
+	c.JSON(http.StatusOK, gin.H{"entries": entries})
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func queryAudit(t *testing.T, r *gin.Engine, query string) []models.AuditEntry {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/admin/audit?"+query, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("audit query %q failed: %d %s", query, w.Code, w.Body.String())
+	}
+	var res struct {
+		Entries []models.AuditEntry `json:"entries"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &res)
+	return res.Entries
+}
+
+func TestAuditLogRecordsLogins(t *testing.T) {
+	setupDataDir(t, models.SystemConfig{AuthMode: "multi"})
+	hashed, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	utils.WriteJSON(filepath.Join(config.UsersDir, "alice.json"), models.User{Username: "alice", Password: string(hashed)})
+
+	r := gin.New()
+	r.POST("/api/login", Login)
+	r.GET("/api/admin/audit", GetAuditLog)
+
+	postJSON(r, "/api/login", `{"username":"alice","password":"wrong"}`)
+	postJSON(r, "/api/login", `{"username":"alice","password":"secret"}`)
+	postJSON(r, "/api/login", `{"username":"bob","password":"secret"}`)
+
+	entries := queryAudit(t, r, "user=alice")
+	if len(entries) != 2 || entries[0].Action != "login.success" || entries[1].Action != "login.failed" {
+		t.Fatalf("unexpected entries for alice: %+v", entries)
+	}
+	if entries := queryAudit(t, r, "action=login.failed"); len(entries) != 2 {
+		t.Fatalf("expected two failed logins, got %+v", entries)
+	}
+	if entries := queryAudit(t, r, "action=login&limit=1"); len(entries) != 1 || entries[0].Username != "bob" {
+		t.Fatalf("expected the newest login only, got %+v", entries)
+	}
+	if entries := queryAudit(t, r, "since=4102444800"); len(entries) != 0 {
+		t.Fatalf("expected no entries in the future, got %+v", entries)
+	}
+}
+
+func TestAuditLogRotates(t *testing.T) {
+	config.DataDir = t.TempDir()
+	dir := getAuditDir()
+	os.MkdirAll(dir, 0700)
+	os.WriteFile(filepath.Join(dir, auditFileName), []byte(strings.Repeat(" ", auditMaxFileSize)+"\n"), 0600)
+	for i := 0; i < auditMaxRotated; i++ {
+		os.WriteFile(filepath.Join(dir, auditRotatedPrefix+strings.Repeat("0", i+1)+".log"), nil, 0600)
+	}
+
+	appendAuditEntry(models.AuditEntry{Action: "test"})
+
+	rotated, _ := filepath.Glob(filepath.Join(dir, auditRotatedPattern))
+	if len(rotated) != auditMaxRotated {
+		t.Fatalf("expected %d rotated files, got %d", auditMaxRotated, len(rotated))
+	}
+	info, err := os.Stat(filepath.Join(dir, auditFileName))
+	if err != nil || info.Size() >= auditMaxFileSize {
+		t.Fatalf("expected a fresh audit log after rotation")
+	}
+}
@@ -2,10 +2,17 @@ package handlers
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flatnasgo-backend/config"
+	"flatnasgo-backend/middleware"
+	"flatnasgo-backend/migrations"
 	"flatnasgo-backend/models"
+	"flatnasgo-backend/storage"
 	"flatnasgo-backend/utils"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -13,7 +20,6 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -34,6 +40,36 @@ func Login(c *gin.Context) {
 		req.Username = "admin"
 	}
 
+	clientIP := c.ClientIP()
+	if wait, locked := loginLockedOut(clientIP, req.Username); locked {
+		respondLoginLocked(c, wait)
+		return
+	}
+	if !requireChallenge(c, &sysConfig, "login") {
+		return
+	}
+
+	if ldapUser, handled, err := ldapLogin(&sysConfig, req.Username, req.Password); handled {
+		if err != nil {
+			if errors.Is(err, errLDAPCredentials) || errors.Is(err, errLDAPAccount) {
+				recordLoginFailure(clientIP, req.Username)
+				auditLogin(c, req.Username, "login.failed", gin.H{"method": "ldap"})
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "用户不存在或密码错误"})
+				return
+			}
+			log.Printf("LDAP login failed for %s: %v", req.Username, err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "LDAP server unavailable"})
+			return
+		}
+		if requiresSecondFactor(ldapUser) {
+			issueTwoFactorChallenge(c, req.Username, ldapUser)
+			return
+		}
+		recordLoginSuccess(clientIP, req.Username)
+		issueLoginToken(c, req.Username, ldapUser)
+		return
+	}
+
 	userFile := filepath.Join(config.UsersDir, req.Username+".json")
 	if req.Username == "admin" && sysConfig.AuthMode == "single" {
 		// Single mode admin data is in data.json
@@ -46,74 +82,158 @@ func Login(c *gin.Context) {
 	if err := utils.ReadJSON(userFile, &user); err != nil {
 		// If admin user not found, create default admin
 		if req.Username == "admin" {
-			hashed, err := bcrypt.GenerateFromPassword([]byte("admin"), 10)
+			hashed, err := utils.HashPassword("admin")
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
 				return
 			}
 			user = models.User{
-				Username: "admin",
-				Password: string(hashed),
+				SchemaVersion: migrations.Latest(migrations.User),
+				Username:      "admin",
+				Password:      hashed,
 			}
 			// Ensure directory exists
 			if err := utils.WriteJSON(userFile, user); err == nil {
 				// Successfully created default admin, now check password
-				err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password))
-				if err == nil {
-					match = true
-				}
+				match = passwordMatches(user.Password, req.Password)
 			} else {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create default user"})
 				return
 			}
 		} else {
-						c.JSON(http.StatusUnauthorized, gin.H{"error": "用户不存在或密码错误"})
-						return
-					}	} else {
-		// User exists logic...
-		storedPwd := user.Password
-		if storedPwd == "" {
-			storedPwd = "admin"
+			recordLoginFailure(clientIP, req.Username)
+			auditLogin(c, req.Username, "login.failed", gin.H{"method": "password", "reason": "unknown user"})
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "用户不存在或密码错误"})
+			return
 		}
-
-		if len(storedPwd) > 0 && storedPwd[0] == '$' {
-			err := bcrypt.CompareHashAndPassword([]byte(storedPwd), []byte(req.Password))
-			if err == nil {
-				match = true
+	} else if passwordMatches(user.Password, req.Password) {
+		match = true
+		// Plaintext passwords and hashes of an older cost are upgraded in place
+		if utils.PasswordNeedsRehash(user.Password) {
+			hashed, err := utils.HashPassword(req.Password)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+				return
 			}
-		} else {
-			if req.Password == storedPwd {
-				match = true
-				hashed, err := bcrypt.GenerateFromPassword([]byte(req.Password), 10)
-				if err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
-					return
-				}
-				user.Password = string(hashed)
-				if err := utils.WriteJSON(userFile, user); err != nil {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save user"})
-					return
-				}
+			_, err = updateUserAccount(req.Username, func(u *models.User) error {
+				u.Password = hashed
+				return nil
+			})
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save user"})
+				return
 			}
 		}
 	}
 
 	if match {
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-			"username": req.Username,
-			"exp":      time.Now().Add(time.Hour * 24 * 30).Unix(),
-		})
-		tokenString, err := token.SignedString([]byte(config.GetSecretKeyString()))
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign token"})
+		if requiresSecondFactor(&user) {
+			// Failure counters are only reset once the second factor is verified
+			issueTwoFactorChallenge(c, req.Username, &user)
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{"success": true, "token": tokenString, "username": req.Username})
+		finishPasswordLogin(c, clientIP, req.Username, &user)
 	} else {
+		recordLoginFailure(clientIP, req.Username)
+		auditLogin(c, req.Username, "login.failed", gin.H{"method": "password"})
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Password incorrect"})
 	}
 }
 
+// userFilePath returns the file holding the account and dashboard of username.
+// In single mode the admin account lives in data.json.
+func userFilePath(username string) string {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	if username == "admin" && sysConfig.AuthMode == "single" {
+		return filepath.Join(config.DataDir, "data.json")
+	}
+	return filepath.Join(config.UsersDir, username+".json")
+}
+
+// decodeAccount extracts the account fields of a user document. Dashboard
+// content is skipped so a malformed widget can never break authentication.
+func decodeAccount(raw map[string]interface{}) (*models.User, error) {
+	account := make(map[string]interface{})
+	for _, k := range append([]string{"username", "password"}, protectedUserKeys...) {
+		if v, ok := raw[k]; ok {
+			account[k] = v
+		}
+	}
+	encoded, err := json.Marshal(account)
+	if err != nil {
+		return nil, err
+	}
+	var user models.User
+	if err := json.Unmarshal(encoded, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func loadUser(username string) (*models.User, error) {
+	var raw map[string]interface{}
+	if err := utils.ReadJSON(userFilePath(username), &raw); err != nil {
+		return nil, err
+	}
+	return decodeAccount(raw)
+}
+
+// updateUserAccount applies fn to the account fields of a user record under
+// the file lock. Only the account keys are written back, so dashboard content
+// stored in the same file (including fields unknown to models.User) is kept.
+func updateUserAccount(username string, fn func(user *models.User) error) (*models.User, error) {
+	userFile := userFilePath(username)
+	var user *models.User
+	err := utils.WithFileLock(userFile, func() error {
+		var raw map[string]interface{}
+		if err := utils.ReadJSONUnlocked(userFile, &raw); err != nil {
+			return err
+		}
+		decoded, err := decodeAccount(raw)
+		if err != nil {
+			return err
+		}
+		user = decoded
+		if err := fn(user); err != nil {
+			return err
+		}
+
+		encoded, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(encoded, &fields); err != nil {
+			return err
+		}
+		for _, k := range append([]string{"password"}, protectedUserKeys...) {
+			if v, ok := fields[k]; ok {
+				raw[k] = v
+			} else {
+				delete(raw, k)
+			}
+		}
+		return utils.WriteJSONUnlocked(userFile, raw)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// passwordMatches compares against a bcrypt hash, or against a legacy
+// plaintext password that Login has not upgraded yet.
+func passwordMatches(stored, password string) bool {
+	if stored == "" {
+		stored = "admin"
+	}
+	if stored[0] == '$' {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+}
+
 type RegisterRequest struct {
 	Username   string `json:"username"`
 	Password   string `json:"password"`
@@ -121,8 +241,37 @@ type RegisterRequest struct {
 }
 
 type AddUserRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username    string   `json:"username"`
+	Password    string   `json:"password"`
+	Role        string   `json:"role,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+type UpdateUserRequest struct {
+	Role        *string   `json:"role,omitempty"`
+	Permissions *[]string `json:"permissions,omitempty"`
+	Disabled    *bool     `json:"disabled,omitempty"`
+}
+
+type UserSummary struct {
+	Username    string   `json:"username"`
+	Role        string   `json:"role"`
+	Permissions []string `json:"permissions"`
+	Disabled    bool     `json:"disabled"`
+}
+
+// validateRoleAssignment checks a role and extra permissions sent by an admin.
+// An empty role is allowed and means the default role.
+func validateRoleAssignment(role string, permissions []string) string {
+	if role != "" && !models.IsValidRole(role) {
+		return "Invalid role"
+	}
+	for _, p := range permissions {
+		if !models.IsValidPermission(p) {
+			return "Invalid permission: " + p
+		}
+	}
+	return ""
 }
 
 type LicenseRequest struct {
@@ -146,105 +295,107 @@ func Register(c *gin.Context) {
 		return
 	}
 
+	if !utils.IsValidUsername(req.Username) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "用户名只能包含字母、数字和 . _ @ -"})
+		return
+	}
+
 	// Check if registration is allowed
 	var sysConfig models.SystemConfig
 	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
 
+	if msg := checkPasswordPolicy(sysConfig.PasswordPolicy, req.Username, req.Password); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
 	if !sysConfig.AllowRegistration && req.InviteCode == "" {
 		c.JSON(http.StatusForbidden, gin.H{"error": "注册功能已关闭"})
 		return
 	}
 
-	// If invite code is provided, verify it
+	// Guessing invite codes counts as failed logins
 	if req.InviteCode != "" {
-		inviteCodesFile := filepath.Join(config.DataDir, "invite_codes.json")
-		var inviteCodes []models.InviteCode
-		utils.ReadJSON(inviteCodesFile, &inviteCodes)
-
-		validCode := false
-		var codeIndex = -1
-		var invalidReason string
-
-		for i, code := range inviteCodes {
-			if code.Code == req.InviteCode && code.IsActive {
-				// Check if expired
-				if code.ExpiresAt > 0 && code.ExpiresAt < time.Now().Unix() {
-					invalidReason = "邀请码已过期"
-					continue
-				}
-				// Check if max uses reached
-				if code.MaxUses > 0 && code.UsedCount >= code.MaxUses {
-					invalidReason = "邀请码使用次数已达上限"
-					continue
-				}
-				validCode = true
-				codeIndex = i
-				break
-			}
-		}
-
-		if !validCode {
-			if invalidReason != "" {
-				c.JSON(http.StatusForbidden, gin.H{"error": invalidReason})
-			} else {
-				c.JSON(http.StatusForbidden, gin.H{"error": "无效的邀请码"})
-			}
+		if wait, locked := loginLockedOut(c.ClientIP(), ""); locked {
+			respondLoginLocked(c, wait)
 			return
 		}
-
-		// Update used count
-		inviteCodes[codeIndex].UsedCount++
-		utils.WriteJSON(inviteCodesFile, inviteCodes)
 	}
 
-	userFile := filepath.Join(config.UsersDir, req.Username+".json")
-	if _, err := os.Stat(userFile); err == nil {
-		c.JSON(http.StatusConflict, gin.H{"error": "用户名已存在"})
+	if !requireChallenge(c, &sysConfig, "register") {
 		return
 	}
 
-	hashed, err := bcrypt.GenerateFromPassword([]byte(req.Password), 10)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
-		return
-	}
-
-	user := models.User{
-		Username: req.Username,
-		Password: string(hashed),
+	var err error
+	if req.InviteCode != "" {
+		// The account is created while the code is locked, so it is used
+		// exactly once per account even under concurrent registrations. The
+		// password is only hashed for a valid code.
+		err = redeemInviteCode(req.InviteCode, req.Username, func(invite *models.InviteCode) (interface{}, error) {
+			hashed, err := utils.HashPassword(req.Password)
+			if err != nil {
+				return nil, err
+			}
+			return newUserRecord(req.Username, hashed, invite.Role, invite.Template)
+		})
+	} else {
+		var hashed string
+		if hashed, err = utils.HashPassword(req.Password); err == nil {
+			record, _ := newUserRecord(req.Username, hashed, "", "")
+			err = createUserFile(userFilePath(req.Username), record)
+		}
 	}
 
-	if err := utils.WriteJSON(userFile, user); err != nil {
+	var invalid *inviteError
+	switch {
+	case errors.As(err, &invalid):
+		recordLoginFailure(c.ClientIP(), "")
+		auditLogin(c, req.Username, "register.failed", gin.H{"inviteCode": req.InviteCode, "reason": invalid.msg})
+		c.JSON(http.StatusForbidden, gin.H{"error": invalid.msg})
+		return
+	case errors.Is(err, errUsernameTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": "用户名已存在"})
+		return
+	case err != nil:
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save user"})
 		return
 	}
 
+	auditLogin(c, req.Username, "user.register", gin.H{"inviteCode": req.InviteCode})
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
 
 func GetUsers(c *gin.Context) {
-	username := c.GetString("username")
-	if username != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
-		return
-	}
-
-	files, err := os.ReadDir(config.UsersDir)
+	files, err := storage.ReadDir(config.UsersDir)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read users directory"})
 		return
 	}
 
 	var users []string
+	details := []UserSummary{}
 	for _, file := range files {
-		if !file.IsDir() && strings.HasSuffix(file.Name(), ".json") {
-			name := strings.TrimSuffix(file.Name(), ".json")
+		if strings.HasSuffix(file, ".json") {
+			name := strings.TrimSuffix(file, ".json")
 			if name != "admin" {
+				var user models.User
+				utils.ReadJSON(filepath.Join(config.UsersDir, file), &user)
+				role := models.EffectiveRole(name, user.Role)
+				permissions := user.Permissions
+				if permissions == nil {
+					permissions = []string{}
+				}
 				users = append(users, name)
+				details = append(details, UserSummary{
+					Username:    name,
+					Role:        role,
+					Permissions: permissions,
+					Disabled:    user.Disabled,
+				})
 			}
 		}
 	}
-	c.JSON(http.StatusOK, gin.H{"users": users})
+	c.JSON(http.StatusOK, gin.H{"users": users, "details": details})
 }
 
 func AddUser(c *gin.Context) {
@@ -264,21 +415,41 @@ func AddUser(c *gin.Context) {
 		return
 	}
 
+	if !utils.IsValidUsername(req.Username) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "用户名只能包含字母、数字和 . _ @ -"})
+		return
+	}
+
+	if msg := validateRoleAssignment(req.Role, req.Permissions); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	if msg := checkPasswordPolicy(sysConfig.PasswordPolicy, req.Username, req.Password); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
 	userFile := filepath.Join(config.UsersDir, req.Username+".json")
-	if _, err := os.Stat(userFile); err == nil {
+	if exists, _ := storage.Exists(userFile); exists {
 		c.JSON(http.StatusConflict, gin.H{"error": "用户名已存在"})
 		return
 	}
 
-	hashed, err := bcrypt.GenerateFromPassword([]byte(req.Password), 10)
+	hashed, err := utils.HashPassword(req.Password)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
 		return
 	}
 
 	user := models.User{
-		Username: req.Username,
-		Password: string(hashed),
+		SchemaVersion: migrations.Latest(migrations.User),
+		Username:      req.Username,
+		Password:      hashed,
+		Role:          req.Role,
+		Permissions:   req.Permissions,
 	}
 
 	if err := utils.WriteJSON(userFile, user); err != nil {
@@ -286,27 +457,131 @@ func AddUser(c *gin.Context) {
 		return
 	}
 
+	audit(c, "user.create", req.Username, gin.H{"role": req.Role, "permissions": req.Permissions})
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
 
-func DeleteUser(c *gin.Context) {
-	currentUsername := c.GetString("username")
-	if currentUsername != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+// UpdateUser changes the role and extra permissions of a user, or disables
+// and enables the account. The rest of the user document is left untouched.
+func UpdateUser(c *gin.Context) {
+	username := c.Param("usr")
+	if !isManagedUsername(username) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid username"})
 		return
 	}
 
+	var req UpdateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if req.Disabled != nil && *req.Disabled && username == c.GetString("username") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "不能禁用自己的账号"})
+		return
+	}
+
+	role := ""
+	if req.Role != nil {
+		role = *req.Role
+	}
+	var permissions []string
+	if req.Permissions != nil {
+		permissions = *req.Permissions
+	}
+	if msg := validateRoleAssignment(role, permissions); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	user, err := updateUserAccount(username, func(user *models.User) error {
+		if req.Role != nil {
+			user.Role = role
+		}
+		if req.Permissions != nil {
+			user.Permissions = permissions
+		}
+		if req.Disabled != nil {
+			user.Disabled = *req.Disabled
+		}
+		return nil
+	})
+	if err != nil {
+		if os.IsNotExist(err) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+		return
+	}
+	if user.Disabled {
+		revokeUserSessions(username, "")
+	} else {
+		// Outstanding access tokens carry the old permissions; refreshing picks up the new ones
+		middleware.RevokeUserTokens(username)
+	}
+	role = models.EffectiveRole(username, user.Role)
+	middleware.RestrictAPITokens(username, models.EffectivePermissions(role, user.Permissions))
+
+	summary := UserSummary{
+		Username:    username,
+		Role:        role,
+		Permissions: user.Permissions,
+		Disabled:    user.Disabled,
+	}
+	if summary.Permissions == nil {
+		summary.Permissions = []string{}
+	}
+	changes := gin.H{}
+	if req.Role != nil {
+		changes["role"] = role
+	}
+	if req.Permissions != nil {
+		changes["permissions"] = summary.Permissions
+	}
+	if req.Disabled != nil {
+		changes["disabled"] = user.Disabled
+	}
+	audit(c, "user.update", username, changes)
+	c.JSON(http.StatusOK, gin.H{"success": true, "user": summary})
+}
+
+// DeleteUser removes an account together with everything the user owns, or
+// hands their transfer items, versions, scripts and wallpapers to the user
+// named by ?transferTo=.
+func DeleteUser(c *gin.Context) {
 	username := c.Param("usr")
-	if username == "" || username == "admin" {
+	if !isManagedUsername(username) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid username"})
 		return
 	}
+	heir := c.Query("transferTo")
+	if heir != "" {
+		if heir == username || (heir != "admin" && !isManagedUsername(heir)) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid transferTo"})
+			return
+		}
+		if _, err := loadUser(heir); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Transfer target not found"})
+			return
+		}
+	}
 
 	userFile := filepath.Join(config.UsersDir, username+".json")
-	if err := os.Remove(userFile); err != nil {
+	if err := storage.Remove(userFile); err != nil {
+		if os.IsNotExist(err) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete user"})
 		return
 	}
+	revokeUserSessions(username, "")
+	middleware.DeleteUserAPITokens(username)
+	moveUserData(username, heir)
+	if err := moveShareLinks(username, ""); err != nil {
+		log.Printf("Failed to delete share links of %s: %v", username, err)
+	}
+	audit(c, "user.delete", username, gin.H{"transferTo": heir})
 
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
@@ -331,34 +606,29 @@ type GenerateInviteCodeRequest struct {
 	MaxUses     int    `json:"maxUses"`     // 0 for unlimited
 	ExpiresIn   int    `json:"expiresIn"`   // Days until expiration, 0 for never
 	Description string `json:"description"`
+	Role        string `json:"role"`     // Role of accounts registered with the code
+	Template    string `json:"template"` // "default" or a config version ID
 }
 
 func GetInviteCodes(c *gin.Context) {
-	username := c.GetString("username")
-	if username != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
-		return
-	}
-
-	inviteCodesFile := filepath.Join(config.DataDir, "invite_codes.json")
 	var inviteCodes []models.InviteCode
-	utils.ReadJSON(inviteCodesFile, &inviteCodes)
+	utils.ReadJSON(getInviteCodesFile(), &inviteCodes)
 
 	c.JSON(http.StatusOK, gin.H{"success": true, "codes": inviteCodes})
 }
 
 func GenerateInviteCode(c *gin.Context) {
 	username := c.GetString("username")
-	if username != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
-		return
-	}
 
 	var req GenerateInviteCodeRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 		return
 	}
+	if msg := validateInviteDefaults(c, req.Role, req.Template); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
 
 	// Generate random code
 	bytes := make([]byte, 8)
@@ -379,56 +649,46 @@ func GenerateInviteCode(c *gin.Context) {
 		ExpiresAt:   expiresAt,
 		IsActive:    true,
 		Description: req.Description,
+		Role:        req.Role,
+		Template:    req.Template,
 	}
 
-	inviteCodesFile := filepath.Join(config.DataDir, "invite_codes.json")
-	var inviteCodes []models.InviteCode
-	utils.ReadJSON(inviteCodesFile, &inviteCodes)
-	inviteCodes = append(inviteCodes, newCode)
-
-	if err := utils.WriteJSON(inviteCodesFile, inviteCodes); err != nil {
+	err := updateInviteCodes(func(codes []models.InviteCode) ([]models.InviteCode, error) {
+		return append(codes, newCode), nil
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save invite code"})
 		return
 	}
 
+	audit(c, "invite.create", code, gin.H{"maxUses": req.MaxUses, "expiresAt": expiresAt, "role": req.Role, "template": req.Template})
 	c.JSON(http.StatusOK, gin.H{"success": true, "code": newCode})
 }
 
 func DeleteInviteCode(c *gin.Context) {
-	username := c.GetString("username")
-	if username != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
-		return
-	}
-
 	code := c.Param("code")
 	if code == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Code required"})
 		return
 	}
 
-	inviteCodesFile := filepath.Join(config.DataDir, "invite_codes.json")
-	var inviteCodes []models.InviteCode
-	utils.ReadJSON(inviteCodesFile, &inviteCodes)
-
-	found := false
-	for i, inviteCode := range inviteCodes {
-		if inviteCode.Code == code {
-			inviteCodes = append(inviteCodes[:i], inviteCodes[i+1:]...)
-			found = true
-			break
+	err := updateInviteCodes(func(codes []models.InviteCode) ([]models.InviteCode, error) {
+		for i, inviteCode := range codes {
+			if inviteCode.Code == code {
+				return append(codes[:i], codes[i+1:]...), nil
+			}
 		}
-	}
-
-	if !found {
+		return nil, os.ErrNotExist
+	})
+	if os.IsNotExist(err) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Invite code not found"})
 		return
 	}
-
-	if err := utils.WriteJSON(inviteCodesFile, inviteCodes); err != nil {
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete invite code"})
 		return
 	}
 
+	audit(c, "invite.delete", code, nil)
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	defaultChallengeDifficulty = 16
+	maxChallengeDifficulty     = 28
+	challengeTTL               = 2 * time.Minute
+	challengeHeader            = "X-Challenge"
+	challengeSolutionHeader    = "X-Challenge-Solution"
+)
+
+// challengeActions are the endpoints a puzzle can be solved for. A solution
+// only unlocks the action it was issued for.
+var challengeActions = map[string]bool{"login": true, "register": true, "visitor": true}
+
+var (
+	spentChallenges   = make(map[string]time.Time) // Nonce to expiry
+	spentChallengesMu sync.Mutex
+)
+
+// PowChallengeClaims is a puzzle: find a counter so that the SHA-256 of
+// "nonce:counter" starts with Difficulty zero bits.
+type PowChallengeClaims struct {
+	Nonce      string `json:"nonce"`
+	Difficulty int    `json:"difficulty"`
+	jwt.RegisteredClaims
+}
+
+func challengeDifficulty(cc *models.ChallengeConfig) int {
+	if cc == nil || cc.Difficulty <= 0 {
+		return defaultChallengeDifficulty
+	}
+	return cc.Difficulty
+}
+
+// challengeRequired reports whether action needs a solved puzzle from ip.
+// The visitor counter has no failures, so it only asks when always enabled.
+func challengeRequired(cc *models.ChallengeConfig, action, ip string) bool {
+	if cc == nil {
+		return false
+	}
+	if cc.Enabled {
+		return true
+	}
+	return action != "visitor" && cc.AfterFailures > 0 && loginFailures(ip) >= cc.AfterFailures
+}
+
+func leadingZeroBits(sum [32]byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// spendChallenge marks nonce as used and reports whether it was fresh.
+func spendChallenge(nonce string, expires time.Time) bool {
+	spentChallengesMu.Lock()
+	defer spentChallengesMu.Unlock()
+	now := time.Now()
+	for n, exp := range spentChallenges {
+		if exp.Before(now) {
+			delete(spentChallenges, n)
+		}
+	}
+	if _, ok := spentChallenges[nonce]; ok {
+		return false
+	}
+	spentChallenges[nonce] = expires
+	return true
+}
+
+// verifyChallenge checks the puzzle and solution sent in the request headers.
+// A puzzle can be used once.
+func verifyChallenge(c *gin.Context, cc *models.ChallengeConfig, action string) bool {
+	claims := &PowChallengeClaims{}
+	tok, err := utils.ParseToken(config.KeyPurposeChallenge, c.GetHeader(challengeHeader), claims, jwt.WithSubject("pow:"+action))
+	if err != nil || tok == nil || !tok.Valid || claims.Nonce == "" || claims.ExpiresAt == nil {
+		return false
+	}
+	// Puzzles issued before the difficulty was raised are not accepted
+	if claims.Difficulty < challengeDifficulty(cc) {
+		return false
+	}
+	solution := c.GetHeader(challengeSolutionHeader)
+	if _, err := strconv.ParseUint(solution, 10, 64); err != nil {
+		return false
+	}
+	if leadingZeroBits(sha256.Sum256([]byte(claims.Nonce+":"+solution))) < claims.Difficulty {
+		return false
+	}
+	return spendChallenge(claims.Nonce, claims.ExpiresAt.Time)
+}
+
+// requireChallenge lets the request through when no puzzle is needed or a
+// valid solution was sent. Otherwise it responds and returns false.
+func requireChallenge(c *gin.Context, sysConfig *models.SystemConfig, action string) bool {
+	cc := sysConfig.Challenge
+	if !challengeRequired(cc, action, c.ClientIP()) || verifyChallenge(c, cc, action) {
+		return true
+	}
+	c.JSON(http.StatusPreconditionRequired, gin.H{
+		"error":             "需要完成人机验证",
+		"challengeRequired": true,
+		"action":            action,
+	})
+	return false
+}
+
+// GetChallenge issues a puzzle for ?action=. required tells the client
+// whether it has to be solved right now.
+func GetChallenge(c *gin.Context) {
+	action := c.Query("action")
+	if !challengeActions[action] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid action"})
+		return
+	}
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+
+	nonce, err := randomHex(16)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create challenge"})
+		return
+	}
+	difficulty := challengeDifficulty(sysConfig.Challenge)
+	now := time.Now()
+	signed, err := utils.SignToken(config.KeyPurposeChallenge, PowChallengeClaims{
+		Nonce:      nonce,
+		Difficulty: difficulty,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "pow:" + action,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(challengeTTL)),
+		},
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign token"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"required":   challengeRequired(sysConfig.Challenge, action, c.ClientIP()),
+		"challenge":  signed,
+		"nonce":      nonce,
+		"difficulty": difficulty,
+		"expiresIn":  int64(challengeTTL / time.Second),
+	})
+}
+
+// parseChallengeConfig validates the challenge section of a system config
+// update.
+func parseChallengeConfig(raw interface{}) (*models.ChallengeConfig, string) {
+	if raw == nil {
+		return nil, ""
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, "Invalid challenge"
+	}
+	var cc models.ChallengeConfig
+	if err := json.Unmarshal(data, &cc); err != nil {
+		return nil, "Invalid challenge"
+	}
+	if cc.Difficulty < 0 || cc.Difficulty > maxChallengeDifficulty || cc.AfterFailures < 0 {
+		return nil, "Invalid challenge difficulty"
+	}
+	return &cc, ""
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func solveChallenge(nonce string, difficulty int) string {
+	for i := 0; ; i++ {
+		counter := strconv.Itoa(i)
+		if leadingZeroBits(sha256.Sum256([]byte(nonce+":"+counter))) >= difficulty {
+			return counter
+		}
+	}
+}
+
+func TestLoginRequiresSolvedChallenge(t *testing.T) {
+	setupDataDir(t, models.SystemConfig{
+		AuthMode:  "multi",
+		Challenge: &models.ChallengeConfig{Enabled: true, Difficulty: 8},
+	})
+	hashed, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	utils.WriteJSON(filepath.Join(config.UsersDir, "alice.json"), models.User{Username: "alice", Password: string(hashed)})
+
+	r := gin.New()
+	r.POST("/api/login", Login)
+	r.GET("/api/challenge", GetChallenge)
+	login := func(challenge, solution string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(`{"username":"alice","password":"secret"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(challengeHeader, challenge)
+		req.Header.Set(challengeSolutionHeader, solution)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := login("", ""); code != http.StatusPreconditionRequired {
+		t.Fatalf("expected a challenge to be required, got %d", code)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/challenge?action=login", nil))
+	var issued struct {
+		Challenge  string `json:"challenge"`
+		Nonce      string `json:"nonce"`
+		Difficulty int    `json:"difficulty"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &issued)
+	if issued.Difficulty != 8 {
+		t.Fatalf("unexpected challenge %s", w.Body.String())
+	}
+
+	solution := solveChallenge(issued.Nonce, issued.Difficulty)
+	wrong := strconv.Itoa(-1)
+	if code := login(issued.Challenge, wrong); code != http.StatusPreconditionRequired {
+		t.Fatalf("expected a bad solution to fail, got %d", code)
+	}
+	if code := login(issued.Challenge, solution); code != http.StatusOK {
+		t.Fatalf("expected login with solved challenge, got %d", code)
+	}
+	if code := login(issued.Challenge, solution); code != http.StatusPreconditionRequired {
+		t.Fatalf("expected a solved challenge to be single use, got %d", code)
+	}
+}
@@ -0,0 +1,637 @@
+package handlers
+
+import (
+	"errors"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The endpoints below edit single groups, items and widgets of the
+// dashboard, so scripts do not have to post the whole document to SaveData.
+// Every edit bumps the revision like a full save does.
+
+// dashboardError is a failed edit reported to the client as is.
+type dashboardError struct {
+	status int
+	msg    string
+	fields []FieldError
+}
+
+func (e *dashboardError) Error() string { return e.msg }
+
+var errRevisionConflict = errors.New("revision conflict")
+
+var errGroupFull = &dashboardError{status: http.StatusBadRequest, msg: fmt.Sprintf("A group holds at most %d items", maxItemsPerGroup)}
+
+func invalidFields(errs []FieldError) error {
+	return &dashboardError{status: http.StatusBadRequest, msg: "数据校验失败", fields: errs}
+}
+
+var widgetLayoutNames = map[string]bool{"desktop": true, "tablet": true, "mobile": true}
+
+type ReorderGroupsRequest struct {
+	IDs []string `json:"ids" binding:"required"`
+}
+
+type MoveGroupItemRequest struct {
+	GroupID  string `json:"groupId"`
+	Position *int   `json:"position"` // Defaults to the end of the group
+}
+
+// editDashboard applies fn to the dashboard of the user under its lock and
+// saves the result with the next revision. An If-Match header is honoured
+// like on full saves, but not required.
+func editDashboard(c *gin.Context, fn func(doc map[string]interface{}) (gin.H, error)) {
+	userFile := userFilePath(c.GetString("username"))
+	var result gin.H
+	var rev int64
+	err := utils.WithFileLock(userFile, func() error {
+		var doc map[string]interface{}
+		if err := utils.ReadJSONUnlocked(userFile, &doc); err != nil || doc == nil {
+			return &dashboardError{status: http.StatusNotFound, msg: "User data not found"}
+		}
+		if c.GetHeader("If-Match") != "" {
+			expected, anyRevision, ok := requestedRevision(c, nil)
+			if !ok {
+				return &dashboardError{status: http.StatusBadRequest, msg: "Invalid If-Match revision"}
+			}
+			if !anyRevision && expected != documentRevision(doc) {
+				rev = documentRevision(doc)
+				return errRevisionConflict
+			}
+		}
+		var err error
+		if result, err = fn(doc); err != nil {
+			return err
+		}
+		rev = bumpRevision(doc, doc)
+		return utils.WriteJSONUnlocked(userFile, doc)
+	})
+
+	var de *dashboardError
+	switch {
+	case errors.Is(err, errRevisionConflict):
+		respondRevisionConflict(c, rev)
+		return
+	case errors.As(err, &de) && de.fields != nil:
+		respondFieldErrors(c, de.fields)
+		return
+	case errors.As(err, &de):
+		c.JSON(de.status, gin.H{"error": de.msg})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save data"})
+		return
+	}
+	if result == nil {
+		result = gin.H{}
+	}
+	result["success"] = true
+	result["revision"] = rev
+	c.Header("ETag", revisionETag(rev))
+	c.JSON(http.StatusOK, result)
+}
+
+// readDashboard returns the dashboard of the user for the list endpoints.
+func readDashboard(c *gin.Context) (map[string]interface{}, bool) {
+	var doc map[string]interface{}
+	if err := utils.ReadJSON(userFilePath(c.GetString("username")), &doc); err != nil || doc == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User data not found"})
+		return nil, false
+	}
+	c.Header("ETag", revisionETag(documentRevision(doc)))
+	return doc, true
+}
+
+// bindFields reads the request body as a JSON object.
+func bindFields(c *gin.Context) (map[string]interface{}, bool) {
+	var fields map[string]interface{}
+	if err := c.ShouldBindJSON(&fields); err != nil || fields == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return nil, false
+	}
+	return fields, true
+}
+
+// queryPosition reads the optional position query parameter. Without one
+// new entries are appended.
+func queryPosition(c *gin.Context) (int, bool) {
+	raw := c.Query("position")
+	if raw == "" {
+		return -1, true
+	}
+	pos, err := strconv.Atoi(raw)
+	if err != nil || pos < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid position"})
+		return 0, false
+	}
+	return pos, true
+}
+
+// applyPatch merges patch into entry. A null value removes the field and
+// the ID can not be changed.
+func applyPatch(entry, patch map[string]interface{}) {
+	for k, v := range patch {
+		if k == "id" {
+			continue
+		}
+		if v == nil {
+			delete(entry, k)
+		} else {
+			entry[k] = v
+		}
+	}
+}
+
+func docEntries(doc map[string]interface{}, key string) []interface{} {
+	list, _ := doc[key].([]interface{})
+	return list
+}
+
+func findEntry(list []interface{}, id string) (int, map[string]interface{}) {
+	for i, e := range list {
+		if m, ok := e.(map[string]interface{}); ok {
+			if entryID, _ := m["id"].(string); entryID == id {
+				return i, m
+			}
+		}
+	}
+	return -1, nil
+}
+
+// findItem returns the group holding the item id and its index in there.
+func findItem(groups []interface{}, id string) (map[string]interface{}, int, map[string]interface{}) {
+	for _, g := range groups {
+		group, ok := g.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if i, item := findEntry(docEntries(group, "items"), id); item != nil {
+			return group, i, item
+		}
+	}
+	return nil, -1, nil
+}
+
+func insertAt(list []interface{}, pos int, v interface{}) []interface{} {
+	if pos < 0 || pos >= len(list) {
+		return append(list, v)
+	}
+	list = append(list, nil)
+	copy(list[pos+1:], list[pos:])
+	list[pos] = v
+	return list
+}
+
+func removeAt(list []interface{}, i int) []interface{} {
+	return append(list[:i:i], list[i+1:]...)
+}
+
+// assignID gives entry a new ID unless it brings one, which must not be
+// taken according to taken.
+func assignID(entry map[string]interface{}, taken func(id string) bool) error {
+	if id, ok := entry["id"].(string); ok && id != "" {
+		if taken(id) {
+			return &dashboardError{status: http.StatusConflict, msg: "ID already exists: " + id}
+		}
+		return nil
+	}
+	for {
+		id, err := randomHex(8)
+		if err != nil {
+			return err
+		}
+		if !taken(id) {
+			entry["id"] = id
+			return nil
+		}
+	}
+}
+
+func setDefault(entry map[string]interface{}, key string, value interface{}) {
+	if _, ok := entry[key]; !ok {
+		entry[key] = value
+	}
+}
+
+func itemTaken(groups []interface{}) func(string) bool {
+	return func(id string) bool {
+		_, _, item := findItem(groups, id)
+		return item != nil
+	}
+}
+
+// checkItem checks an item sent to the item endpoints, which unlike full
+// saves need a title and an address.
+func checkItem(path string, fields map[string]interface{}) []FieldError {
+	errs := append(checkFields(path, fields, itemType), checkSizes(path, fields)...)
+	if title, _ := fields["title"].(string); strings.TrimSpace(title) == "" {
+		errs = append(errs, FieldError{joinPath(path, "title"), "is required"})
+	}
+	url, _ := fields["url"].(string)
+	lanURL, _ := fields["lanUrl"].(string)
+	if strings.TrimSpace(url) == "" && strings.TrimSpace(lanURL) == "" {
+		errs = append(errs, FieldError{joinPath(path, "url"), "is required"})
+	}
+	return errs
+}
+
+func checkGroup(fields map[string]interface{}) []FieldError {
+	errs := checkFields("", fields, groupType, "items")
+	for k, v := range fields {
+		if k != "items" {
+			errs = append(errs, checkSizes(k, v)...)
+		}
+	}
+	if title, _ := fields["title"].(string); strings.TrimSpace(title) == "" {
+		errs = append(errs, FieldError{"title", "is required"})
+	}
+	items, listErrs := objectList("", fields, "items")
+	errs = append(errs, listErrs...)
+	if len(items) > maxItemsPerGroup {
+		errs = append(errs, FieldError{"items", fmt.Sprintf("has more than %d entries", maxItemsPerGroup)})
+	}
+	for i, item := range items {
+		errs = append(errs, checkItem(fmt.Sprintf("items[%d]", i), item)...)
+	}
+	return errs
+}
+
+func checkWidget(fields map[string]interface{}) []FieldError {
+	errs := append(checkWidgetFields("", fields), checkSizes("", fields)...)
+	if typ, _ := fields["type"].(string); strings.TrimSpace(typ) == "" {
+		errs = append(errs, FieldError{"type", "is required"})
+	}
+	return errs
+}
+
+func GetGroups(c *gin.Context) {
+	doc, ok := readDashboard(c)
+	if !ok {
+		return
+	}
+	groups := docEntries(doc, "groups")
+	if groups == nil {
+		groups = []interface{}{}
+	}
+	c.JSON(http.StatusOK, gin.H{"groups": groups, "revision": documentRevision(doc)})
+}
+
+func CreateGroup(c *gin.Context) {
+	fields, ok := bindFields(c)
+	if !ok {
+		return
+	}
+	pos, ok := queryPosition(c)
+	if !ok {
+		return
+	}
+	if errs := checkGroup(fields); len(errs) > 0 {
+		respondFieldErrors(c, errs)
+		return
+	}
+	editDashboard(c, func(doc map[string]interface{}) (gin.H, error) {
+		groups := docEntries(doc, "groups")
+		if len(groups) >= maxGroups {
+			return nil, &dashboardError{status: http.StatusBadRequest, msg: fmt.Sprintf("At most %d groups are allowed", maxGroups)}
+		}
+		err := assignID(fields, func(id string) bool {
+			_, g := findEntry(groups, id)
+			return g != nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		items := docEntries(fields, "items")
+		if items == nil {
+			items = []interface{}{}
+		}
+		taken := itemTaken(groups)
+		seen := map[string]bool{}
+		for _, it := range items {
+			item := it.(map[string]interface{})
+			if err := assignID(item, func(id string) bool { return seen[id] || taken(id) }); err != nil {
+				return nil, err
+			}
+			seen[item["id"].(string)] = true
+			setDefault(item, "isPublic", false)
+		}
+		fields["items"] = items
+		doc["groups"] = insertAt(groups, pos, fields)
+		return gin.H{"group": fields}, nil
+	})
+}
+
+func UpdateGroup(c *gin.Context) {
+	patch, ok := bindFields(c)
+	if !ok {
+		return
+	}
+	if _, ok := patch["items"]; ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Items are changed through the item endpoints"})
+		return
+	}
+	editDashboard(c, func(doc map[string]interface{}) (gin.H, error) {
+		_, group := findEntry(docEntries(doc, "groups"), c.Param("id"))
+		if group == nil {
+			return nil, &dashboardError{status: http.StatusNotFound, msg: "Group not found"}
+		}
+		updated := map[string]interface{}{}
+		for k, v := range group {
+			if k != "items" {
+				updated[k] = v
+			}
+		}
+		applyPatch(updated, patch)
+		if errs := checkGroup(updated); len(errs) > 0 {
+			return nil, invalidFields(errs)
+		}
+		applyPatch(group, patch)
+		return gin.H{"group": group}, nil
+	})
+}
+
+func DeleteGroup(c *gin.Context) {
+	editDashboard(c, func(doc map[string]interface{}) (gin.H, error) {
+		groups := docEntries(doc, "groups")
+		i, group := findEntry(groups, c.Param("id"))
+		if group == nil {
+			return nil, &dashboardError{status: http.StatusNotFound, msg: "Group not found"}
+		}
+		doc["groups"] = removeAt(groups, i)
+		return nil, nil
+	})
+}
+
+// ReorderGroups puts the groups in the order of the given IDs, which have
+// to name every group exactly once.
+func ReorderGroups(c *gin.Context) {
+	var req ReorderGroupsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	editDashboard(c, func(doc map[string]interface{}) (gin.H, error) {
+		groups := docEntries(doc, "groups")
+		if len(req.IDs) != len(groups) {
+			return nil, &dashboardError{status: http.StatusBadRequest, msg: "Every group has to be listed once"}
+		}
+		ordered := make([]interface{}, 0, len(groups))
+		seen := map[string]bool{}
+		for _, id := range req.IDs {
+			_, group := findEntry(groups, id)
+			if group == nil || seen[id] {
+				return nil, &dashboardError{status: http.StatusBadRequest, msg: "Every group has to be listed once"}
+			}
+			seen[id] = true
+			ordered = append(ordered, group)
+		}
+		doc["groups"] = ordered
+		return nil, nil
+	})
+}
+
+func CreateGroupItem(c *gin.Context) {
+	fields, ok := bindFields(c)
+	if !ok {
+		return
+	}
+	pos, ok := queryPosition(c)
+	if !ok {
+		return
+	}
+	if errs := checkItem("", fields); len(errs) > 0 {
+		respondFieldErrors(c, errs)
+		return
+	}
+	editDashboard(c, func(doc map[string]interface{}) (gin.H, error) {
+		groups := docEntries(doc, "groups")
+		_, group := findEntry(groups, c.Param("id"))
+		if group == nil {
+			return nil, &dashboardError{status: http.StatusNotFound, msg: "Group not found"}
+		}
+		if len(docEntries(group, "items")) >= maxItemsPerGroup {
+			return nil, errGroupFull
+		}
+		if err := assignID(fields, itemTaken(groups)); err != nil {
+			return nil, err
+		}
+		setDefault(fields, "isPublic", false)
+		group["items"] = insertAt(docEntries(group, "items"), pos, fields)
+		return gin.H{"item": fields}, nil
+	})
+}
+
+func UpdateGroupItem(c *gin.Context) {
+	patch, ok := bindFields(c)
+	if !ok {
+		return
+	}
+	editDashboard(c, func(doc map[string]interface{}) (gin.H, error) {
+		_, group := findEntry(docEntries(doc, "groups"), c.Param("id"))
+		if group == nil {
+			return nil, &dashboardError{status: http.StatusNotFound, msg: "Group not found"}
+		}
+		_, item := findEntry(docEntries(group, "items"), c.Param("itemId"))
+		if item == nil {
+			return nil, &dashboardError{status: http.StatusNotFound, msg: "Item not found"}
+		}
+		updated := map[string]interface{}{}
+		for k, v := range item {
+			updated[k] = v
+		}
+		applyPatch(updated, patch)
+		if errs := checkItem("", updated); len(errs) > 0 {
+			return nil, invalidFields(errs)
+		}
+		applyPatch(item, patch)
+		return gin.H{"item": item}, nil
+	})
+}
+
+func DeleteGroupItem(c *gin.Context) {
+	editDashboard(c, func(doc map[string]interface{}) (gin.H, error) {
+		_, group := findEntry(docEntries(doc, "groups"), c.Param("id"))
+		if group == nil {
+			return nil, &dashboardError{status: http.StatusNotFound, msg: "Group not found"}
+		}
+		items := docEntries(group, "items")
+		i, item := findEntry(items, c.Param("itemId"))
+		if item == nil {
+			return nil, &dashboardError{status: http.StatusNotFound, msg: "Item not found"}
+		}
+		group["items"] = removeAt(items, i)
+		return nil, nil
+	})
+}
+
+// MoveGroupItem moves an item to a position in the same or another group.
+func MoveGroupItem(c *gin.Context) {
+	var req MoveGroupItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	pos := -1
+	if req.Position != nil {
+		if *req.Position < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid position"})
+			return
+		}
+		pos = *req.Position
+	}
+	editDashboard(c, func(doc map[string]interface{}) (gin.H, error) {
+		groups := docEntries(doc, "groups")
+		_, from := findEntry(groups, c.Param("id"))
+		if from == nil {
+			return nil, &dashboardError{status: http.StatusNotFound, msg: "Group not found"}
+		}
+		to := from
+		if req.GroupID != "" {
+			if _, to = findEntry(groups, req.GroupID); to == nil {
+				return nil, &dashboardError{status: http.StatusNotFound, msg: "Target group not found"}
+			}
+		}
+		items := docEntries(from, "items")
+		i, item := findEntry(items, c.Param("itemId"))
+		if item == nil {
+			return nil, &dashboardError{status: http.StatusNotFound, msg: "Item not found"}
+		}
+		if req.GroupID != "" && req.GroupID != c.Param("id") && len(docEntries(to, "items")) >= maxItemsPerGroup {
+			return nil, errGroupFull
+		}
+		from["items"] = removeAt(items, i)
+		to["items"] = insertAt(docEntries(to, "items"), pos, item)
+		return gin.H{"item": item}, nil
+	})
+}
+
+func GetWidgets(c *gin.Context) {
+	doc, ok := readDashboard(c)
+	if !ok {
+		return
+	}
+	widgets := docEntries(doc, "widgets")
+	if widgets == nil {
+		widgets = []interface{}{}
+	}
+	c.JSON(http.StatusOK, gin.H{"widgets": widgets, "revision": documentRevision(doc)})
+}
+
+func CreateWidget(c *gin.Context) {
+	fields, ok := bindFields(c)
+	if !ok {
+		return
+	}
+	if errs := checkWidget(fields); len(errs) > 0 {
+		respondFieldErrors(c, errs)
+		return
+	}
+	editDashboard(c, func(doc map[string]interface{}) (gin.H, error) {
+		widgets := docEntries(doc, "widgets")
+		if len(widgets) >= maxWidgets {
+			return nil, &dashboardError{status: http.StatusBadRequest, msg: fmt.Sprintf("At most %d widgets are allowed", maxWidgets)}
+		}
+		err := assignID(fields, func(id string) bool {
+			_, w := findEntry(widgets, id)
+			return w != nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		setDefault(fields, "enable", true)
+		setDefault(fields, "isPublic", false)
+		doc["widgets"] = append(widgets, fields)
+		return gin.H{"widget": fields}, nil
+	})
+}
+
+func UpdateWidget(c *gin.Context) {
+	patch, ok := bindFields(c)
+	if !ok {
+		return
+	}
+	editDashboard(c, func(doc map[string]interface{}) (gin.H, error) {
+		_, widget := findEntry(docEntries(doc, "widgets"), c.Param("id"))
+		if widget == nil {
+			return nil, &dashboardError{status: http.StatusNotFound, msg: "Widget not found"}
+		}
+		updated := map[string]interface{}{}
+		for k, v := range widget {
+			updated[k] = v
+		}
+		applyPatch(updated, patch)
+		if errs := checkWidget(updated); len(errs) > 0 {
+			return nil, invalidFields(errs)
+		}
+		applyPatch(widget, patch)
+		return gin.H{"widget": widget}, nil
+	})
+}
+
+func DeleteWidget(c *gin.Context) {
+	editDashboard(c, func(doc map[string]interface{}) (gin.H, error) {
+		widgets := docEntries(doc, "widgets")
+		i, widget := findEntry(widgets, c.Param("id"))
+		if widget == nil {
+			return nil, &dashboardError{status: http.StatusNotFound, msg: "Widget not found"}
+		}
+		doc["widgets"] = removeAt(widgets, i)
+		return nil, nil
+	})
+}
+
+// SetWidgetLayout places a widget in the grid of one screen size.
+func SetWidgetLayout(c *gin.Context) {
+	name := c.Param("name")
+	if !widgetLayoutNames[name] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown layout: " + name})
+		return
+	}
+	var layout models.WidgetLayout
+	if err := c.ShouldBindJSON(&layout); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid layout"})
+		return
+	}
+	if layout.X < 0 || layout.Y < 0 || layout.W < 1 || layout.H < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid layout"})
+		return
+	}
+	editDashboard(c, func(doc map[string]interface{}) (gin.H, error) {
+		_, widget := findEntry(docEntries(doc, "widgets"), c.Param("id"))
+		if widget == nil {
+			return nil, &dashboardError{status: http.StatusNotFound, msg: "Widget not found"}
+		}
+		layouts, _ := widget["layouts"].(map[string]interface{})
+		if layouts == nil {
+			layouts = map[string]interface{}{}
+		}
+		layouts[name] = layout
+		widget["layouts"] = layouts
+		return gin.H{"widget": widget}, nil
+	})
+}
+
+func DeleteWidgetLayout(c *gin.Context) {
+	editDashboard(c, func(doc map[string]interface{}) (gin.H, error) {
+		_, widget := findEntry(docEntries(doc, "widgets"), c.Param("id"))
+		if widget == nil {
+			return nil, &dashboardError{status: http.StatusNotFound, msg: "Widget not found"}
+		}
+		layouts, _ := widget["layouts"].(map[string]interface{})
+		if _, ok := layouts[c.Param("name")]; !ok {
+			return nil, &dashboardError{status: http.StatusNotFound, msg: "Layout not found"}
+		}
+		delete(layouts, c.Param("name"))
+		if len(layouts) == 0 {
+			delete(widget, "layouts")
+		}
+		return gin.H{"widget": widget}, nil
+	})
+}
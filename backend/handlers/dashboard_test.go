@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestDashboardEndpointsEditSingleEntries(t *testing.T) {
+	setupDataDir(t, models.SystemConfig{AuthMode: "multi"})
+	utils.WriteJSON(userFilePath("alice"), map[string]interface{}{
+		"username": "alice",
+		"password": "hash",
+		"groups": []interface{}{
+			map[string]interface{}{"id": "g1", "title": "Media", "cardLayout": "horizontal", "items": []interface{}{
+				map[string]interface{}{"id": "i1", "title": "Jellyfin", "url": "http://jf"},
+			}},
+		},
+		"widgets": []interface{}{},
+	})
+
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("username", "alice") })
+	r.POST("/api/groups", CreateGroup)
+	r.PUT("/api/groups/order", ReorderGroups)
+	r.PATCH("/api/groups/:id", UpdateGroup)
+	r.POST("/api/groups/:id/items", CreateGroupItem)
+	r.POST("/api/groups/:id/items/:itemId/move", MoveGroupItem)
+	r.POST("/api/widgets", CreateWidget)
+	r.PUT("/api/widgets/:id/layouts/:name", SetWidgetLayout)
+	send := func(method, path, ifMatch, body string) (int, map[string]interface{}) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var resp map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	if code, _ := send(http.MethodPost, "/api/groups/g1/items", "", `{"title":"Plex","url":42}`); code != http.StatusBadRequest {
+		t.Fatalf("expected item with a numeric URL to be refused, got %d", code)
+	}
+	if code, _ := send(http.MethodPost, "/api/groups/g1/items", "", `{"title":"Plex"}`); code != http.StatusBadRequest {
+		t.Fatalf("expected item without URL to be refused, got %d", code)
+	}
+	code, resp := send(http.MethodPost, "/api/groups/g1/items?position=0", "", `{"title":"Plex","url":"http://plex"}`)
+	if code != http.StatusOK || resp["revision"] != float64(1) {
+		t.Fatalf("expected item to be added at revision 1, got %d %v", code, resp)
+	}
+	plexID := resp["item"].(map[string]interface{})["id"].(string)
+
+	if code, _ := send(http.MethodPost, "/api/groups", `"0"`, `{"title":"Tools"}`); code != http.StatusConflict {
+		t.Fatalf("expected stale If-Match to conflict, got %d", code)
+	}
+	code, resp = send(http.MethodPost, "/api/groups", `"1"`, `{"id":"g2","title":"Tools"}`)
+	if code != http.StatusOK {
+		t.Fatalf("create group failed: %d %v", code, resp)
+	}
+	if code, _ := send(http.MethodPost, "/api/groups", "", `{"id":"g2","title":"Again"}`); code != http.StatusConflict {
+		t.Fatalf("expected duplicate group ID to be refused, got %d", code)
+	}
+	if code, _ := send(http.MethodPatch, "/api/groups/g1", "", `{"title":"Streaming","cardLayout":null}`); code != http.StatusOK {
+		t.Fatalf("update group failed: %d", code)
+	}
+	if code, _ := send(http.MethodPost, "/api/groups/g1/items/"+plexID+"/move", "", `{"groupId":"g2"}`); code != http.StatusOK {
+		t.Fatalf("move item failed: %d", code)
+	}
+	if code, _ := send(http.MethodPut, "/api/groups/order", "", `{"ids":["g2"]}`); code != http.StatusBadRequest {
+		t.Fatalf("expected incomplete order to be refused, got %d", code)
+	}
+	if code, _ := send(http.MethodPut, "/api/groups/order", "", `{"ids":["g2","g1"]}`); code != http.StatusOK {
+		t.Fatalf("reorder failed: %d", code)
+	}
+	code, resp = send(http.MethodPost, "/api/widgets", "", `{"type":"clock"}`)
+	if code != http.StatusOK {
+		t.Fatalf("create widget failed: %d %v", code, resp)
+	}
+	widgetID := resp["widget"].(map[string]interface{})["id"].(string)
+	if code, _ := send(http.MethodPut, "/api/widgets/"+widgetID+"/layouts/watch", "", `{"x":0,"y":0,"w":2,"h":2}`); code != http.StatusBadRequest {
+		t.Fatalf("expected unknown layout to be refused, got %d", code)
+	}
+	if code, _ := send(http.MethodPut, "/api/widgets/"+widgetID+"/layouts/desktop", "", `{"x":1,"y":0,"w":2,"h":2}`); code != http.StatusOK {
+		t.Fatalf("set layout failed: %d", code)
+	}
+
+	var doc struct {
+		Password string `json:"password"`
+		Revision int64  `json:"revision"`
+		Groups   []struct {
+			ID         string        `json:"id"`
+			Title      string        `json:"title"`
+			CardLayout string        `json:"cardLayout"`
+			Items      []models.Item `json:"items"`
+		} `json:"groups"`
+		Widgets []models.Widget `json:"widgets"`
+	}
+	utils.ReadJSON(userFilePath("alice"), &doc)
+	if doc.Password != "hash" || doc.Revision != 7 {
+		t.Fatalf("unexpected account fields or revision: %+v", doc)
+	}
+	if len(doc.Groups) != 2 || doc.Groups[0].ID != "g2" || doc.Groups[1].Title != "Streaming" || doc.Groups[1].CardLayout != "" {
+		t.Fatalf("unexpected groups %+v", doc.Groups)
+	}
+	if len(doc.Groups[0].Items) != 1 || doc.Groups[0].Items[0].Title != "Plex" || len(doc.Groups[1].Items) != 1 {
+		t.Fatalf("item was not moved: %+v", doc.Groups)
+	}
+	if len(doc.Widgets) != 1 || !doc.Widgets[0].Enable || doc.Widgets[0].Layouts["desktop"].X != 1 {
+		t.Fatalf("unexpected widgets %+v", doc.Widgets)
+	}
+}
@@ -1,24 +1,35 @@
 package handlers
 
 import (
+	"errors"
 	"flatnasgo-backend/config"
+	"flatnasgo-backend/middleware"
+	"flatnasgo-backend/migrations"
 	"flatnasgo-backend/models"
+	"flatnasgo-backend/storage"
 	"flatnasgo-backend/utils"
 	"net/http"
-	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// protectedUserKeys are user document fields that dashboard saves, imports,
+// resets and restores must never overwrite.
+var protectedUserKeys = []string{"role", "permissions", "twoFactor", "external", "webauthn", "mustChangePassword", "disabled", "publicPage"}
+
 func GetData(c *gin.Context) {
 	username := c.GetString("username")
 	isGuest := false
 	if username == "" {
 		username = "admin"
 		isGuest = true
+	} else if !middleware.HasPermission(c, models.PermDataRead) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+		return
 	}
 
 	var sysConfig models.SystemConfig
@@ -37,55 +48,24 @@ func GetData(c *gin.Context) {
 	}
 
 	// Remove password from response
-	delete(userData, "password")
+	for _, k := range secretUserKeys {
+		delete(userData, k)
+	}
 
 	if isGuest {
-		// Filter public items manually in the map structure
-		// This is tricky with untyped map, but necessary to preserve data integrity
-		if groups, ok := userData["groups"].([]interface{}); ok {
-			var filteredGroups []interface{}
-			for _, g := range groups {
-				if groupMap, ok := g.(map[string]interface{}); ok {
-					if items, ok := groupMap["items"].([]interface{}); ok {
-						var publicItems []interface{}
-						for _, item := range items {
-							if itemMap, ok := item.(map[string]interface{}); ok {
-								if isPublic, ok := itemMap["isPublic"].(bool); ok && isPublic {
-									publicItems = append(publicItems, itemMap)
-								}
-							}
-						}
-						// Only keep group if it has public items (or maybe keep empty groups?)
-						// Previous logic: if len(publicItems) > 0 { ... }
-						if len(publicItems) > 0 {
-							groupMap["items"] = publicItems
-							filteredGroups = append(filteredGroups, groupMap)
-						}
-					}
-				}
-			}
-			userData["groups"] = filteredGroups
-		}
-
-		if widgets, ok := userData["widgets"].([]interface{}); ok {
-			var filteredWidgets []interface{}
-			for _, w := range widgets {
-				if widgetMap, ok := w.(map[string]interface{}); ok {
-					if isPublic, ok := widgetMap["isPublic"].(bool); ok && isPublic {
-						filteredWidgets = append(filteredWidgets, widgetMap)
-					}
-				}
-			}
-			userData["widgets"] = filteredWidgets
-		}
+		filterPublicData(userData)
 	}
 
 	// Inject system config
+	redactSystemConfig(&sysConfig, middleware.HasPermission(c, models.PermSystemManage))
 	userData["systemConfig"] = sysConfig
 	// Inject username if missing (for consistency)
 	if _, ok := userData["username"]; !ok {
 		userData["username"] = username
 	}
+	rev := documentRevision(userData)
+	userData[revisionKey] = rev
+	c.Header("ETag", revisionETag(rev))
 
 	c.JSON(http.StatusOK, userData)
 }
@@ -130,7 +110,13 @@ func GetWidget(c *gin.Context) {
 	c.JSON(http.StatusNotFound, gin.H{"error": "Widget not found"})
 }
 
+// SaveData replaces the dashboard of the user. The save has to name the
+// revision it is based on and is refused with 409 when that is outdated.
 func SaveData(c *gin.Context) {
+	saveUserData(c, true)
+}
+
+func saveUserData(c *gin.Context, checkRevision bool) {
 	username := c.GetString("username")
 	if username == "" {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
@@ -138,11 +124,31 @@ func SaveData(c *gin.Context) {
 	}
 
 	// 1. Bind to map to capture EVERYTHING sent by frontend
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxDashboardBytes)
 	var payload map[string]interface{}
 	if err := c.ShouldBindJSON(&payload); err != nil {
+		if isBodyTooLarge(err) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "数据过大"})
+			return
+		}
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
 		return
 	}
+	// Imports may come from older releases. Passwords are kept from the
+	// stored document below, so the payload's is not worth hashing.
+	delete(payload, "password")
+	if !upgradeDashboard(c, payload) {
+		return
+	}
+	normalized, fieldErrs, err := normalizeDashboard(payload)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save data"})
+		return
+	}
+	if len(fieldErrs) > 0 {
+		respondFieldErrors(c, fieldErrs)
+		return
+	}
 
 	var sysConfig models.SystemConfig
 	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
@@ -152,27 +158,81 @@ func SaveData(c *gin.Context) {
 		userFile = filepath.Join(config.DataDir, "data.json")
 	}
 
-	// 2. Read existing data to map to preserve EVERYTHING in file
-	var existingData map[string]interface{}
-	utils.ReadJSON(userFile, &existingData)
-	if existingData == nil {
-		existingData = make(map[string]interface{})
+	expected, anyRevision, hasRevision := requestedRevision(c, payload)
+	if checkRevision && !hasRevision {
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "Missing If-Match revision"})
+		return
 	}
+	delete(payload, revisionKey)
 
-	// 3. Handle Password Hashing
-	// Check if payload has a password string
-	if pwd, ok := payload["password"].(string); ok && pwd != "" {
-		// Hash new password
-		hashed, err := utils.HashPassword(pwd)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
-			return
+	var rev int64
+	conflict := false
+	err = utils.WithFileLock(userFile, func() error {
+		// 2. Read existing data to map to preserve EVERYTHING in file
+		var existingData map[string]interface{}
+		utils.ReadJSONUnlocked(userFile, &existingData)
+		if existingData == nil {
+			existingData = make(map[string]interface{})
+		}
+		if checkRevision && !anyRevision && expected != documentRevision(existingData) {
+			rev = documentRevision(existingData)
+			conflict = true
+			return nil
 		}
-		payload["password"] = hashed
+		mergeSavedData(payload, existingData, username)
+		rev = bumpRevision(payload, existingData)
+		return utils.WriteJSONUnlocked(userFile, payload)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save data"})
+		return
+	}
+	if conflict {
+		respondRevisionConflict(c, rev)
+		return
+	}
+
+	c.Header("ETag", revisionETag(rev))
+	resp := gin.H{"success": true, "revision": rev}
+	if normalized {
+		// The client keeps using the IDs it sent unless it gets the new ones
+		resp["groups"] = payload["groups"]
+		resp["widgets"] = payload["widgets"]
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// upgradeDashboard brings a dashboard from an import, a config version or
+// the default template to the current schema. Dashboards written by a newer
+// release are refused.
+func upgradeDashboard(c *gin.Context, doc map[string]interface{}) bool {
+	if _, err := migrations.Upgrade(migrations.User, doc); err != nil {
+		if errors.Is(err, migrations.ErrNewerSchema) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "数据来自更新版本的 FlatNas，无法载入"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upgrade data"})
+		}
+		return false
+	}
+	return true
+}
+
+// mergeSavedData completes a dashboard save with what the client may not
+// change or did not send.
+func mergeSavedData(payload, existingData map[string]interface{}, username string) {
+	// 3. Passwords are changed through ChangePassword only
+	if existingPwd, ok := existingData["password"]; ok {
+		payload["password"] = existingPwd
 	} else {
-		// Keep existing password
-		if existingPwd, ok := existingData["password"]; ok {
-			payload["password"] = existingPwd
+		delete(payload, "password")
+	}
+
+	// Account fields are managed through the admin endpoints only
+	for _, k := range protectedUserKeys {
+		if v, ok := existingData[k]; ok {
+			payload[k] = v
+		} else {
+			delete(payload, k)
 		}
 	}
 
@@ -188,29 +248,20 @@ func SaveData(c *gin.Context) {
 		}
 	}
 
-	// Clean up legacy "items" field if "groups" is present in payload
-	// This prevents the issue where deleting all groups causes legacy items to reappear as a "Default Group"
-	if _, hasGroups := payload["groups"]; hasGroups {
-		delete(payload, "items")
-	}
-
 	// Ensure username is set
 	if _, ok := payload["username"]; !ok {
 		payload["username"] = username
 	}
-
-	if err := utils.WriteJSON(userFile, payload); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save data"})
-		return
-	}
-
-	c.JSON(http.StatusOK, gin.H{"success": true})
 }
 
 // ImportData handles importing JSON configuration
 func ImportData(c *gin.Context) {
-	// Re-use SaveData logic as it handles the exact same payload structure
-	SaveData(c)
+	// Re-use SaveData logic as it handles the exact same payload structure.
+	// An import replaces the dashboard whatever revision it was exported at.
+	saveUserData(c, false)
+	if c.Writer.Status() == http.StatusOK {
+		audit(c, "data.import", c.GetString("username"), nil)
+	}
 }
 
 func SaveDefault(c *gin.Context) {
@@ -241,6 +292,10 @@ func SaveDefault(c *gin.Context) {
 	delete(userData, "password")
 	delete(userData, "username")
 	delete(userData, "created_at")
+	delete(userData, revisionKey)
+	for _, k := range protectedUserKeys {
+		delete(userData, k)
+	}
 
 	// Save to default.json
 	if err := utils.WriteJSON(config.DefaultFile, userData); err != nil {
@@ -264,6 +319,9 @@ func ResetData(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Default template not found"})
 		return
 	}
+	if !upgradeDashboard(c, defaultData) {
+		return
+	}
 
 	// Determine user file
 	var sysConfig models.SystemConfig
@@ -279,6 +337,9 @@ func ResetData(c *gin.Context) {
 	utils.ReadJSON(userFile, &currentData)
 
 	// Merge: Use default data, but keep current password and username
+	for _, k := range protectedUserKeys {
+		delete(defaultData, k)
+	}
 	if currentData != nil {
 		if pwd, ok := currentData["password"]; ok {
 			defaultData["password"] = pwd
@@ -286,33 +347,58 @@ func ResetData(c *gin.Context) {
 		if usr, ok := currentData["username"]; ok {
 			defaultData["username"] = usr
 		}
+		for _, k := range protectedUserKeys {
+			if v, ok := currentData[k]; ok {
+				defaultData[k] = v
+			}
+		}
 	} else {
 		// If current data is missing, ensure username is set
 		defaultData["username"] = username
 		// Password might be missing if it was empty
 	}
+	rev := bumpRevision(defaultData, currentData)
 
 	if err := utils.WriteJSON(userFile, defaultData); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset data"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"success": true})
+	audit(c, "data.reset", username, nil)
+	c.JSON(http.StatusOK, gin.H{"success": true, "revision": rev})
+}
+
+// redactSystemConfig strips secrets from a system config before it is sent
+// out. Authentication settings are only shown to admins.
+func redactSystemConfig(sysConfig *models.SystemConfig, admin bool) {
+	if !admin {
+		sysConfig.ProxyAuth = nil
+		sysConfig.LDAP = nil
+		sysConfig.Network = nil
+		if oc := sysConfig.OIDC; oc != nil {
+			sysConfig.OIDC = &models.OIDCConfig{Enabled: oc.Enabled, ButtonText: oc.ButtonText}
+		}
+	}
+	if sysConfig.OIDC != nil {
+		oc := *sysConfig.OIDC
+		oc.ClientSecret = ""
+		sysConfig.OIDC = &oc
+	}
+	if sysConfig.LDAP != nil {
+		lc := *sysConfig.LDAP
+		lc.BindPassword = ""
+		sysConfig.LDAP = &lc
+	}
 }
 
 func GetSystemConfig(c *gin.Context) {
 	var sysConfig models.SystemConfig
 	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	redactSystemConfig(&sysConfig, middleware.HasPermission(c, models.PermSystemManage))
 	c.JSON(http.StatusOK, sysConfig)
 }
 
 func UpdateSystemConfig(c *gin.Context) {
-	username := c.GetString("username")
-	if username != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
-		return
-	}
-
 	var payload map[string]interface{}
 	if err := c.ShouldBindJSON(&payload); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
@@ -339,24 +425,87 @@ func UpdateSystemConfig(c *gin.Context) {
 	if v, ok := payload["allowRegistration"].(bool); ok {
 		sysConfig.AllowRegistration = v
 	}
+	if raw, ok := payload["proxyAuth"]; ok {
+		pa, msg := parseProxyAuthConfig(raw)
+		if msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+		sysConfig.ProxyAuth = pa
+	}
+	if raw, ok := payload["oidc"]; ok {
+		oc, msg := parseOIDCConfig(raw, sysConfig.OIDC)
+		if msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+		sysConfig.OIDC = oc
+	}
+	if raw, ok := payload["ldap"]; ok {
+		lc, msg := parseLDAPConfig(raw, sysConfig.LDAP)
+		if msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+		sysConfig.LDAP = lc
+	}
+	if raw, ok := payload["passwordPolicy"]; ok {
+		pp, msg := parsePasswordPolicy(raw)
+		if msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+		sysConfig.PasswordPolicy = pp
+	}
+	if raw, ok := payload["challenge"]; ok {
+		cc, msg := parseChallengeConfig(raw)
+		if msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+		sysConfig.Challenge = cc
+	}
+	if raw, ok := payload["webauthn"]; ok {
+		wc, msg := parseWebAuthnConfig(raw)
+		if msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+		sysConfig.WebAuthn = wc
+	}
+	if raw, ok := payload["network"]; ok {
+		nc, msg := parseNetworkConfig(c, raw)
+		if msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+			return
+		}
+		sysConfig.Network = nc
+	}
 
 	if err := utils.WriteJSON(config.SystemConfigFile, sysConfig); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update system config"})
 		return
 	}
 
+	// Only the names of the changed sections are logged, never their secrets
+	keys := make([]string, 0, len(payload))
+	for k := range payload {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	audit(c, "system.config.update", "", gin.H{"keys": keys})
+
+	redactSystemConfig(&sysConfig, true)
 	c.JSON(http.StatusOK, sysConfig)
 }
 
 func StartDataWarmup() {
 	go func() {
 		dataFile := filepath.Join(config.DataDir, "data.json")
-		if _, err := os.Stat(dataFile); err != nil {
-			if os.IsNotExist(err) {
-				time.Sleep(5 * time.Second)
-			} else {
-				return
-			}
+		if exists, err := storage.Exists(dataFile); err != nil {
+			return
+		} else if !exists {
+			time.Sleep(5 * time.Second)
 		}
 
 		var payload map[string]interface{}
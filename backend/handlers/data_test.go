@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSaveDataRejectsStaleRevision(t *testing.T) {
+	setupDataDir(t, models.SystemConfig{AuthMode: "multi"})
+	utils.WriteJSON(userFilePath("alice"), map[string]interface{}{"username": "alice", "password": "hash", "groups": []interface{}{}})
+
+	r := gin.New()
+	asAlice := func(c *gin.Context) {
+		c.Set("username", "alice")
+		c.Set("permissions", []string{models.PermDataRead, models.PermDataWrite})
+	}
+	r.GET("/api/data", asAlice, GetData)
+	r.POST("/api/save", asAlice, SaveData)
+	r.POST("/api/data/import", asAlice, ImportData)
+	save := func(path, ifMatch, body string) (int, int64) {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var resp struct {
+			Revision int64 `json:"revision"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp.Revision
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/data", nil))
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"0"` {
+		t.Fatalf("expected revision 0, got %d %q", w.Code, w.Header().Get("ETag"))
+	}
+
+	if code, _ := save("/api/save", "", `{"groups":[]}`); code != http.StatusPreconditionRequired {
+		t.Fatalf("expected save without revision to be refused, got %d", code)
+	}
+	if code, rev := save("/api/save", `"0"`, `{"groups":[{"id":"laptop"}]}`); code != http.StatusOK || rev != 1 {
+		t.Fatalf("expected first save to succeed with revision 1, got %d %d", code, rev)
+	}
+	if code, rev := save("/api/save", `"0"`, `{"groups":[{"id":"tablet"}]}`); code != http.StatusConflict || rev != 1 {
+		t.Fatalf("expected stale save to conflict at revision 1, got %d %d", code, rev)
+	}
+	if code, rev := save("/api/save", "", `{"revision":1,"groups":[{"id":"merged"}]}`); code != http.StatusOK || rev != 2 {
+		t.Fatalf("expected save with revision field to succeed, got %d %d", code, rev)
+	}
+	if code, rev := save("/api/data/import", "", `{"revision":0,"groups":[{"id":"imported"}]}`); code != http.StatusOK || rev != 3 {
+		t.Fatalf("expected import to ignore revisions, got %d %d", code, rev)
+	}
+
+	var stored map[string]interface{}
+	utils.ReadJSON(userFilePath("alice"), &stored)
+	if stored["password"] != "hash" || documentRevision(stored) != 3 {
+		t.Fatalf("unexpected stored document %v", stored)
+	}
+}
+
+func TestSaveDataValidatesAndNormalizes(t *testing.T) {
+	setupDataDir(t, models.SystemConfig{AuthMode: "multi"})
+	utils.WriteJSON(userFilePath("alice"), map[string]interface{}{"username": "alice", "password": "hash"})
+
+	r := gin.New()
+	r.POST("/api/save", func(c *gin.Context) { c.Set("username", "alice") }, SaveData)
+	var normalized map[string]interface{}
+	save := func(body string) (int, []FieldError) {
+		req := httptest.NewRequest(http.MethodPost, "/api/save", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("If-Match", "*")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var resp struct {
+			Fields []FieldError `json:"fields"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		normalized = nil
+		json.Unmarshal(w.Body.Bytes(), &normalized)
+		return w.Code, resp.Fields
+	}
+
+	code, fields := save(`{"groups":[{"id":"g1","items":[{"title":7},{"title":"ok","isPublic":"yes"}]}],"widgets":{}}`)
+	if code != http.StatusBadRequest || len(fields) != 3 {
+		t.Fatalf("expected three field errors, got %d %v", code, fields)
+	}
+	paths := map[string]bool{}
+	for _, f := range fields {
+		paths[f.Path] = true
+	}
+	if !paths["groups[0].items[0].title"] || !paths["groups[0].items[1].isPublic"] || !paths["widgets"] {
+		t.Fatalf("unexpected field errors %v", fields)
+	}
+
+	icon := "data:image/png;base64," + strings.Repeat("A", maxInlineImageBytes)
+	if code, fields := save(`{"groups":[{"items":[{"icon":"` + icon + `"}]}]}`); code != http.StatusBadRequest || len(fields) != 1 || fields[0].Path != "groups[0].items[0].icon" {
+		t.Fatalf("expected oversized icon to be refused, got %d %v", code, fields)
+	}
+
+	body := `{"groups":[{"items":[{"id":"a","title":"A"},{"id":"a","title":"B"},{"title":"C"}]},{"id":5}],` +
+		`"widgets":[{"type":"clock","x":1.6}],"customTheme":{"accent":"#fff"}}`
+	if code, fields := save(body); code != http.StatusOK {
+		t.Fatalf("expected save to succeed, got %d %v", code, fields)
+	}
+	var stored struct {
+		Groups []struct {
+			ID    string        `json:"id"`
+			Items []models.Item `json:"items"`
+		} `json:"groups"`
+		Widgets     []map[string]interface{} `json:"widgets"`
+		CustomTheme map[string]interface{}   `json:"customTheme"`
+	}
+	utils.ReadJSON(userFilePath("alice"), &stored)
+	if len(stored.Groups) != 2 || stored.Groups[0].ID == "" || stored.Groups[1].ID != "5" {
+		t.Fatalf("unexpected group IDs %+v", stored.Groups)
+	}
+	items := stored.Groups[0].Items
+	if items[0].ID != "a" || items[1].ID == "" || items[1].ID == "a" || items[2].ID == "" {
+		t.Fatalf("item IDs were not made unique: %+v", items)
+	}
+	if stored.Widgets[0]["id"] == nil || stored.Widgets[0]["x"] != float64(2) {
+		t.Fatalf("widget was not normalized: %v", stored.Widgets[0])
+	}
+	if stored.CustomTheme["accent"] != "#fff" {
+		t.Fatalf("unknown keys were dropped: %v", stored.CustomTheme)
+	}
+
+	// Generated IDs are sent back, so the client does not keep its own
+	groups, _ := normalized["groups"].([]interface{})
+	widgets, _ := normalized["widgets"].([]interface{})
+	if len(groups) != 2 || groups[0].(map[string]interface{})["id"] != stored.Groups[0].ID || len(widgets) != 1 || widgets[0].(map[string]interface{})["id"] != stored.Widgets[0]["id"] {
+		t.Fatalf("expected normalized groups and widgets in the response, got %v", normalized)
+	}
+	if code, _ := save(`{"groups":[{"id":"g1","items":[]}],"widgets":[]}`); code != http.StatusOK || normalized["groups"] != nil {
+		t.Fatalf("expected no data back when nothing was changed, got %d %v", code, normalized)
+	}
+}
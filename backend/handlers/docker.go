@@ -431,12 +431,6 @@ func GetDockerStatus(c *gin.Context) {
 }
 
 func ContainerAction(c *gin.Context) {
-	username := c.GetString("username")
-	if username != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
-		return
-	}
-
 	id := c.Param("id")
 	action := c.Param("action")
 
@@ -470,10 +464,12 @@ func ContainerAction(c *gin.Context) {
 	}
 
 	if err != nil {
+		audit(c, "container."+action, id, gin.H{"error": err.Error()})
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	audit(c, "container."+action, id, nil)
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
 
@@ -657,11 +653,6 @@ func ContainerInspectLite(c *gin.Context) {
 }
 
 func TriggerUpdateCheck(c *gin.Context) {
-	username := c.GetString("username")
-	if username != "admin" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
-		return
-	}
 	if !dockerEnabled() {
 		c.JSON(http.StatusOK, gin.H{"success": false, "error": "Docker not available"})
 		return
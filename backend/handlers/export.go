@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/storage"
+	"flatnasgo-backend/utils"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// secretUserKeys are account fields that never leave the server.
+var secretUserKeys = []string{"password", "twoFactor", "webauthn"}
+
+// wallpaperRefPattern matches the web path of a wallpaper in dashboard data.
+var wallpaperRefPattern = regexp.MustCompile(`/(backgrounds|mobile_backgrounds)/([^/?#"'\s]+)`)
+
+// exportWriter adds files to the archive and keeps the first error.
+type exportWriter struct {
+	zw  *zip.Writer
+	now time.Time
+	err error
+}
+
+func (w *exportWriter) create(name string) io.Writer {
+	if w.err != nil {
+		return nil
+	}
+	f, err := w.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: w.now})
+	if err != nil {
+		w.err = err
+		return nil
+	}
+	return f
+}
+
+func (w *exportWriter) writeJSON(name string, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		w.err = err
+		return
+	}
+	if f := w.create(name); f != nil {
+		_, w.err = f.Write(data)
+	}
+}
+
+// copyFile adds the file at path, skipping it when it is gone.
+func (w *exportWriter) copyFile(name, path string) {
+	src, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+	if f := w.create(name); f != nil {
+		_, w.err = io.Copy(f, src)
+	}
+}
+
+// referencedWallpapers collects the names of wallpapers a dashboard points at,
+// per directory.
+func referencedWallpapers(doc map[string]interface{}) map[string][]string {
+	refs := map[string][]string{}
+	seen := map[string]bool{}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch t := v.(type) {
+		case string:
+			for _, m := range wallpaperRefPattern.FindAllStringSubmatch(t, -1) {
+				key := m[1] + "/" + m[2]
+				if !seen[key] {
+					seen[key] = true
+					refs[m[1]] = append(refs[m[1]], m[2])
+				}
+			}
+		case map[string]interface{}:
+			for _, e := range t {
+				walk(e)
+			}
+		case []interface{}:
+			for _, e := range t {
+				walk(e)
+			}
+		}
+	}
+	walk(doc)
+	return refs
+}
+
+// ExportUserData streams a zip with everything stored for the signed in user:
+// the dashboard, custom scripts, config versions, sent transfer items with
+// their files, and wallpapers. Password hashes and 2FA secrets are left out.
+func ExportUserData(c *gin.Context) {
+	username := c.GetString("username")
+	if username == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var dashboard map[string]interface{}
+	if err := utils.ReadJSON(userFilePath(username), &dashboard); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User data not found"})
+		return
+	}
+	for _, k := range secretUserKeys {
+		delete(dashboard, k)
+	}
+
+	var scripts map[string]CustomScriptsPayload
+	utils.ReadJSON(filepath.Join(config.DataDir, "custom_scripts.json"), &scripts)
+
+	var transfer models.TransferData
+	utils.ReadJSON(getTransferIndexFile(), &transfer)
+	sent := []models.TransferItem{}
+	for _, item := range transfer.Items {
+		if item.Sender == username {
+			sent = append(sent, item)
+		}
+	}
+
+	now := time.Now()
+	filename := "flatnas-" + username + "-" + now.Format("20060102") + ".zip"
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Status(http.StatusOK)
+
+	w := &exportWriter{zw: zip.NewWriter(c.Writer), now: now}
+	w.writeJSON("dashboard.json", dashboard)
+	if entry, ok := scripts[username]; ok {
+		w.writeJSON("custom_scripts.json", entry)
+	}
+
+	if names, err := storage.ReadDir(config.ConfigVersionsDir); err == nil {
+		for _, name := range names {
+			if !strings.HasSuffix(name, ".json") {
+				continue
+			}
+			var vf VersionFile
+			if err := utils.ReadJSON(filepath.Join(config.ConfigVersionsDir, name), &vf); err != nil || versionOwner(&vf) != username {
+				continue
+			}
+			for _, k := range secretUserKeys {
+				delete(vf.Data, k)
+			}
+			w.writeJSON("versions/"+name, vf)
+		}
+	}
+
+	w.writeJSON("transfer/items.json", sent)
+	for _, item := range sent {
+		if item.Type == "file" && item.File != nil {
+			name := filepath.Base(item.File.Url)
+			w.copyFile("transfer/files/"+name, filepath.Join(getUploadsDir(), name))
+		}
+	}
+
+	// Fetched wallpapers carry the username, uploaded ones are found through
+	// the dashboard that uses them
+	dirs := map[string]string{"backgrounds": config.BackgroundsDir, "mobile_backgrounds": config.MobileBackgroundsDir}
+	wallpapers := referencedWallpapers(dashboard)
+	for key, dir := range dirs {
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			if m := fetchedWallpaperPattern.FindStringSubmatch(e.Name()); m != nil && m[2] == username {
+				wallpapers[key] = append(wallpapers[key], e.Name())
+			}
+		}
+	}
+	for key, names := range wallpapers {
+		added := map[string]bool{}
+		for _, name := range names {
+			if unescaped, err := url.PathUnescape(name); err == nil {
+				name = unescaped
+			}
+			name = filepath.Base(name)
+			if added[name] || name == "." || strings.HasPrefix(name, "..") {
+				continue
+			}
+			added[name] = true
+			w.copyFile("wallpapers/"+key+"/"+name, filepath.Join(dirs[key], name))
+		}
+	}
+
+	if w.err == nil {
+		w.err = w.zw.Close()
+	}
+	if w.err != nil {
+		// Headers are gone already; the client sees a truncated archive
+		log.Printf("Failed to export data of %s: %v", username, w.err)
+	}
+}
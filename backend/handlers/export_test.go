@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"flatnasgo-backend/utils"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestExportUserData(t *testing.T) {
+	setupUserDataDirs(t)
+	utils.WriteJSON(userFilePath("alice"), map[string]interface{}{
+		"username":  "alice",
+		"password":  "$2a$12$secret",
+		"appConfig": map[string]interface{}{"background": "/backgrounds/api_bg_alice_100.jpg"},
+	})
+
+	r := gin.New()
+	r.GET("/api/export", func(c *gin.Context) { c.Set("username", "alice") }, ExportUserData)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/export", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("export: %d %s", w.Code, w.Body.String())
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		if f.Name == "dashboard.json" {
+			rc, _ := f.Open()
+			data, _ := io.ReadAll(rc)
+			rc.Close()
+			if strings.Contains(string(data), "secret") {
+				t.Fatal("password hash exported")
+			}
+		}
+	}
+	sort.Strings(names)
+	want := []string{
+		"custom_scripts.json",
+		"dashboard.json",
+		"transfer/files/a.bin",
+		"transfer/items.json",
+		"versions/1.json",
+		"wallpapers/backgrounds/api_bg_alice_100.jpg",
+	}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Fatalf("unexpected archive entries %v", names)
+	}
+}
@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setupDataDir points the config at a fresh data directory with an empty
+// users folder and sysConfig as the system config.
+func setupDataDir(t *testing.T, sysConfig models.SystemConfig) {
+	gin.SetMode(gin.TestMode)
+	config.DataDir = t.TempDir()
+	config.UsersDir = filepath.Join(config.DataDir, "users")
+	config.SystemConfigFile = filepath.Join(config.DataDir, "system.json")
+	config.SecretKey = []byte("test-secret")
+	os.MkdirAll(config.UsersDir, 0755)
+	utils.WriteJSON(config.SystemConfigFile, sysConfig)
+}
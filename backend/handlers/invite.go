@@ -0,0 +1,268 @@
+package handlers
+
+import (
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/middleware"
+	"flatnasgo-backend/migrations"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/storage"
+	"flatnasgo-backend/utils"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// inviteError explains to the client why an invite code was not accepted.
+type inviteError struct {
+	msg string
+}
+
+func (e *inviteError) Error() string { return e.msg }
+
+type UpdateInviteCodeRequest struct {
+	IsActive    *bool   `json:"isActive,omitempty"`
+	MaxUses     *int    `json:"maxUses,omitempty"`   // 0 for unlimited
+	ExpiresIn   *int    `json:"expiresIn,omitempty"` // Days from now, 0 for never
+	Description *string `json:"description,omitempty"`
+	Role        *string `json:"role,omitempty"`
+	Template    *string `json:"template,omitempty"`
+}
+
+func getInviteCodesFile() string {
+	return filepath.Join(config.DataDir, "invite_codes.json")
+}
+
+// updateInviteCodes applies fn to the invite codes under the file lock.
+func updateInviteCodes(fn func(codes []models.InviteCode) ([]models.InviteCode, error)) error {
+	path := getInviteCodesFile()
+	return utils.WithFileLock(path, func() error {
+		var codes []models.InviteCode
+		if err := utils.ReadJSONUnlocked(path, &codes); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		updated, err := fn(codes)
+		if err != nil {
+			return err
+		}
+		if updated == nil {
+			updated = []models.InviteCode{}
+		}
+		return utils.WriteJSONUnlocked(path, updated)
+	})
+}
+
+// redeemInviteCode creates the account of username from the record build
+// returns while the invite codes are locked, so a code is never used more
+// often than MaxUses. The account is removed again if the use of the code
+// could not be saved.
+func redeemInviteCode(code, username string, build func(invite *models.InviteCode) (interface{}, error)) error {
+	path := userFilePath(username)
+	created := false
+	err := updateInviteCodes(func(codes []models.InviteCode) ([]models.InviteCode, error) {
+		now := time.Now()
+		for i := range codes {
+			invite := &codes[i]
+			if invite.Code != code {
+				continue
+			}
+			switch {
+			case !invite.IsActive:
+				return nil, &inviteError{"邀请码已停用"}
+			case invite.ExpiresAt > 0 && invite.ExpiresAt < now.Unix():
+				return nil, &inviteError{"邀请码已过期"}
+			case invite.MaxUses > 0 && invite.UsedCount >= invite.MaxUses:
+				return nil, &inviteError{"邀请码使用次数已达上限"}
+			}
+			record, err := build(invite)
+			if err != nil {
+				return nil, err
+			}
+			if err := createUserFile(path, record); err != nil {
+				return nil, err
+			}
+			created = true
+			invite.UsedCount++
+			invite.RedeemedBy = append(invite.RedeemedBy, models.InviteRedemption{Username: username, RedeemedAt: now.Unix()})
+			return codes, nil
+		}
+		return nil, &inviteError{"无效的邀请码"}
+	})
+	if err != nil && created {
+		if rmErr := storage.Remove(path); rmErr != nil {
+			log.Printf("Failed to remove account %s after a failed invite redemption: %v", username, rmErr)
+		}
+	}
+	return err
+}
+
+// loadDashboardTemplate returns the dashboard a new account starts with:
+// "default" is the system default, anything else a config version. Account
+// fields of the source are dropped.
+func loadDashboardTemplate(template string) (map[string]interface{}, error) {
+	var data map[string]interface{}
+	if template == "default" {
+		if err := utils.ReadJSON(config.DefaultFile, &data); err != nil {
+			return nil, err
+		}
+	} else {
+		var vf VersionFile
+		if err := utils.ReadJSON(filepath.Join(config.ConfigVersionsDir, template+".json"), &vf); err != nil {
+			return nil, err
+		}
+		data = vf.Data
+	}
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	for _, k := range append([]string{"username", "password"}, protectedUserKeys...) {
+		delete(data, k)
+	}
+	return data, nil
+}
+
+// newUserRecord builds the record of a new account, with a blank dashboard
+// or the one of template. A template deleted since falls back to blank.
+func newUserRecord(username, hashed, role, template string) (interface{}, error) {
+	blank := models.User{SchemaVersion: migrations.Latest(migrations.User), Username: username, Password: hashed, Role: role}
+	if template == "" {
+		return blank, nil
+	}
+	record, err := loadDashboardTemplate(template)
+	if os.IsNotExist(err) {
+		log.Printf("Dashboard template %s of invite is gone, %s starts blank", template, username)
+		return blank, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := migrations.Upgrade(migrations.User, record); err != nil {
+		return nil, err
+	}
+	record["username"] = username
+	record["password"] = hashed
+	if role != "" {
+		record["role"] = role
+	}
+	return record, nil
+}
+
+// createUserFile writes record to path unless the file exists already.
+func createUserFile(path string, record interface{}) error {
+	if err := utils.CreateJSON(path, record); err != nil {
+		if os.IsExist(err) {
+			return errUsernameTaken
+		}
+		return err
+	}
+	return nil
+}
+
+// validateInviteDefaults checks the role and template a code hands out. A
+// code may not grant more than the user issuing it holds, and only their own
+// config versions can serve as a template.
+func validateInviteDefaults(c *gin.Context, role, template string) string {
+	if role != "" {
+		if !models.IsValidRole(role) {
+			return "Invalid role"
+		}
+		for _, p := range models.RolePermissions[role] {
+			if !middleware.HasPermission(c, p) {
+				return "不能分配高于自身权限的角色"
+			}
+		}
+	}
+	if template != "" && template != "default" {
+		if !isValidVersionID(template) {
+			return "Invalid template"
+		}
+		var vf VersionFile
+		if err := utils.ReadJSON(filepath.Join(config.ConfigVersionsDir, template+".json"), &vf); err != nil || versionOwner(&vf) != c.GetString("username") {
+			return "Template not found"
+		}
+	}
+	return ""
+}
+
+// UpdateInviteCode activates or deactivates a code, or changes its limits
+// and defaults. Fields missing from the body are left unchanged.
+func UpdateInviteCode(c *gin.Context) {
+	code := c.Param("code")
+	var req UpdateInviteCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if (req.MaxUses != nil && *req.MaxUses < 0) || (req.ExpiresIn != nil && *req.ExpiresIn < 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	role, template := "", ""
+	if req.Role != nil {
+		role = *req.Role
+	}
+	if req.Template != nil {
+		template = *req.Template
+	}
+	if msg := validateInviteDefaults(c, role, template); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	var updated *models.InviteCode
+	err := updateInviteCodes(func(codes []models.InviteCode) ([]models.InviteCode, error) {
+		for i := range codes {
+			invite := &codes[i]
+			if invite.Code != code {
+				continue
+			}
+			if req.MaxUses != nil {
+				if *req.MaxUses > 0 && *req.MaxUses < invite.UsedCount {
+					return nil, &inviteError{"使用次数上限不能小于已使用次数"}
+				}
+				invite.MaxUses = *req.MaxUses
+			}
+			if req.ExpiresIn != nil {
+				invite.ExpiresAt = 0
+				if *req.ExpiresIn > 0 {
+					invite.ExpiresAt = time.Now().Add(time.Duration(*req.ExpiresIn) * 24 * time.Hour).Unix()
+				}
+			}
+			if req.IsActive != nil {
+				invite.IsActive = *req.IsActive
+			}
+			if req.Description != nil {
+				invite.Description = *req.Description
+			}
+			if req.Role != nil {
+				invite.Role = role
+			}
+			if req.Template != nil {
+				invite.Template = template
+			}
+			found := *invite
+			updated = &found
+			return codes, nil
+		}
+		return nil, os.ErrNotExist
+	})
+	if err != nil {
+		var invalid *inviteError
+		if errors.As(err, &invalid) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": invalid.msg})
+			return
+		}
+		if os.IsNotExist(err) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Invite code not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save invite code"})
+		return
+	}
+	audit(c, "invite.update", code, gin.H{"isActive": updated.IsActive, "maxUses": updated.MaxUses, "expiresAt": updated.ExpiresAt, "role": updated.Role, "template": updated.Template})
+	c.JSON(http.StatusOK, gin.H{"success": true, "code": updated})
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/storage"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestInviteCodeRedeemedOnce(t *testing.T) {
+	setupDataDir(t, models.SystemConfig{AuthMode: "multi"})
+	config.DefaultFile = filepath.Join(config.DataDir, "default.json")
+	utils.WriteJSON(config.DefaultFile, map[string]interface{}{"groups": []interface{}{"home"}, "role": "admin"})
+	utils.WriteJSON(getInviteCodesFile(), []models.InviteCode{
+		{Code: "once", MaxUses: 1, IsActive: true, Role: models.RoleViewer, Template: "default"},
+	})
+
+	r := gin.New()
+	r.POST("/api/register", Register)
+
+	const attempts = 5
+	codes := make([]int, attempts)
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"username":"user%d","password":"password%d","inviteCode":"once"}`, i, i)
+			codes[i] = postJSON(r, "/api/register", body).Code
+		}(i)
+	}
+	wg.Wait()
+
+	winner := -1
+	for i, code := range codes {
+		if code == http.StatusOK {
+			if winner >= 0 {
+				t.Fatalf("code redeemed twice: %v", codes)
+			}
+			winner = i
+		}
+	}
+	if winner < 0 {
+		t.Fatalf("no registration succeeded: %v", codes)
+	}
+
+	var invites []models.InviteCode
+	utils.ReadJSON(getInviteCodesFile(), &invites)
+	username := fmt.Sprintf("user%d", winner)
+	if invites[0].UsedCount != 1 || len(invites[0].RedeemedBy) != 1 || invites[0].RedeemedBy[0].Username != username {
+		t.Fatalf("unexpected redemption record %+v", invites[0])
+	}
+
+	var doc map[string]interface{}
+	utils.ReadJSON(userFilePath(username), &doc)
+	if doc["role"] != models.RoleViewer || doc["groups"] == nil {
+		t.Fatalf("code defaults not applied: %v", doc)
+	}
+}
+
+// failingInviteStore fails every write of the invite codes.
+type failingInviteStore struct {
+	*storage.FileStore
+}
+
+func (s failingInviteStore) Put(key string, data []byte) error {
+	if key == "invite_codes.json" {
+		return errors.New("disk full")
+	}
+	return s.FileStore.Put(key, data)
+}
+
+func TestInviteRedemptionRemovesAccountWhenCodeNotSaved(t *testing.T) {
+	setupDataDir(t, models.SystemConfig{AuthMode: "multi"})
+	utils.WriteJSON(getInviteCodesFile(), []models.InviteCode{{Code: "once", MaxUses: 1, IsActive: true}})
+	layout := storage.Layout{Dir: config.DataDir}
+	storage.Use(failingInviteStore{storage.NewFileStore(layout)}, layout)
+	defer storage.Use(nil, storage.Layout{})
+
+	r := gin.New()
+	r.POST("/api/register", Register)
+	w := postJSON(r, "/api/register", `{"username":"erin","password":"password1","inviteCode":"once"}`)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected failure, got %d %s", w.Code, w.Body.String())
+	}
+	if _, err := os.Stat(userFilePath("erin")); !os.IsNotExist(err) {
+		t.Fatalf("expected the account to be removed, got %v", err)
+	}
+}
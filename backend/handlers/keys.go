@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"errors"
+	"flatnasgo-backend/config"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type RotateKeysRequest struct {
+	Purpose    string `json:"purpose"`    // Empty rotates every purpose
+	GraceHours *int   `json:"graceHours"` // Defaults to config.DefaultKeyGracePeriod
+}
+
+func GetSigningKeys(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"success":         true,
+		"keys":            config.ListSigningKeys(),
+		"purposes":        config.KeyPurposes,
+		"legacyExpiresAt": config.LegacyKeyExpiresAt(),
+	})
+}
+
+// RotateSigningKeys puts a new signing key in place. Tokens signed with the
+// previous key keep verifying until the grace period ends.
+func RotateSigningKeys(c *gin.Context) {
+	var req RotateKeysRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+
+	grace := config.DefaultKeyGracePeriod
+	if req.GraceHours != nil {
+		if *req.GraceHours < 0 || *req.GraceHours > 24*30 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "graceHours must be between 0 and 720"})
+			return
+		}
+		grace = time.Duration(*req.GraceHours) * time.Hour
+	}
+
+	var purposes []string
+	if req.Purpose != "" {
+		purposes = []string{req.Purpose}
+	}
+	keys, err := config.RotateSigningKeys(purposes, grace)
+	if err != nil {
+		if errors.Is(err, config.ErrUnknownKeyPurpose) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown key purpose"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate keys"})
+		return
+	}
+	audit(c, "keys.rotate", req.Purpose, gin.H{"graceHours": int64(grace / time.Hour)})
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":         true,
+		"keys":            keys,
+		"legacyExpiresAt": config.LegacyKeyExpiresAt(),
+	})
+}
@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/middleware"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const ldapTimeout = 10 * time.Second
+
+var (
+	errLDAPCredentials = errors.New("invalid ldap credentials")
+	errLDAPAccount     = errors.New("ldap account not allowed")
+)
+
+// ldapIdentity is a directory user whose password was verified.
+type ldapIdentity struct {
+	DN     string
+	Groups []string
+}
+
+func ldapConnect(lc *models.LDAPConfig) (*ldap.Conn, error) {
+	u, err := url.Parse(lc.URL)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: lc.InsecureSkipVerify,
+	}
+	conn, err := ldap.DialURL(lc.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}),
+		ldap.DialWithTLSConfig(tlsConfig),
+	)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(ldapTimeout)
+	if lc.StartTLS && u.Scheme == "ldap" {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// ldapServiceBind binds as the search account, or stays anonymous.
+func ldapServiceBind(conn *ldap.Conn, lc *models.LDAPConfig) error {
+	if lc.BindDN == "" {
+		return nil
+	}
+	return conn.Bind(lc.BindDN, lc.BindPassword)
+}
+
+// ldapAuthenticate looks the user up and verifies the password by binding as
+// them. Directory errors other than bad credentials are returned as is.
+func ldapAuthenticate(lc *models.LDAPConfig, username, password string) (*ldapIdentity, error) {
+	// An empty password would be an unauthenticated bind, which many servers accept
+	if password == "" {
+		return nil, errLDAPCredentials
+	}
+
+	conn, err := ldapConnect(lc)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := ldapServiceBind(conn, lc); err != nil {
+		return nil, err
+	}
+
+	filter := lc.UserFilter
+	if filter == "" {
+		filter = "(uid={username})"
+	}
+	filter = strings.ReplaceAll(filter, "{username}", ldap.EscapeFilter(username))
+	groupAttr := lc.GroupAttribute
+	if groupAttr == "" {
+		groupAttr = "memberOf"
+	}
+
+	res, err := conn.Search(ldap.NewSearchRequest(
+		lc.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout/time.Second), false,
+		filter, []string{"dn", groupAttr}, nil,
+	))
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Entries) != 1 {
+		return nil, errLDAPCredentials
+	}
+	entry := res.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, errLDAPCredentials
+		}
+		return nil, err
+	}
+
+	identity := &ldapIdentity{DN: entry.DN, Groups: entry.GetAttributeValues(groupAttr)}
+	if lc.GroupFilter != "" {
+		// Group membership is read with the search account, not the user
+		if err := ldapServiceBind(conn, lc); err != nil {
+			return nil, err
+		}
+		base := lc.GroupBaseDN
+		if base == "" {
+			base = lc.BaseDN
+		}
+		groupFilter := strings.ReplaceAll(lc.GroupFilter, "{dn}", ldap.EscapeFilter(entry.DN))
+		groupFilter = strings.ReplaceAll(groupFilter, "{username}", ldap.EscapeFilter(username))
+		groups, err := conn.Search(ldap.NewSearchRequest(
+			base, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(ldapTimeout/time.Second), false,
+			groupFilter, []string{"dn"}, nil,
+		))
+		if err != nil {
+			return nil, err
+		}
+		identity.Groups = identity.Groups[:0]
+		for _, g := range groups.Entries {
+			identity.Groups = append(identity.Groups, g.DN)
+		}
+	}
+	return identity, nil
+}
+
+// mappedLDAPRole matches the groups of the user against RoleMapping, by full
+// DN or by the CN of the group, ignoring case. A user in none of the mapped
+// groups gets the default role, "" is only returned without a mapping.
+func mappedLDAPRole(lc *models.LDAPConfig, groups []string) string {
+	if len(lc.RoleMapping) == 0 {
+		return ""
+	}
+	var roles []string
+	for _, group := range groups {
+		cn := ""
+		if dn, err := ldap.ParseDN(group); err == nil && len(dn.RDNs) > 0 && len(dn.RDNs[0].Attributes) > 0 {
+			if strings.EqualFold(dn.RDNs[0].Attributes[0].Type, "cn") {
+				cn = dn.RDNs[0].Attributes[0].Value
+			}
+		}
+		for key, role := range lc.RoleMapping {
+			if strings.EqualFold(key, group) || (cn != "" && strings.EqualFold(key, cn)) {
+				roles = append(roles, role)
+			}
+		}
+	}
+	if role := models.MostPrivilegedRole(roles); role != "" {
+		return role
+	}
+	return unmappedRole(lc.DefaultRole)
+}
+
+// ldapLogin authenticates username against the directory when LDAP is in
+// charge of it: LDAP is enabled in multi-user mode and no local account of
+// that name exists, or the account was created by an earlier LDAP login.
+// handled is false when the caller should check the local password instead.
+func ldapLogin(sysConfig *models.SystemConfig, username, password string) (user *models.User, handled bool, err error) {
+	lc := sysConfig.LDAP
+	if lc == nil || !lc.Enabled || sysConfig.AuthMode == "single" || username == "admin" {
+		return nil, false, nil
+	}
+	if !utils.IsValidUsername(username) {
+		return nil, false, nil
+	}
+
+	existing, loadErr := loadUser(username)
+	if loadErr == nil && (existing.External == nil || existing.External.Provider != "ldap") {
+		return nil, false, nil
+	}
+	if loadErr != nil && !os.IsNotExist(loadErr) {
+		return nil, false, nil
+	}
+
+	identity, err := ldapAuthenticate(lc, username, password)
+	if err != nil {
+		return nil, true, err
+	}
+	user, err = syncLDAPAccount(lc, username, identity, loadErr == nil)
+	return user, true, err
+}
+
+// syncLDAPAccount provisions the account of an authenticated directory user
+// on first login and applies the role their groups map to.
+func syncLDAPAccount(lc *models.LDAPConfig, username string, identity *ldapIdentity, exists bool) (*models.User, error) {
+	external := &models.External{Provider: "ldap", Issuer: lc.URL, Subject: identity.DN, LinkedAt: time.Now().Unix()}
+	role := mappedLDAPRole(lc, identity.Groups)
+	if !exists {
+		newRole := role
+		if newRole == "" {
+			newRole = lc.DefaultRole
+		}
+		if _, err := middleware.ProvisionUser(userFilePath(username), username, newRole, external); err != nil {
+			return nil, err
+		}
+	}
+
+	previousRole := ""
+	user, err := updateUserAccount(username, func(user *models.User) error {
+		if user.External == nil || user.External.Provider != "ldap" || !strings.EqualFold(user.External.Subject, identity.DN) {
+			return errLDAPAccount
+		}
+		previousRole = user.Role
+		if role != "" {
+			user.Role = role
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if role != "" {
+		syncMappedRole(username, previousRole, user)
+	}
+	return user, nil
+}
+
+// parseLDAPConfig validates the ldap section of a system config update. An
+// empty bind password keeps the stored one.
+func parseLDAPConfig(raw interface{}, existing *models.LDAPConfig) (*models.LDAPConfig, string) {
+	if raw == nil {
+		return nil, ""
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, "Invalid ldap"
+	}
+	var lc models.LDAPConfig
+	if err := json.Unmarshal(data, &lc); err != nil {
+		return nil, "Invalid ldap"
+	}
+
+	lc.URL = strings.TrimSpace(lc.URL)
+	lc.BaseDN = strings.TrimSpace(lc.BaseDN)
+	if lc.BindPassword == "" && existing != nil && existing.BindDN == lc.BindDN {
+		lc.BindPassword = existing.BindPassword
+	}
+	if lc.Enabled {
+		u, err := url.Parse(lc.URL)
+		if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+			return nil, "Invalid ldap url"
+		}
+		if _, err := ldap.ParseDN(lc.BaseDN); err != nil || lc.BaseDN == "" {
+			return nil, "Invalid ldap baseDn"
+		}
+	}
+	for _, filter := range []string{lc.UserFilter, lc.GroupFilter} {
+		if filter == "" {
+			continue
+		}
+		probe := strings.NewReplacer("{username}", "x", "{dn}", "x").Replace(filter)
+		if _, err := ldap.CompileFilter(probe); err != nil {
+			return nil, "Invalid ldap filter: " + filter
+		}
+	}
+	for group, role := range lc.RoleMapping {
+		if !models.IsValidRole(role) {
+			return nil, "Invalid role for group " + group
+		}
+	}
+	if lc.DefaultRole != "" && !models.IsValidRole(lc.DefaultRole) {
+		return nil, "Invalid role"
+	}
+	return &lc, ""
+}
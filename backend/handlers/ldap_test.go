@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"flatnasgo-backend/middleware"
+	"flatnasgo-backend/models"
+	"testing"
+)
+
+func TestMappedLDAPRoleMatchesDNOrCN(t *testing.T) {
+	lc := &models.LDAPConfig{RoleMapping: map[string]string{
+		"cn=nas-admins,ou=groups,dc=home,dc=lan": models.RoleAdmin,
+		"family":                                 models.RoleOperator,
+	}}
+
+	cases := []struct {
+		groups []string
+		role   string
+	}{
+		{[]string{"CN=Family,ou=groups,dc=home,dc=lan"}, models.RoleOperator},
+		{[]string{"cn=family,ou=groups,dc=home,dc=lan", "cn=nas-admins,ou=groups,dc=home,dc=lan"}, models.RoleAdmin},
+		{[]string{"cn=guests,ou=groups,dc=home,dc=lan"}, models.RoleMember},
+		{nil, models.RoleMember},
+	}
+	for _, c := range cases {
+		if got := mappedLDAPRole(lc, c.groups); got != c.role {
+			t.Fatalf("groups=%v expected %q, got %q", c.groups, c.role, got)
+		}
+	}
+
+	if got := mappedLDAPRole(&models.LDAPConfig{}, []string{"cn=family"}); got != "" {
+		t.Fatalf("expected no role without a mapping, got %q", got)
+	}
+}
+
+func TestLDAPLoginDemotesUserWithoutMappedGroups(t *testing.T) {
+	setupDataDir(t, models.SystemConfig{AuthMode: "multi"})
+	lc := &models.LDAPConfig{
+		Enabled:     true,
+		URL:         "ldap://ldap.home.lan",
+		DefaultRole: models.RoleViewer,
+		RoleMapping: map[string]string{"nas-admins": models.RoleAdmin},
+	}
+	identity := &ldapIdentity{DN: "uid=dave,ou=people,dc=home,dc=lan", Groups: []string{"cn=nas-admins,ou=groups,dc=home,dc=lan"}}
+
+	user, err := syncLDAPAccount(lc, "dave", identity, false)
+	if err != nil || user.Role != models.RoleAdmin {
+		t.Fatalf("expected provisioned admin, got %+v %v", user, err)
+	}
+	middleware.UpdateAPITokens(func(tokens []models.APIToken) ([]models.APIToken, error) {
+		return append(tokens, models.APIToken{ID: "dave-token", Username: "dave", Scopes: []string{models.PermDataRead, models.PermUsersManage}}), nil
+	})
+	version := middleware.TokenVersion("dave")
+
+	// Removed from the admin group in the directory
+	identity.Groups = nil
+	if user, err = syncLDAPAccount(lc, "dave", identity, true); err != nil || user.Role != models.RoleViewer {
+		t.Fatalf("expected demotion to the default role, got %+v %v", user, err)
+	}
+	if stored, err := loadUser("dave"); err != nil || stored.Role != models.RoleViewer {
+		t.Fatalf("expected stored role to be demoted, got %+v %v", stored, err)
+	}
+	if middleware.TokenVersion("dave") <= version {
+		t.Fatalf("expected outstanding tokens to be revoked")
+	}
+	for _, token := range middleware.ListAPITokens("dave") {
+		if len(token.Scopes) != 1 || token.Scopes[0] != models.PermDataRead {
+			t.Fatalf("expected API token scopes to be restricted, got %v", token.Scopes)
+		}
+	}
+}
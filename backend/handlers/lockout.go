@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	lockoutUserThreshold = 5  // Failures per username before it gets locked
+	lockoutIPThreshold   = 20 // Failures per client IP before it gets locked
+	lockoutBaseDelay     = 30 * time.Second
+	lockoutMaxDelay      = time.Hour
+	lockoutResetAfter    = 24 * time.Hour // Forget failures after this much quiet time
+)
+
+var (
+	loginAttempts   map[string]*models.LoginAttempt
+	loginAttemptsMu sync.Mutex
+)
+
+func getLoginAttemptsFile() string {
+	return filepath.Join(config.DataDir, "login_attempts.json")
+}
+
+func userAttemptKey(username string) string {
+	return "user:" + username
+}
+
+func ipAttemptKey(ip string) string {
+	return "ip:" + ip
+}
+
+// lockoutDelay doubles the lock duration for every failure past the threshold.
+func lockoutDelay(failures, threshold int) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+	shift := failures - threshold
+	if shift > 16 {
+		shift = 16
+	}
+	delay := lockoutBaseDelay << shift
+	if delay > lockoutMaxDelay {
+		delay = lockoutMaxDelay
+	}
+	return delay
+}
+
+func attemptExpired(a *models.LoginAttempt, now time.Time) bool {
+	return a.LockedUntil <= now.Unix() && now.Sub(time.Unix(a.LastFailure, 0)) > lockoutResetAfter
+}
+
+// loadLoginAttemptsLocked reads the persisted state on first use so lockouts
+// survive restarts.
+func loadLoginAttemptsLocked() {
+	if loginAttempts != nil {
+		return
+	}
+	loginAttempts = make(map[string]*models.LoginAttempt)
+	var list []models.LoginAttempt
+	utils.ReadJSON(getLoginAttemptsFile(), &list)
+	now := time.Now()
+	for i := range list {
+		a := list[i]
+		if a.Key == "" || attemptExpired(&a, now) {
+			continue
+		}
+		loginAttempts[a.Key] = &a
+	}
+}
+
+func saveLoginAttemptsLocked() {
+	now := time.Now()
+	list := make([]models.LoginAttempt, 0, len(loginAttempts))
+	for key, a := range loginAttempts {
+		if attemptExpired(a, now) {
+			delete(loginAttempts, key)
+			continue
+		}
+		list = append(list, *a)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Key < list[j].Key
+	})
+	if err := utils.WriteJSON(getLoginAttemptsFile(), list); err != nil {
+		log.Printf("Failed to save login attempts: %v", err)
+	}
+}
+
+// loginLockedOut reports how long the client has to wait before it may try
+// to authenticate as username again.
+func loginLockedOut(ip, username string) (time.Duration, bool) {
+	loginAttemptsMu.Lock()
+	defer loginAttemptsMu.Unlock()
+	loadLoginAttemptsLocked()
+
+	now := time.Now().Unix()
+	var wait int64
+	for _, key := range []string{ipAttemptKey(ip), userAttemptKey(username)} {
+		if a, ok := loginAttempts[key]; ok && a.LockedUntil > now {
+			if remaining := a.LockedUntil - now; remaining > wait {
+				wait = remaining
+			}
+		}
+	}
+	return time.Duration(wait) * time.Second, wait > 0
+}
+
+func recordLoginFailure(ip, username string) {
+	loginAttemptsMu.Lock()
+	defer loginAttemptsMu.Unlock()
+	loadLoginAttemptsLocked()
+
+	now := time.Now()
+	bump := func(key string, threshold int) {
+		a, ok := loginAttempts[key]
+		if !ok || attemptExpired(a, now) {
+			a = &models.LoginAttempt{Key: key}
+			loginAttempts[key] = a
+		}
+		a.Failures++
+		a.LastFailure = now.Unix()
+		if delay := lockoutDelay(a.Failures, threshold); delay > 0 {
+			a.LockedUntil = now.Add(delay).Unix()
+		}
+	}
+	bump(ipAttemptKey(ip), lockoutIPThreshold)
+	if username != "" {
+		bump(userAttemptKey(username), lockoutUserThreshold)
+	}
+	saveLoginAttemptsLocked()
+}
+
+func recordLoginSuccess(ip, username string) {
+	loginAttemptsMu.Lock()
+	defer loginAttemptsMu.Unlock()
+	loadLoginAttemptsLocked()
+
+	_, hadIP := loginAttempts[ipAttemptKey(ip)]
+	_, hadUser := loginAttempts[userAttemptKey(username)]
+	if !hadIP && !hadUser {
+		return
+	}
+	delete(loginAttempts, ipAttemptKey(ip))
+	delete(loginAttempts, userAttemptKey(username))
+	saveLoginAttemptsLocked()
+}
+
+// loginFailures returns how often authentication failed recently from ip.
+func loginFailures(ip string) int {
+	loginAttemptsMu.Lock()
+	defer loginAttemptsMu.Unlock()
+	loadLoginAttemptsLocked()
+
+	if a, ok := loginAttempts[ipAttemptKey(ip)]; ok && !attemptExpired(a, time.Now()) {
+		return a.Failures
+	}
+	return 0
+}
+
+func respondLoginLocked(c *gin.Context, wait time.Duration) {
+	seconds := int64(wait / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Header("Retry-After", strconv.FormatInt(seconds, 10))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":      "尝试次数过多，请稍后再试",
+		"retryAfter": seconds,
+	})
+}
+
+type LoginLockoutEntry struct {
+	models.LoginAttempt
+	Locked     bool  `json:"locked"`
+	RetryAfter int64 `json:"retryAfter"` // Seconds until the lock expires
+}
+
+func GetLoginLockouts(c *gin.Context) {
+	loginAttemptsMu.Lock()
+	loadLoginAttemptsLocked()
+	now := time.Now().Unix()
+	entries := make([]LoginLockoutEntry, 0, len(loginAttempts))
+	for _, a := range loginAttempts {
+		entry := LoginLockoutEntry{LoginAttempt: *a}
+		if a.LockedUntil > now {
+			entry.Locked = true
+			entry.RetryAfter = a.LockedUntil - now
+		}
+		entries = append(entries, entry)
+	}
+	loginAttemptsMu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastFailure > entries[j].LastFailure
+	})
+	c.JSON(http.StatusOK, gin.H{"success": true, "entries": entries})
+}
+
+// ClearLoginLockout removes a single entry, or every entry when no key is given.
+func ClearLoginLockout(c *gin.Context) {
+	key := c.Param("key")
+
+	loginAttemptsMu.Lock()
+	defer loginAttemptsMu.Unlock()
+	loadLoginAttemptsLocked()
+
+	if key == "" {
+		loginAttempts = make(map[string]*models.LoginAttempt)
+	} else {
+		if _, ok := loginAttempts[key]; !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Entry not found"})
+			return
+		}
+		delete(loginAttempts, key)
+	}
+	saveLoginAttemptsLocked()
+	audit(c, "lockout.clear", key, nil)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// setupLockoutTest starts with no recorded failures and an account alice
+// with the password "secret".
+func setupLockoutTest(t *testing.T) *gin.Engine {
+	setupDataDir(t, models.SystemConfig{AuthMode: "multi"})
+	loginAttempts = nil
+	hashed, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	utils.WriteJSON(filepath.Join(config.UsersDir, "alice.json"), models.User{Username: "alice", Password: string(hashed)})
+
+	r := gin.New()
+	r.POST("/api/login", Login)
+	r.GET("/api/admin/lockouts", GetLoginLockouts)
+	r.DELETE("/api/admin/lockouts", ClearLoginLockout)
+	r.DELETE("/api/admin/lockouts/:key", ClearLoginLockout)
+	return r
+}
+
+func loginFrom(r *gin.Engine, ip, username, password string) *httptest.ResponseRecorder {
+	body := `{"username":"` + username + `","password":"` + password + `"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = ip + ":40000"
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestLockoutDelayDoublesUpToTheMaximum(t *testing.T) {
+	cases := []struct {
+		failures int
+		delay    time.Duration
+	}{
+		{lockoutUserThreshold - 1, 0},
+		{lockoutUserThreshold, lockoutBaseDelay},
+		{lockoutUserThreshold + 1, 2 * lockoutBaseDelay},
+		{lockoutUserThreshold + 3, 8 * lockoutBaseDelay},
+		{lockoutUserThreshold + 100, lockoutMaxDelay},
+	}
+	for _, c := range cases {
+		if got := lockoutDelay(c.failures, lockoutUserThreshold); got != c.delay {
+			t.Fatalf("failures=%d expected %v, got %v", c.failures, c.delay, got)
+		}
+	}
+}
+
+func TestLoginLocksUsernameAfterThreshold(t *testing.T) {
+	r := setupLockoutTest(t)
+
+	// Failures from changing addresses still count against the account
+	for i := 0; i < lockoutUserThreshold; i++ {
+		if w := loginFrom(r, "192.0.2."+string(rune('1'+i)), "alice", "wrong"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401, got %d", i, w.Code)
+		}
+	}
+	w := loginFrom(r, "198.51.100.7", "alice", "secret")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected locked account, got %d %s", w.Code, w.Body.String())
+	}
+	first := loginAttempts[userAttemptKey("alice")].LockedUntil
+
+	// Every further failure doubles the lock
+	loginAttempts[userAttemptKey("alice")].LockedUntil = 0
+	loginFrom(r, "198.51.100.7", "alice", "wrong")
+	if second := loginAttempts[userAttemptKey("alice")].LockedUntil; second-time.Now().Unix() < int64(2*lockoutBaseDelay/time.Second)-2 || second <= first {
+		t.Fatalf("expected the lock to grow, got %d after %d", second, first)
+	}
+
+	// Other accounts are not affected from a fresh address
+	if w := loginFrom(r, "198.51.100.8", "bob", "x"); w.Code == http.StatusTooManyRequests {
+		t.Fatalf("expected other account to stay open")
+	}
+}
+
+func TestLoginLocksAddressAfterThreshold(t *testing.T) {
+	r := setupLockoutTest(t)
+
+	// Guessing many usernames from one address locks the address
+	for i := 0; i < lockoutIPThreshold; i++ {
+		loginFrom(r, "203.0.113.9", "guess"+string(rune('a'+i)), "x")
+	}
+	if w := loginFrom(r, "203.0.113.9", "alice", "secret"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected locked address, got %d", w.Code)
+	}
+	if w := loginFrom(r, "203.0.113.10", "alice", "secret"); w.Code != http.StatusOK {
+		t.Fatalf("expected login from another address to succeed, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestLoginSuccessResetsFailures(t *testing.T) {
+	r := setupLockoutTest(t)
+
+	for i := 0; i < lockoutUserThreshold-1; i++ {
+		loginFrom(r, "192.0.2.1", "alice", "wrong")
+	}
+	if w := loginFrom(r, "192.0.2.1", "alice", "secret"); w.Code != http.StatusOK {
+		t.Fatalf("expected login below the threshold to succeed, got %d", w.Code)
+	}
+	if _, ok := loginAttempts[userAttemptKey("alice")]; ok {
+		t.Fatalf("expected user failures to be reset")
+	}
+	if _, ok := loginAttempts[ipAttemptKey("192.0.2.1")]; ok {
+		t.Fatalf("expected address failures to be reset")
+	}
+	if w := loginFrom(r, "192.0.2.1", "alice", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a single failure not to lock, got %d", w.Code)
+	}
+}
+
+func TestLockoutsSurviveRestart(t *testing.T) {
+	r := setupLockoutTest(t)
+
+	for i := 0; i < lockoutUserThreshold; i++ {
+		loginFrom(r, "192.0.2.1", "alice", "wrong")
+	}
+
+	// A restart reads the state back from login_attempts.json
+	loginAttempts = nil
+	if w := loginFrom(r, "192.0.2.2", "alice", "secret"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected lock to survive a reload, got %d", w.Code)
+	}
+}
+
+func TestAdminListsAndClearsLockouts(t *testing.T) {
+	r := setupLockoutTest(t)
+
+	for i := 0; i < lockoutUserThreshold; i++ {
+		loginFrom(r, "192.0.2.1", "alice", "wrong")
+	}
+	loginFrom(r, "192.0.2.5", "bob", "wrong")
+
+	list := func() map[string]LoginLockoutEntry {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/admin/lockouts", nil))
+		var resp struct {
+			Entries []LoginLockoutEntry `json:"entries"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		entries := map[string]LoginLockoutEntry{}
+		for _, e := range resp.Entries {
+			entries[e.Key] = e
+		}
+		return entries
+	}
+	del := func(path string) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, path, nil))
+		return w.Code
+	}
+
+	entries := list()
+	alice := entries[userAttemptKey("alice")]
+	if len(entries) != 4 || !alice.Locked || alice.RetryAfter <= 0 || alice.Failures != lockoutUserThreshold || entries[userAttemptKey("bob")].Locked {
+		t.Fatalf("unexpected lockout entries %+v", entries)
+	}
+
+	if code := del("/api/admin/lockouts/" + userAttemptKey("alice")); code != http.StatusOK {
+		t.Fatalf("expected entry to be cleared, got %d", code)
+	}
+	if w := loginFrom(r, "192.0.2.9", "alice", "secret"); w.Code != http.StatusOK {
+		t.Fatalf("expected cleared account to log in, got %d", w.Code)
+	}
+	if code := del("/api/admin/lockouts/user:nobody"); code != http.StatusNotFound {
+		t.Fatalf("expected unknown entry to be reported, got %d", code)
+	}
+	if code := del("/api/admin/lockouts"); code != http.StatusOK || len(list()) != 0 {
+		t.Fatalf("expected every entry to be cleared, got %d %v", code, list())
+	}
+}
@@ -4,7 +4,7 @@ import (
 	"strings"
 	"time"
 
-	"flatnasgo-backend/config"
+	"flatnasgo-backend/middleware"
 
 	socketio "github.com/googollee/go-socket.io"
 	"github.com/golang-jwt/jwt/v5"
@@ -28,7 +28,7 @@ func BindMemoHandlers(server *socketio.Server) {
 		if !ok {
 			return
 		}
-		if _, ok := validateSocketToken(token); !ok {
+		if _, ok := authorizeSocketEvent(s, "memo:update", token); !ok {
 			return
 		}
 		server.BroadcastToNamespace("/", "memo:updated", map[string]interface{}{
@@ -44,7 +44,7 @@ func BindTodoHandlers(server *socketio.Server) {
 		if !ok {
 			return
 		}
-		if _, ok := validateSocketToken(token); !ok {
+		if _, ok := authorizeSocketEvent(s, "todo:update", token); !ok {
 			return
 		}
 		server.BroadcastToNamespace("/", "todo:updated", map[string]interface{}{
@@ -69,7 +69,7 @@ func BindNetworkHandlers(server *socketio.Server) {
 		if !ok {
 			return
 		}
-		username, ok := validateSocketToken(token)
+		username, ok := authorizeSocketEvent(s, "network:mode", token)
 		if !ok {
 			return
 		}
@@ -86,7 +86,7 @@ func BindNetworkHandlers(server *socketio.Server) {
 		if !ok {
 			return
 		}
-		if _, ok := validateSocketToken(token); !ok {
+		if _, ok := authorizeSocketEvent(s, "network:heartbeat", token); !ok {
 			return
 		}
 		s.Emit("network:heartbeat", map[string]interface{}{
@@ -201,24 +201,37 @@ func isValidNetworkMode(mode string) bool {
 	}
 }
 
-func validateSocketToken(tokenStr string) (string, bool) {
-	if tokenStr == "" {
-		return "", false
+// authorizeSocketEvent resolves the user of a socket event like
+// validateSocketToken, and tells the client when it is refused so that an
+// expired access token can be refreshed and the event sent again.
+func authorizeSocketEvent(s socketio.Conn, event, tokenStr string) (string, bool) {
+	username, ok := validateSocketToken(s, tokenStr)
+	if !ok && s != nil {
+		s.Emit("auth:error", map[string]interface{}{
+			"event": event,
+			"error": "登录已过期",
+		})
 	}
+	return username, ok
+}
+
+// validateSocketToken resolves the user of a socket event from the token in
+// its payload, or from the trusted proxy header of the connection.
+func validateSocketToken(s socketio.Conn, tokenStr string) (string, bool) {
 	tokenStr = strings.TrimPrefix(tokenStr, "Bearer ")
-	tok, err := jwt.Parse(
-		tokenStr,
-		func(token *jwt.Token) (interface{}, error) {
-			return []byte(config.GetSecretKeyString()), nil
-		},
-		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
-	)
-	if err != nil || tok == nil || !tok.Valid {
-		return "", false
+	if tokenStr != "" {
+		tok, err := middleware.ParseSessionToken(tokenStr)
+		if err == nil && tok != nil && tok.Valid {
+			if claims, ok := tok.Claims.(jwt.MapClaims); ok {
+				if username, ok := claims["username"].(string); ok && username != "" {
+					return username, true
+				}
+			}
+		}
 	}
-	if claims, ok := tok.Claims.(jwt.MapClaims); ok {
-		if username, ok := claims["username"].(string); ok && username != "" {
-			return username, true
+	if s != nil && s.RemoteAddr() != nil {
+		if u, ok := middleware.ProxyIdentity(s.RemoteAddr().String(), s.RemoteHeader()); ok {
+			return u.Username, true
 		}
 	}
 	return "", false
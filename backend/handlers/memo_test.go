@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	socketio "github.com/googollee/go-socket.io"
+)
+
+// fakeSocket records the events emitted to one socket connection.
+type fakeSocket struct {
+	socketio.Conn
+	addr    net.Addr
+	header  http.Header
+	emitted map[string][]interface{}
+}
+
+func newFakeSocket(ip string) *fakeSocket {
+	return &fakeSocket{
+		addr:    &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000},
+		header:  http.Header{},
+		emitted: map[string][]interface{}{},
+	}
+}
+
+func (s *fakeSocket) RemoteAddr() net.Addr      { return s.addr }
+func (s *fakeSocket) RemoteHeader() http.Header { return s.header }
+func (s *fakeSocket) Emit(event string, v ...interface{}) {
+	s.emitted[event] = append(s.emitted[event], v...)
+}
+
+func socketToken(t *testing.T, username string, exp time.Time) string {
+	signed, err := utils.SignToken(config.KeyPurposeSession, jwt.MapClaims{
+		"username": username,
+		"exp":      exp.Unix(),
+	})
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+	return signed
+}
+
+func TestAuthorizeSocketEventReportsExpiredToken(t *testing.T) {
+	setupDataDir(t, models.SystemConfig{AuthMode: "multi"})
+
+	s := newFakeSocket("192.0.2.1")
+	if username, ok := authorizeSocketEvent(s, "memo:update", socketToken(t, "erin", time.Now().Add(time.Minute))); !ok || username != "erin" {
+		t.Fatalf("expected valid token to be accepted, got %q %v", username, ok)
+	}
+	if len(s.emitted["auth:error"]) != 0 {
+		t.Fatalf("expected no auth error for a valid token")
+	}
+
+	if _, ok := authorizeSocketEvent(s, "memo:update", socketToken(t, "erin", time.Now().Add(-time.Minute))); ok {
+		t.Fatalf("expected expired token to be rejected")
+	}
+	errs := s.emitted["auth:error"]
+	if len(errs) != 1 {
+		t.Fatalf("expected one auth error, got %v", errs)
+	}
+	if payload, _ := errs[0].(map[string]interface{}); payload["event"] != "memo:update" {
+		t.Fatalf("expected the refused event to be named, got %v", errs[0])
+	}
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flatnasgo-backend/middleware"
+	"flatnasgo-backend/models"
+	"net"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var networkGroups = map[string]bool{
+	models.NetworkGroupUsers:   true,
+	models.NetworkGroupSystem:  true,
+	models.NetworkGroupDocker:  true,
+	models.NetworkGroupScripts: true,
+}
+
+// cleanAddressList trims entries and drops empty ones. It returns the first
+// entry that is neither a CIDR nor a single address as bad.
+func cleanAddressList(entries []string) (cleaned []string, bad string) {
+	cleaned = []string{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(entry); err != nil && net.ParseIP(entry) == nil {
+			return nil, entry
+		}
+		cleaned = append(cleaned, entry)
+	}
+	return cleaned, ""
+}
+
+// parseNetworkConfig validates the network section of a system config
+// update. The admin saving it must still be able to reach the system
+// settings afterwards, or nobody could undo the change.
+func parseNetworkConfig(c *gin.Context, raw interface{}) (*models.NetworkConfig, string) {
+	if raw == nil {
+		return nil, ""
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, "Invalid network"
+	}
+	var nc models.NetworkConfig
+	if err := json.Unmarshal(data, &nc); err != nil {
+		return nil, "Invalid network"
+	}
+
+	proxies, bad := cleanAddressList(nc.TrustedProxies)
+	if bad != "" {
+		return nil, "Invalid trusted proxy: " + bad
+	}
+	nc.TrustedProxies = proxies
+	allowlists := map[string][]string{}
+	for group, entries := range nc.Allowlists {
+		if !networkGroups[group] {
+			return nil, "Unknown route group: " + group
+		}
+		cleaned, bad := cleanAddressList(entries)
+		if bad != "" {
+			return nil, "Invalid address: " + bad
+		}
+		if len(cleaned) > 0 {
+			allowlists[group] = cleaned
+		}
+	}
+	nc.Allowlists = allowlists
+
+	if !middleware.NetworkAllows(&nc, models.NetworkGroupSystem, middleware.ClientAddress(c.Request, &nc)) {
+		return nil, "当前地址不在系统设置的允许列表中，保存后将无法再修改"
+	}
+	return &nc, ""
+}
@@ -0,0 +1,690 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/middleware"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/storage"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	oidcDiscoveryTTL   = time.Hour
+	oidcJWKSRefetchMin = time.Minute
+	oidcAuthRequestTTL = 10 * time.Minute
+	oidcExchangeTTL    = time.Minute
+	// oidcStateCookie ties a login to the browser that started it, so a
+	// callback URL of someone else's login is refused.
+	oidcStateCookie = "flatnas_oidc_state"
+)
+
+var (
+	errOIDCDisabled = errors.New("oidc is not enabled")
+	errOIDCAccount  = errors.New("oidc account not allowed")
+)
+
+var oidcSigningMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+type oidcDiscovery struct {
+	Issuer                   string   `json:"issuer"`
+	AuthorizationEndpoint    string   `json:"authorization_endpoint"`
+	TokenEndpoint            string   `json:"token_endpoint"`
+	JWKSURI                  string   `json:"jwks_uri"`
+	TokenEndpointAuthMethods []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+type oidcProvider struct {
+	discovery     oidcDiscovery
+	fetchedAt     time.Time
+	keys          map[string]interface{} // Key ID -> public key
+	keysFetchedAt time.Time
+}
+
+// oidcAuthRequest is kept between the redirect to the provider and its
+// callback, keyed by the state parameter.
+type oidcAuthRequest struct {
+	Verifier  string
+	Nonce     string
+	ExpiresAt time.Time
+}
+
+// oidcExchange holds a finished login until the frontend picks it up. The
+// tokens never appear in a URL, only the one-time code does.
+type oidcExchange struct {
+	Body      gin.H
+	ExpiresAt time.Time
+}
+
+var (
+	oidcProviders   = map[string]*oidcProvider{}
+	oidcAuthReqs    = map[string]oidcAuthRequest{}
+	oidcExchanges   = map[string]oidcExchange{}
+	oidcProvidersMu sync.Mutex
+	oidcStateMu     sync.Mutex
+)
+
+func loadOIDCConfig() (*models.SystemConfig, *models.OIDCConfig, error) {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	oc := sysConfig.OIDC
+	if oc == nil || !oc.Enabled || oc.Issuer == "" || oc.ClientID == "" {
+		return &sysConfig, nil, errOIDCDisabled
+	}
+	return &sysConfig, oc, nil
+}
+
+func oidcGetJSON(rawURL string, v interface{}) error {
+	resp, err := oidcHTTPClient.Get(rawURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: status %d", rawURL, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func decodeJWKInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// parseJWKS converts the signing keys of a JWK set into public keys.
+func parseJWKS(set []map[string]interface{}) map[string]interface{} {
+	keys := map[string]interface{}{}
+	for _, k := range set {
+		str := func(name string) string {
+			v, _ := k[name].(string)
+			return v
+		}
+		if use := str("use"); use != "" && use != "sig" {
+			continue
+		}
+		switch str("kty") {
+		case "RSA":
+			n, err1 := decodeJWKInt(str("n"))
+			e, err2 := decodeJWKInt(str("e"))
+			if err1 != nil || err2 != nil || !e.IsInt64() {
+				continue
+			}
+			keys[str("kid")] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch str("crv") {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, err1 := decodeJWKInt(str("x"))
+			y, err2 := decodeJWKInt(str("y"))
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[str("kid")] = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		}
+	}
+	return keys
+}
+
+func fetchJWKS(jwksURI string) (map[string]interface{}, error) {
+	var data struct {
+		Keys []map[string]interface{} `json:"keys"`
+	}
+	if err := oidcGetJSON(jwksURI, &data); err != nil {
+		return nil, err
+	}
+	return parseJWKS(data.Keys), nil
+}
+
+// getOIDCProvider returns the discovery document and keys of issuer, read
+// from the provider and cached for an hour.
+func getOIDCProvider(issuer string) (*oidcProvider, error) {
+	oidcProvidersMu.Lock()
+	defer oidcProvidersMu.Unlock()
+
+	if p, ok := oidcProviders[issuer]; ok && time.Since(p.fetchedAt) < oidcDiscoveryTTL {
+		return p, nil
+	}
+
+	var d oidcDiscovery
+	if err := oidcGetJSON(strings.TrimRight(issuer, "/")+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(d.Issuer, "/") != strings.TrimRight(issuer, "/") {
+		return nil, fmt.Errorf("discovery issuer %q does not match %q", d.Issuer, issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("incomplete discovery document")
+	}
+	keys, err := fetchJWKS(d.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	p := &oidcProvider{discovery: d, fetchedAt: time.Now(), keys: keys, keysFetchedAt: time.Now()}
+	oidcProviders[issuer] = p
+	return p, nil
+}
+
+// oidcKey resolves the key an ID token was signed with. Unknown key IDs
+// trigger a JWKS refetch so provider key rotation is picked up.
+func oidcKey(p *oidcProvider, kid string) (interface{}, error) {
+	oidcProvidersMu.Lock()
+	defer oidcProvidersMu.Unlock()
+
+	lookup := func() (interface{}, bool) {
+		if kid == "" && len(p.keys) == 1 {
+			for _, k := range p.keys {
+				return k, true
+			}
+		}
+		k, ok := p.keys[kid]
+		return k, ok
+	}
+	if k, ok := lookup(); ok {
+		return k, nil
+	}
+	if time.Since(p.keysFetchedAt) >= oidcJWKSRefetchMin {
+		if keys, err := fetchJWKS(p.discovery.JWKSURI); err == nil {
+			p.keys = keys
+			p.keysFetchedAt = time.Now()
+			if k, ok := lookup(); ok {
+				return k, nil
+			}
+		}
+	}
+	return nil, errors.New("unknown signing key")
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func oidcStateHash(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func setOIDCStateCookie(c *gin.Context, value string, maxAge int, secure bool) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode, // Sent along with the top-level redirect back from the provider
+	})
+}
+
+func pruneOIDCStateLocked(now time.Time) {
+	for k, v := range oidcAuthReqs {
+		if now.After(v.ExpiresAt) {
+			delete(oidcAuthReqs, k)
+		}
+	}
+	for k, v := range oidcExchanges {
+		if now.After(v.ExpiresAt) {
+			delete(oidcExchanges, k)
+		}
+	}
+}
+
+// OIDCLogin redirects the browser to the identity provider.
+func OIDCLogin(c *gin.Context) {
+	_, oc, err := loadOIDCConfig()
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "SSO is not enabled"})
+		return
+	}
+	p, err := getOIDCProvider(oc.Issuer)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to reach identity provider"})
+		return
+	}
+
+	state, err1 := randomHex(16)
+	nonce, err2 := randomHex(16)
+	verifier, err3 := randomHex(32)
+	if err1 != nil || err2 != nil || err3 != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+		return
+	}
+
+	now := time.Now()
+	oidcStateMu.Lock()
+	pruneOIDCStateLocked(now)
+	oidcAuthReqs[state] = oidcAuthRequest{Verifier: verifier, Nonce: nonce, ExpiresAt: now.Add(oidcAuthRequestTTL)}
+	oidcStateMu.Unlock()
+	setOIDCStateCookie(c, oidcStateHash(state), int(oidcAuthRequestTTL/time.Second), strings.HasPrefix(oc.RedirectURL, "https://"))
+
+	scopes := oc.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	}
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", oc.ClientID)
+	q.Set("redirect_uri", oc.RedirectURL)
+	q.Set("scope", strings.Join(scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", pkceChallenge(verifier))
+	q.Set("code_challenge_method", "S256")
+
+	target := p.discovery.AuthorizationEndpoint
+	if strings.Contains(target, "?") {
+		target += "&" + q.Encode()
+	} else {
+		target += "?" + q.Encode()
+	}
+	c.Redirect(http.StatusFound, target)
+}
+
+// exchangeOIDCCode redeems an authorization code at the token endpoint and
+// returns the ID token.
+func exchangeOIDCCode(oc *models.OIDCConfig, p *oidcProvider, code, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", oc.RedirectURL)
+	form.Set("client_id", oc.ClientID)
+	form.Set("code_verifier", verifier)
+
+	useBasic := false
+	if oc.ClientSecret != "" {
+		methods := p.discovery.TokenEndpointAuthMethods
+		// client_secret_basic is the default when the provider lists nothing
+		useBasic = len(methods) == 0
+		for _, m := range methods {
+			if m == "client_secret_basic" {
+				useBasic = true
+			}
+		}
+		if !useBasic {
+			form.Set("client_secret", oc.ClientSecret)
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if useBasic {
+		req.SetBasicAuth(url.QueryEscape(oc.ClientID), url.QueryEscape(oc.ClientSecret))
+	}
+
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK || body.IDToken == "" {
+		return "", fmt.Errorf("token endpoint: status %d %s", resp.StatusCode, body.Error)
+	}
+	return body.IDToken, nil
+}
+
+// verifyIDToken checks signature, issuer, audience, expiry and nonce.
+func verifyIDToken(oc *models.OIDCConfig, p *oidcProvider, idToken, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return oidcKey(p, kid)
+	},
+		jwt.WithValidMethods(oidcSigningMethods),
+		jwt.WithIssuer(p.discovery.Issuer),
+		jwt.WithAudience(oc.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+	return claims, nil
+}
+
+func claimStrings(v interface{}) []string {
+	switch t := v.(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		out := make([]string, 0, len(t))
+		for _, item := range t {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// mappedOIDCRole returns the role granted by the groups claim, or "" when
+// role mapping is off. A user in none of the mapped groups gets the default
+// role, so leaving a group takes its role away.
+func mappedOIDCRole(oc *models.OIDCConfig, claims jwt.MapClaims) string {
+	if oc.GroupsClaim == "" || len(oc.RoleMapping) == 0 {
+		return ""
+	}
+	var roles []string
+	for _, g := range claimStrings(claims[oc.GroupsClaim]) {
+		if role, ok := oc.RoleMapping[g]; ok {
+			roles = append(roles, role)
+		}
+	}
+	if role := models.MostPrivilegedRole(roles); role != "" {
+		return role
+	}
+	return unmappedRole(oc.DefaultRole)
+}
+
+// unmappedRole is the role of users an identity provider maps to no role.
+func unmappedRole(defaultRole string) string {
+	if models.IsValidRole(defaultRole) {
+		return defaultRole
+	}
+	return models.RoleMember
+}
+
+// syncMappedRole follows up on a role set from identity provider groups at
+// login. After a change the outstanding access tokens are revoked and API
+// tokens lose the scopes the new role does not grant.
+func syncMappedRole(username, previousRole string, user *models.User) {
+	if user.Role != previousRole {
+		middleware.RevokeUserTokens(username)
+	}
+	middleware.RestrictAPITokens(username, models.EffectivePermissions(user.Role, user.Permissions))
+}
+
+// findLinkedUser returns the account linked to the external identity.
+func findLinkedUser(sysConfig *models.SystemConfig, issuer, subject string) string {
+	matches := func(path string) bool {
+		var account struct {
+			External *models.External `json:"external"`
+		}
+		if err := utils.ReadJSON(path, &account); err != nil || account.External == nil {
+			return false
+		}
+		return account.External.Provider == "oidc" && account.External.Issuer == issuer && account.External.Subject == subject
+	}
+	if sysConfig.AuthMode == "single" {
+		if matches(filepath.Join(config.DataDir, "data.json")) {
+			return "admin"
+		}
+		return ""
+	}
+	files, err := storage.ReadDir(config.UsersDir)
+	if err != nil {
+		return ""
+	}
+	for _, name := range files {
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		if matches(filepath.Join(config.UsersDir, name)) {
+			return strings.TrimSuffix(name, ".json")
+		}
+	}
+	return ""
+}
+
+// resolveOIDCUser maps verified ID token claims to a FlatNas account,
+// linking or provisioning it as configured, and applies role mapping.
+func resolveOIDCUser(sysConfig *models.SystemConfig, oc *models.OIDCConfig, claims jwt.MapClaims) (string, *models.User, error) {
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return "", nil, errOIDCAccount
+	}
+	issuer := oc.Issuer
+	external := &models.External{Provider: "oidc", Issuer: issuer, Subject: subject, LinkedAt: time.Now().Unix()}
+	role := mappedOIDCRole(oc, claims)
+
+	username := findLinkedUser(sysConfig, issuer, subject)
+	if username == "" {
+		claim := oc.UsernameClaim
+		if claim == "" {
+			claim = "preferred_username"
+		}
+		username, _ = claims[claim].(string)
+		username = strings.TrimSpace(username)
+		if !utils.IsValidUsername(username) {
+			return "", nil, errOIDCAccount
+		}
+		if sysConfig.AuthMode == "single" && username != "admin" {
+			return "", nil, errOIDCAccount
+		}
+
+		path := userFilePath(username)
+		if exists, err := storage.Exists(path); err == nil && !exists {
+			if !oc.AutoProvision || sysConfig.AuthMode == "single" {
+				return "", nil, errOIDCAccount
+			}
+			newRole := role
+			if newRole == "" {
+				newRole = oc.DefaultRole
+			}
+			if _, err := middleware.ProvisionUser(path, username, newRole, external); err != nil {
+				return "", nil, err
+			}
+		} else {
+			// Claiming an existing local account by name must be allowed explicitly
+			_, err := updateUserAccount(username, func(user *models.User) error {
+				if user.External != nil || !oc.LinkExisting {
+					return errOIDCAccount
+				}
+				user.External = external
+				return nil
+			})
+			if err != nil {
+				return "", nil, err
+			}
+		}
+	}
+
+	previousRole := ""
+	user, err := updateUserAccount(username, func(user *models.User) error {
+		if user.External == nil || user.External.Issuer != issuer || user.External.Subject != subject {
+			return errOIDCAccount
+		}
+		previousRole = user.Role
+		// The built-in admin keeps its role regardless of provider groups
+		if role != "" && username != "admin" {
+			user.Role = role
+		}
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if role != "" && username != "admin" {
+		syncMappedRole(username, previousRole, user)
+	}
+	return username, user, nil
+}
+
+func oidcFail(c *gin.Context, reason string) {
+	c.Redirect(http.StatusFound, "/?oidc_error="+url.QueryEscape(reason))
+}
+
+// OIDCCallback finishes the login started by OIDCLogin. The browser is sent
+// back to the frontend with a one-time code it trades for the session.
+func OIDCCallback(c *gin.Context) {
+	if e := c.Query("error"); e != "" {
+		oidcFail(c, e)
+		return
+	}
+
+	state := c.Query("state")
+	cookie, err := c.Cookie(oidcStateCookie)
+	setOIDCStateCookie(c, "", -1, false)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie), []byte(oidcStateHash(state))) != 1 {
+		oidcFail(c, "invalid_state")
+		return
+	}
+
+	oidcStateMu.Lock()
+	authReq, ok := oidcAuthReqs[state]
+	delete(oidcAuthReqs, state)
+	oidcStateMu.Unlock()
+	if !ok || time.Now().After(authReq.ExpiresAt) {
+		oidcFail(c, "invalid_state")
+		return
+	}
+
+	sysConfig, oc, err := loadOIDCConfig()
+	if err != nil {
+		oidcFail(c, "disabled")
+		return
+	}
+	p, err := getOIDCProvider(oc.Issuer)
+	if err != nil {
+		oidcFail(c, "provider_unreachable")
+		return
+	}
+	idToken, err := exchangeOIDCCode(oc, p, c.Query("code"), authReq.Verifier)
+	if err != nil {
+		oidcFail(c, "token_exchange_failed")
+		return
+	}
+	claims, err := verifyIDToken(oc, p, idToken, authReq.Nonce)
+	if err != nil {
+		oidcFail(c, "invalid_id_token")
+		return
+	}
+	username, user, err := resolveOIDCUser(sysConfig, oc, claims)
+	if err != nil {
+		oidcFail(c, "account_not_allowed")
+		return
+	}
+
+	body, err := newLoginSession(c, username, user)
+	if errors.Is(err, errAccountDisabled) {
+		oidcFail(c, "account_disabled")
+		return
+	}
+	if err != nil {
+		oidcFail(c, "session_failed")
+		return
+	}
+	code, err := randomHex(24)
+	if err != nil {
+		oidcFail(c, "session_failed")
+		return
+	}
+	now := time.Now()
+	oidcStateMu.Lock()
+	pruneOIDCStateLocked(now)
+	oidcExchanges[code] = oidcExchange{Body: body, ExpiresAt: now.Add(oidcExchangeTTL)}
+	oidcStateMu.Unlock()
+
+	c.Redirect(http.StatusFound, "/?oidc="+code)
+}
+
+type OIDCExchangeRequest struct {
+	Code string `json:"code"`
+}
+
+// OIDCExchange hands the session created by OIDCCallback to the frontend.
+func OIDCExchange(c *gin.Context) {
+	var req OIDCExchangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	oidcStateMu.Lock()
+	ex, ok := oidcExchanges[req.Code]
+	delete(oidcExchanges, req.Code)
+	oidcStateMu.Unlock()
+	if !ok || time.Now().After(ex.ExpiresAt) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "登录已过期，请重试"})
+		return
+	}
+	c.JSON(http.StatusOK, ex.Body)
+}
+
+// parseOIDCConfig validates the oidc section of a system config update. An
+// empty client secret keeps the stored one so the UI never has to see it.
+func parseOIDCConfig(raw interface{}, existing *models.OIDCConfig) (*models.OIDCConfig, string) {
+	if raw == nil {
+		return nil, ""
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, "Invalid oidc"
+	}
+	var oc models.OIDCConfig
+	if err := json.Unmarshal(data, &oc); err != nil {
+		return nil, "Invalid oidc"
+	}
+
+	oc.Issuer = strings.TrimSpace(oc.Issuer)
+	oc.ClientID = strings.TrimSpace(oc.ClientID)
+	oc.RedirectURL = strings.TrimSpace(oc.RedirectURL)
+	if oc.ClientSecret == "" && existing != nil {
+		oc.ClientSecret = existing.ClientSecret
+	}
+	if oc.Enabled {
+		if u, err := url.Parse(oc.Issuer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, "Invalid oidc issuer"
+		}
+		if u, err := url.Parse(oc.RedirectURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, "Invalid oidc redirectUrl"
+		}
+		if oc.ClientID == "" {
+			return nil, "oidc clientId is required"
+		}
+	}
+	for group, role := range oc.RoleMapping {
+		if !models.IsValidRole(role) {
+			return nil, "Invalid role for group " + group
+		}
+	}
+	if oc.DefaultRole != "" && !models.IsValidRole(oc.DefaultRole) {
+		return nil, "Invalid role"
+	}
+	return &oc, ""
+}
@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"flatnasgo-backend/middleware"
+	"flatnasgo-backend/models"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mockIdP is a minimal OpenID provider: discovery, JWKS and a token endpoint
+// that returns an ID token for the nonce it was given as the code.
+func mockIdP(t *testing.T, key *rsa.PrivateKey, claims jwt.MapClaims) *httptest.Server {
+	var srv *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 srv.URL,
+			"authorization_endpoint": srv.URL + "/authorize",
+			"token_endpoint":         srv.URL + "/token",
+			"jwks_uri":               srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "k1",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("code_verifier") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		idClaims := jwt.MapClaims{
+			"iss":   srv.URL,
+			"aud":   "flatnas",
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"nonce": r.Form.Get("code"),
+		}
+		for k, v := range claims {
+			idClaims[k] = v
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, idClaims)
+		token.Header["kid"] = "k1"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("sign id token: %v", err)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": signed})
+	})
+	srv = httptest.NewServer(mux)
+	return srv
+}
+
+func TestOIDCLoginProvisionsUserWithMappedRole(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	idp := mockIdP(t, key, jwt.MapClaims{
+		"sub":                "u-123",
+		"preferred_username": "alice",
+		"groups":             []string{"nas-ops", "staff"},
+	})
+	defer idp.Close()
+
+	setupDataDir(t, models.SystemConfig{
+		AuthMode: "multi",
+		OIDC: &models.OIDCConfig{
+			Enabled:       true,
+			Issuer:        idp.URL,
+			ClientID:      "flatnas",
+			RedirectURL:   "http://nas.local/api/oidc/callback",
+			GroupsClaim:   "groups",
+			RoleMapping:   map[string]string{"nas-ops": models.RoleOperator, "staff": models.RoleViewer},
+			AutoProvision: true,
+		},
+	})
+
+	r := gin.New()
+	r.GET("/api/oidc/login", OIDCLogin)
+	r.GET("/api/oidc/callback", OIDCCallback)
+	r.POST("/api/oidc/exchange", OIDCExchange)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/oidc/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: expected redirect, got %d %s", w.Code, w.Body.String())
+	}
+	authURL, _ := url.Parse(w.Header().Get("Location"))
+	q := authURL.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("expected PKCE parameters, got %v", q)
+	}
+	cookies := w.Result().Cookies()
+
+	// The mock token endpoint echoes the code back as the nonce
+	callback := "/api/oidc/callback?state=" + q.Get("state") + "&code=" + q.Get("nonce")
+	callbackRequest := func(withCookies bool) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, callback, nil)
+		if withCookies {
+			for _, cookie := range cookies {
+				req.AddCookie(cookie)
+			}
+		}
+		return req
+	}
+
+	// A browser that did not start the login can not finish it
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, callbackRequest(false))
+	if !strings.Contains(w.Header().Get("Location"), "oidc_error=invalid_state") {
+		t.Fatalf("expected callback without state cookie to fail, got %q", w.Header().Get("Location"))
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, callbackRequest(true))
+	location := w.Header().Get("Location")
+	if w.Code != http.StatusFound || !strings.HasPrefix(location, "/?oidc=") {
+		t.Fatalf("callback: expected redirect with code, got %d %q", w.Code, location)
+	}
+
+	w = httptest.NewRecorder()
+	body := `{"code":"` + strings.TrimPrefix(location, "/?oidc=") + `"}`
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/oidc/exchange", strings.NewReader(body)))
+	var resp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || resp["token"] == nil || resp["username"] != "alice" || resp["role"] != models.RoleOperator {
+		t.Fatalf("exchange: unexpected response %d %s", w.Code, w.Body.String())
+	}
+
+	user, err := loadUser("alice")
+	if err != nil || user.External == nil || user.External.Subject != "u-123" {
+		t.Fatalf("expected provisioned user linked to the subject, got %+v %v", user, err)
+	}
+
+	// A replayed state is rejected
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, callbackRequest(true))
+	if !strings.Contains(w.Header().Get("Location"), "oidc_error=invalid_state") {
+		t.Fatalf("expected replayed state to fail, got %q", w.Header().Get("Location"))
+	}
+}
+
+// oidcLoginFlow returns a function running a whole login against the mock
+// provider, which returns the response of the final exchange.
+func oidcLoginFlow(t *testing.T) func() map[string]interface{} {
+	r := gin.New()
+	r.GET("/api/oidc/login", OIDCLogin)
+	r.GET("/api/oidc/callback", OIDCCallback)
+	r.POST("/api/oidc/exchange", OIDCExchange)
+	login := func() map[string]interface{} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/oidc/login", nil))
+		authURL, _ := url.Parse(w.Header().Get("Location"))
+		q := authURL.Query()
+		req := httptest.NewRequest(http.MethodGet, "/api/oidc/callback?state="+q.Get("state")+"&code="+q.Get("nonce"), nil)
+		for _, cookie := range w.Result().Cookies() {
+			req.AddCookie(cookie)
+		}
+
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		code := strings.TrimPrefix(w.Header().Get("Location"), "/?oidc=")
+
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/oidc/exchange", strings.NewReader(`{"code":"`+code+`"}`)))
+		var resp map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != http.StatusOK {
+			t.Fatalf("login failed: %d %s", w.Code, w.Body.String())
+		}
+		return resp
+	}
+	return login
+}
+
+func TestOIDCLoginDemotesUserWithoutMappedGroups(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	claims := jwt.MapClaims{"sub": "u-456", "preferred_username": "carol", "groups": []string{"nas-admins"}}
+	idp := mockIdP(t, key, claims)
+	defer idp.Close()
+
+	setupDataDir(t, models.SystemConfig{
+		AuthMode: "multi",
+		OIDC: &models.OIDCConfig{
+			Enabled:       true,
+			Issuer:        idp.URL,
+			ClientID:      "flatnas",
+			RedirectURL:   "http://nas.local/api/oidc/callback",
+			GroupsClaim:   "groups",
+			RoleMapping:   map[string]string{"nas-admins": models.RoleAdmin},
+			DefaultRole:   models.RoleViewer,
+			AutoProvision: true,
+		},
+	})
+	login := oidcLoginFlow(t)
+
+	if resp := login(); resp["role"] != models.RoleAdmin {
+		t.Fatalf("expected admin role from the group, got %v", resp["role"])
+	}
+	middleware.UpdateAPITokens(func(tokens []models.APIToken) ([]models.APIToken, error) {
+		return append(tokens, models.APIToken{ID: "carol-token", Username: "carol", Scopes: []string{models.PermDataRead, models.PermSystemManage}}), nil
+	})
+	version := middleware.TokenVersion("carol")
+
+	// Removed from every mapped group at the provider
+	claims["groups"] = []string{}
+	if resp := login(); resp["role"] != models.RoleViewer {
+		t.Fatalf("expected demotion to the default role, got %v", resp["role"])
+	}
+	if user, err := loadUser("carol"); err != nil || user.Role != models.RoleViewer {
+		t.Fatalf("expected stored role to be demoted, got %+v %v", user, err)
+	}
+	if middleware.TokenVersion("carol") <= version {
+		t.Fatalf("expected outstanding tokens to be revoked")
+	}
+	for _, token := range middleware.ListAPITokens("carol") {
+		if len(token.Scopes) != 1 || token.Scopes[0] != models.PermDataRead {
+			t.Fatalf("expected API token scopes to be restricted, got %v", token.Scopes)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultPasswordMinLength = 8
+	maxPasswordBytes         = 72 // bcrypt ignores anything longer
+)
+
+var (
+	errPasswordIncorrect = errors.New("current password incorrect")
+	errPasswordManaged   = errors.New("password managed by the directory")
+	errPasswordReused    = errors.New("new password equals the old one")
+	errPasswordState     = errors.New("no password change pending")
+)
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+type ForcedPasswordChangeRequest struct {
+	Challenge   string `json:"challenge"`
+	NewPassword string `json:"newPassword"`
+}
+
+type ResetPasswordRequest struct {
+	Password    string `json:"password"`
+	ForceChange bool   `json:"forceChange"` // Require a new password at the next login
+}
+
+// checkPasswordPolicy returns why password is not acceptable, or "". Without
+// a configured policy any non-empty password bcrypt can hash is accepted.
+func checkPasswordPolicy(policy *models.PasswordPolicy, username, password string) string {
+	if password == "" {
+		return "密码不能为空"
+	}
+	var p models.PasswordPolicy
+	if policy != nil {
+		p = *policy
+		if p.MinLength <= 0 {
+			p.MinLength = defaultPasswordMinLength
+		}
+	}
+	if len([]rune(password)) < p.MinLength {
+		return "密码长度不能少于 " + strconv.Itoa(p.MinLength) + " 位"
+	}
+	if len(password) > maxPasswordBytes {
+		return "密码过长"
+	}
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	switch {
+	case p.RequireUpper && !upper:
+		return "密码必须包含大写字母"
+	case p.RequireLower && !lower:
+		return "密码必须包含小写字母"
+	case p.RequireDigit && !digit:
+		return "密码必须包含数字"
+	case p.RequireSymbol && !symbol:
+		return "密码必须包含特殊字符"
+	}
+	if p.DisallowUsername && username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return "密码不能包含用户名"
+	}
+	return ""
+}
+
+func loadPasswordPolicy() *models.PasswordPolicy {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	return sysConfig.PasswordPolicy
+}
+
+// finishPasswordLogin completes a login whose password (and second factor)
+// were verified. An account reset by an admin must pick a new password
+// before it gets a session.
+func finishPasswordLogin(c *gin.Context, clientIP, username string, user *models.User) {
+	recordLoginSuccess(clientIP, username)
+	if !user.MustChangePassword {
+		issueLoginToken(c, username, user)
+		return
+	}
+	signed, err := signLoginChallenge(username, "password")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign token"})
+		return
+	}
+	c.JSON(http.StatusUnauthorized, gin.H{
+		"error":                  "需要修改密码",
+		"passwordChangeRequired": true,
+		"challenge":              signed,
+		"username":               username,
+	})
+}
+
+// setPassword hashes password and stores it for username once check accepts
+// the current record. mustChange asks for another change at the next login.
+func setPassword(username, password string, mustChange bool, check func(user *models.User) error) (*models.User, error) {
+	hashed, err := utils.HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	return updateUserAccount(username, func(user *models.User) error {
+		if user.External != nil && user.External.Provider == "ldap" {
+			return errPasswordManaged
+		}
+		if err := check(user); err != nil {
+			return err
+		}
+		user.Password = hashed
+		user.MustChangePassword = mustChange
+		return nil
+	})
+}
+
+func respondPasswordError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errPasswordIncorrect):
+		c.JSON(http.StatusForbidden, gin.H{"error": "当前密码错误"})
+	case errors.Is(err, errPasswordManaged):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "该账号的密码由 LDAP 管理"})
+	case errors.Is(err, errPasswordReused):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "新密码不能与旧密码相同"})
+	case os.IsNotExist(err):
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save user"})
+	}
+}
+
+// ChangePassword lets a signed in user pick a new password after confirming
+// the current one. Every other session of the user is signed out.
+func ChangePassword(c *gin.Context) {
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	username := c.GetString("username")
+	clientIP := c.ClientIP()
+	if wait, locked := loginLockedOut(clientIP, username); locked {
+		respondLoginLocked(c, wait)
+		return
+	}
+	if msg := checkPasswordPolicy(loadPasswordPolicy(), username, req.NewPassword); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	_, err := setPassword(username, req.NewPassword, false, func(user *models.User) error {
+		if !passwordMatches(user.Password, req.CurrentPassword) {
+			return errPasswordIncorrect
+		}
+		if req.NewPassword == req.CurrentPassword {
+			return errPasswordReused
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, errPasswordIncorrect) {
+			// A stolen session must not become a way to guess the password
+			recordLoginFailure(clientIP, username)
+			audit(c, "password.change.failed", username, nil)
+		}
+		respondPasswordError(c, err)
+		return
+	}
+
+	audit(c, "password.change", username, nil)
+
+	// Sign out every other device; this one gets a token of the new version
+	sessionID := c.GetString("sessionId")
+	if revokeUserSessions(username, sessionID) {
+		if user, err := loadUser(username); err == nil {
+			if token, _, _, err := signAccessToken(username, sessionID, user); err == nil {
+				c.JSON(http.StatusOK, gin.H{"success": true, "token": token})
+				return
+			}
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// LoginChangePassword completes a login that finishPasswordLogin held back
+// because an admin reset the password.
+func LoginChangePassword(c *gin.Context) {
+	var req ForcedPasswordChangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	username, ok := parseLoginChallenge(req.Challenge, "password")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "验证已过期，请重新登录"})
+		return
+	}
+	if msg := checkPasswordPolicy(loadPasswordPolicy(), username, req.NewPassword); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	user, err := setPassword(username, req.NewPassword, false, func(user *models.User) error {
+		// The challenge is spent once the password was changed
+		if !user.MustChangePassword {
+			return errPasswordState
+		}
+		if passwordMatches(user.Password, req.NewPassword) {
+			return errPasswordReused
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, errPasswordState) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "验证已过期，请重新登录"})
+			return
+		}
+		respondPasswordError(c, err)
+		return
+	}
+	issueLoginToken(c, username, user)
+}
+
+// ResetUserPassword lets an admin set the password of another user, e.g.
+// after it was forgotten. All sessions of the user are signed out.
+func ResetUserPassword(c *gin.Context) {
+	username := c.Param("usr")
+	// The admin account and one's own password are changed with ChangePassword
+	if username == "" || username == "admin" || username == c.GetString("username") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid username"})
+		return
+	}
+	var req ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	if msg := checkPasswordPolicy(loadPasswordPolicy(), username, req.Password); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+
+	_, err := setPassword(username, req.Password, req.ForceChange, func(user *models.User) error {
+		return nil
+	})
+	if err != nil {
+		respondPasswordError(c, err)
+		return
+	}
+	revokeUserSessions(username, "")
+	audit(c, "user.password.reset", username, gin.H{"forceChange": req.ForceChange})
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// parsePasswordPolicy validates the passwordPolicy section of a system
+// config update.
+func parsePasswordPolicy(raw interface{}) (*models.PasswordPolicy, string) {
+	if raw == nil {
+		return nil, ""
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, "Invalid passwordPolicy"
+	}
+	var p models.PasswordPolicy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, "Invalid passwordPolicy"
+	}
+	if p.MinLength < 0 || p.MinLength > maxPasswordBytes {
+		return nil, "Invalid passwordPolicy minLength"
+	}
+	return &p, ""
+}
@@ -0,0 +1,21 @@
+package handlers
+
+import (
+	"flatnasgo-backend/models"
+	"testing"
+)
+
+func TestCheckPasswordPolicyDefaultsOnlyWhenConfigured(t *testing.T) {
+	if msg := checkPasswordPolicy(nil, "alice", "abc"); msg != "" {
+		t.Fatalf("expected short password without a policy to pass, got %q", msg)
+	}
+	if msg := checkPasswordPolicy(nil, "alice", ""); msg == "" {
+		t.Fatalf("expected empty password to be rejected")
+	}
+	if msg := checkPasswordPolicy(&models.PasswordPolicy{RequireDigit: true}, "alice", "abc1"); msg == "" {
+		t.Fatalf("expected configured policy to apply the default minimum length")
+	}
+	if msg := checkPasswordPolicy(&models.PasswordPolicy{RequireDigit: true}, "alice", "abcdefg1"); msg != "" {
+		t.Fatalf("expected password to satisfy the policy, got %q", msg)
+	}
+}
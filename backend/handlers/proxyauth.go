@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flatnasgo-backend/middleware"
+	"flatnasgo-backend/models"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var headerNamePattern = regexp.MustCompile(`^[A-Za-z0-9-]{1,64}$`)
+
+// ProxyLogin starts a regular session for the user asserted by a trusted
+// authenticating proxy, so the frontend gets tokens without a password.
+func ProxyLogin(c *gin.Context) {
+	u, ok := middleware.ProxyIdentity(c.Request.RemoteAddr, c.Request.Header)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	user, err := loadUser(u.Username)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	issueLoginToken(c, u.Username, user)
+}
+
+// parseProxyAuthConfig validates the proxyAuth section of a system config
+// update. It returns an error message for the client when invalid.
+func parseProxyAuthConfig(raw interface{}) (*models.ProxyAuthConfig, string) {
+	if raw == nil {
+		return nil, ""
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, "Invalid proxyAuth"
+	}
+	var pa models.ProxyAuthConfig
+	if err := json.Unmarshal(data, &pa); err != nil {
+		return nil, "Invalid proxyAuth"
+	}
+
+	pa.Header = strings.TrimSpace(pa.Header)
+	if pa.Header != "" && !headerNamePattern.MatchString(pa.Header) {
+		return nil, "Invalid proxyAuth header"
+	}
+	proxies, bad := cleanAddressList(pa.TrustedProxies)
+	if bad != "" {
+		return nil, "Invalid trusted proxy: " + bad
+	}
+	pa.TrustedProxies = proxies
+	if pa.Enabled && len(pa.TrustedProxies) == 0 {
+		return nil, "proxyAuth requires at least one trusted proxy"
+	}
+	if pa.DefaultRole != "" && !models.IsValidRole(pa.DefaultRole) {
+		return nil, "Invalid role"
+	}
+	return &pa, ""
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setupProxyLoginTest trusts identity headers from 10.0.0.0/24 only and
+// creates the account bob.
+func setupProxyLoginTest(t *testing.T) {
+	setupDataDir(t, models.SystemConfig{
+		AuthMode: "multi",
+		ProxyAuth: &models.ProxyAuthConfig{
+			Enabled:        true,
+			TrustedProxies: []string{"10.0.0.0/24"},
+		},
+	})
+	utils.WriteJSON(filepath.Join(config.UsersDir, "bob.json"), models.User{Username: "bob", Role: models.RoleMember})
+}
+
+func TestProxyLoginIgnoresUntrustedPeers(t *testing.T) {
+	setupProxyLoginTest(t)
+	r := gin.New()
+	r.POST("/api/login/proxy", ProxyLogin)
+
+	login := func(peer string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/login/proxy", nil)
+		req.RemoteAddr = net.JoinHostPort(peer, "40000")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := login("203.0.113.5", map[string]string{"Remote-User": "bob"}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected the header of an untrusted peer to be ignored, got %d", w.Code)
+	}
+	if w := login("203.0.113.5", map[string]string{"Remote-User": "bob", "X-Forwarded-For": "10.0.0.5"}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a forwarded trusted address to be ignored, got %d", w.Code)
+	}
+	if w := login("10.0.0.5", map[string]string{"Remote-User": "bob"}); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"username":"bob"`) {
+		t.Fatalf("expected the trusted proxy to sign bob in, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestValidateSocketTokenIgnoresProxyHeaderFromUntrustedPeers(t *testing.T) {
+	setupProxyLoginTest(t)
+
+	trusted := newFakeSocket("10.0.0.5")
+	trusted.header.Set("Remote-User", "bob")
+	if username, ok := validateSocketToken(trusted, ""); !ok || username != "bob" {
+		t.Fatalf("expected the trusted proxy to name bob, got %q %v", username, ok)
+	}
+
+	untrusted := newFakeSocket("203.0.113.5")
+	untrusted.header.Set("Remote-User", "bob")
+	untrusted.header.Set("X-Forwarded-For", "10.0.0.5")
+	if username, ok := validateSocketToken(untrusted, ""); ok {
+		t.Fatalf("expected the header of an untrusted peer to be ignored, got %q", username)
+	}
+	if _, ok := authorizeSocketEvent(untrusted, "todo:update", ""); ok || len(untrusted.emitted["auth:error"]) != 1 {
+		t.Fatalf("expected the event to be refused with an auth error")
+	}
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type PublicPageRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// filterPublicData keeps only the groups, items and widgets marked isPublic.
+func filterPublicData(userData map[string]interface{}) {
+	// Filter public items manually in the map structure
+	// This is tricky with untyped map, but necessary to preserve data integrity
+	if groups, ok := userData["groups"].([]interface{}); ok {
+		var filteredGroups []interface{}
+		for _, g := range groups {
+			if groupMap, ok := g.(map[string]interface{}); ok {
+				if items, ok := groupMap["items"].([]interface{}); ok {
+					var publicItems []interface{}
+					for _, item := range items {
+						if itemMap, ok := item.(map[string]interface{}); ok {
+							if isPublic, ok := itemMap["isPublic"].(bool); ok && isPublic {
+								publicItems = append(publicItems, itemMap)
+							}
+						}
+					}
+					// Only keep group if it has public items (or maybe keep empty groups?)
+					// Previous logic: if len(publicItems) > 0 { ... }
+					if len(publicItems) > 0 {
+						groupMap["items"] = publicItems
+						filteredGroups = append(filteredGroups, groupMap)
+					}
+				}
+			}
+		}
+		userData["groups"] = filteredGroups
+	}
+
+	if widgets, ok := userData["widgets"].([]interface{}); ok {
+		var filteredWidgets []interface{}
+		for _, w := range widgets {
+			if widgetMap, ok := w.(map[string]interface{}); ok {
+				if isPublic, ok := widgetMap["isPublic"].(bool); ok && isPublic {
+					filteredWidgets = append(filteredWidgets, widgetMap)
+				}
+			}
+		}
+		userData["widgets"] = filteredWidgets
+	}
+}
+
+// GetPublicData serves the public dashboard of a user who opted in, to
+// anyone. Unknown users and those who did not opt in look the same.
+func GetPublicData(c *gin.Context) {
+	username := c.Param("username")
+	if !utils.IsValidUsername(username) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Public page not found"})
+		return
+	}
+
+	var userData map[string]interface{}
+	if err := utils.ReadJSON(userFilePath(username), &userData); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Public page not found"})
+		return
+	}
+	if published, _ := userData["publicPage"].(bool); !published {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Public page not found"})
+		return
+	}
+	if disabled, _ := userData["disabled"].(bool); disabled {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Public page not found"})
+		return
+	}
+
+	for _, k := range append(secretUserKeys, protectedUserKeys...) {
+		delete(userData, k)
+	}
+	filterPublicData(userData)
+
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	redactSystemConfig(&sysConfig, false)
+	userData["systemConfig"] = sysConfig
+	userData["username"] = username
+
+	c.JSON(http.StatusOK, userData)
+}
+
+// SetPublicPage publishes or unpublishes the public dashboard of the signed
+// in user.
+func SetPublicPage(c *gin.Context) {
+	var req PublicPageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	username := c.GetString("username")
+	if _, err := updateUserAccount(username, func(user *models.User) error {
+		user.PublicPage = req.Enabled
+		return nil
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+		return
+	}
+	audit(c, "public.page", username, gin.H{"enabled": req.Enabled})
+	c.JSON(http.StatusOK, gin.H{"success": true, "publicPage": req.Enabled})
+}
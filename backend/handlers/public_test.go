@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPublicPageIsOptIn(t *testing.T) {
+	setupDataDir(t, models.SystemConfig{AuthMode: "multi"})
+	utils.WriteJSON(userFilePath("alice"), map[string]interface{}{
+		"username": "alice",
+		"password": "hash",
+		"groups": []interface{}{
+			map[string]interface{}{"id": "g1", "items": []interface{}{
+				map[string]interface{}{"id": "public", "isPublic": true},
+				map[string]interface{}{"id": "private"},
+			}},
+			map[string]interface{}{"id": "g2", "items": []interface{}{map[string]interface{}{"id": "hidden"}}},
+		},
+		"widgets": []interface{}{
+			map[string]interface{}{"id": "w1", "isPublic": true},
+			map[string]interface{}{"id": "w2"},
+		},
+	})
+
+	r := gin.New()
+	r.GET("/api/public/:username/data", GetPublicData)
+	r.PUT("/api/public-page", func(c *gin.Context) { c.Set("username", "alice") }, SetPublicPage)
+	get := func(username string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/public/"+username+"/data", nil))
+		return w
+	}
+	publish := func(enabled string) {
+		req := httptest.NewRequest(http.MethodPut, "/api/public-page", strings.NewReader(`{"enabled":`+enabled+`}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("publish failed: %d %s", w.Code, w.Body.String())
+		}
+	}
+
+	if w := get("alice"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected unpublished page to be hidden, got %d", w.Code)
+	}
+	if w := get("nobody"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected unknown user to be hidden, got %d", w.Code)
+	}
+
+	publish("true")
+	w := get("alice")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected published page, got %d", w.Code)
+	}
+	var page struct {
+		Password string `json:"password"`
+		Groups   []struct {
+			ID    string `json:"id"`
+			Items []struct {
+				ID string `json:"id"`
+			} `json:"items"`
+		} `json:"groups"`
+		Widgets []struct {
+			ID string `json:"id"`
+		} `json:"widgets"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &page)
+	if page.Password != "" || strings.Contains(w.Body.String(), "publicPage") {
+		t.Fatalf("account fields leaked: %s", w.Body.String())
+	}
+	if len(page.Groups) != 1 || len(page.Groups[0].Items) != 1 || page.Groups[0].Items[0].ID != "public" {
+		t.Fatalf("unexpected groups %+v", page.Groups)
+	}
+	if len(page.Widgets) != 1 || page.Widgets[0].ID != "w1" {
+		t.Fatalf("unexpected widgets %+v", page.Widgets)
+	}
+
+	publish("false")
+	if w := get("alice"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected unpublished page to be hidden again, got %d", w.Code)
+	}
+}
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// revisionKey is the dashboard field counting its saves. Clients send back
+// the revision they loaded so a stale tab cannot overwrite newer changes.
+const revisionKey = "revision"
+
+func documentRevision(doc map[string]interface{}) int64 {
+	switch v := doc[revisionKey].(type) {
+	case float64:
+		return int64(v)
+	case int64:
+		return v
+	case int:
+		return int64(v)
+	}
+	return 0
+}
+
+// bumpRevision stores the revision following the one of current in doc.
+func bumpRevision(doc, current map[string]interface{}) int64 {
+	next := documentRevision(current) + 1
+	doc[revisionKey] = next
+	return next
+}
+
+func revisionETag(rev int64) string {
+	return `"` + strconv.FormatInt(rev, 10) + `"`
+}
+
+// requestedRevision returns the revision a save is based on, from the
+// If-Match header or else the revision field of the payload. An If-Match
+// of "*" matches any revision.
+func requestedRevision(c *gin.Context, payload map[string]interface{}) (rev int64, any bool, ok bool) {
+	if header := strings.TrimSpace(c.GetHeader("If-Match")); header != "" {
+		if header == "*" {
+			return 0, true, true
+		}
+		value := strings.Trim(strings.TrimPrefix(header, "W/"), `"`)
+		rev, err := strconv.ParseInt(value, 10, 64)
+		return rev, false, err == nil
+	}
+	if _, present := payload[revisionKey]; present {
+		rev, isNumber := payload[revisionKey].(float64)
+		return int64(rev), false, isNumber
+	}
+	return 0, false, false
+}
+
+// respondRevisionConflict tells the client its copy is outdated, with the
+// revision to reload.
+func respondRevisionConflict(c *gin.Context, current int64) {
+	c.Header("ETag", revisionETag(current))
+	c.JSON(http.StatusConflict, gin.H{"error": "数据已在其他设备上修改，请刷新后重试", "revision": current})
+}
@@ -0,0 +1,289 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/models"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxDashboardBytes   = 8 << 20
+	maxStringBytes      = 1 << 20
+	maxInlineImageBytes = 512 << 10 // data: URLs, uploads belong in the wallpaper or icon folders
+	maxGroups           = 500
+	maxItemsPerGroup    = 2000
+	maxWidgets          = 500
+	maxFieldErrors      = 50
+)
+
+// FieldError is a problem with one field of a dashboard document. Path
+// points at the field, e.g. "groups[0].items[2].url".
+type FieldError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+var (
+	groupType     = reflect.TypeOf(models.Group{})
+	itemType      = reflect.TypeOf(models.Item{})
+	widgetType    = reflect.TypeOf(models.Widget{})
+	appConfigType = reflect.TypeOf(models.AppConfig{})
+)
+
+func respondFieldErrors(c *gin.Context, errs []FieldError) {
+	if len(errs) > maxFieldErrors {
+		errs = errs[:maxFieldErrors]
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "数据校验失败", "fields": errs})
+}
+
+// isBodyTooLarge reports whether binding failed on the body size limit.
+func isBodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func describeType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "a list"
+	}
+	return "an object"
+}
+
+func isIntKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+// checkFields reports the fields of obj whose value does not fit the type
+// the model declares for them. Fractions given for whole numbers are
+// rounded. Fields the model does not know are kept without checks, the
+// frontend stores more than the models describe.
+func checkFields(path string, obj map[string]interface{}, model reflect.Type, skip ...string) []FieldError {
+	var errs []FieldError
+fields:
+	for i := 0; i < model.NumField(); i++ {
+		f := model.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		for _, s := range skip {
+			if s == name {
+				continue fields
+			}
+		}
+		v, ok := obj[name]
+		if !ok || v == nil {
+			continue
+		}
+		if n, ok := v.(float64); ok && isIntKind(f.Type.Kind()) && n != math.Trunc(n) {
+			v = math.Round(n)
+			obj[name] = v
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			errs = append(errs, FieldError{joinPath(path, name), "is not valid JSON"})
+			continue
+		}
+		if err := json.Unmarshal(data, reflect.New(f.Type).Interface()); err != nil {
+			fieldPath := joinPath(path, name)
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) && typeErr.Field != "" {
+				fieldPath = joinPath(fieldPath, typeErr.Field)
+				errs = append(errs, FieldError{fieldPath, "must be " + describeType(typeErr.Type)})
+			} else {
+				errs = append(errs, FieldError{fieldPath, "must be " + describeType(f.Type)})
+			}
+		}
+	}
+	return errs
+}
+
+// checkSizes reports strings below v that are too large to keep in a
+// dashboard, such as inline images of several megabytes.
+func checkSizes(path string, v interface{}) []FieldError {
+	var errs []FieldError
+	switch t := v.(type) {
+	case string:
+		if strings.HasPrefix(t, "data:") && len(t) > maxInlineImageBytes {
+			errs = append(errs, FieldError{path, fmt.Sprintf("inline data is larger than %d KB", maxInlineImageBytes>>10)})
+		} else if len(t) > maxStringBytes {
+			errs = append(errs, FieldError{path, fmt.Sprintf("is larger than %d KB", maxStringBytes>>10)})
+		}
+	case map[string]interface{}:
+		for k, e := range t {
+			errs = append(errs, checkSizes(joinPath(path, k), e)...)
+		}
+	case []interface{}:
+		for i, e := range t {
+			errs = append(errs, checkSizes(fmt.Sprintf("%s[%d]", path, i), e)...)
+		}
+	}
+	return errs
+}
+
+// objectList returns the list under key of obj, which has to hold objects
+// only. A missing list is no error.
+func objectList(path string, obj map[string]interface{}, key string) ([]map[string]interface{}, []FieldError) {
+	raw, ok := obj[key]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, []FieldError{{joinPath(path, key), "must be a list"}}
+	}
+	entries := make([]map[string]interface{}, 0, len(list))
+	var errs []FieldError
+	for i, e := range list {
+		m, ok := e.(map[string]interface{})
+		if !ok {
+			errs = append(errs, FieldError{fmt.Sprintf("%s[%d]", joinPath(path, key), i), "must be an object"})
+			continue
+		}
+		entries = append(entries, m)
+	}
+	return entries, errs
+}
+
+// ensureID gives entry a string ID that is not in seen yet and records it.
+// Numeric IDs of old data are turned into strings, missing and duplicate
+// ones are replaced. It reports whether the ID was changed.
+func ensureID(entry map[string]interface{}, seen map[string]bool) (bool, error) {
+	changed := false
+	switch v := entry["id"].(type) {
+	case float64:
+		entry["id"] = strconv.FormatFloat(v, 'f', -1, 64)
+		changed = true
+	case string, nil:
+	default:
+		return false, nil // reported by checkFields
+	}
+	id, _ := entry["id"].(string)
+	for id == "" || seen[id] {
+		var err error
+		if id, err = randomHex(8); err != nil {
+			return false, err
+		}
+		entry["id"] = id
+		changed = true
+	}
+	seen[id] = true
+	return changed, nil
+}
+
+// normalizeDashboard checks a dashboard document against the models and
+// repairs what can be repaired without guessing: missing or duplicate IDs
+// are generated. It reports whether an ID was changed, which the client has
+// to learn about, and returns what is left wrong.
+func normalizeDashboard(doc map[string]interface{}) (bool, []FieldError, error) {
+	errs := checkSizes("", doc)
+	changed := false
+	ensure := func(entry map[string]interface{}, seen map[string]bool) error {
+		c, err := ensureID(entry, seen)
+		changed = changed || c
+		return err
+	}
+
+	groups, listErrs := objectList("", doc, "groups")
+	errs = append(errs, listErrs...)
+	if len(groups) > maxGroups {
+		errs = append(errs, FieldError{"groups", fmt.Sprintf("has more than %d entries", maxGroups)})
+	}
+	groupIDs := map[string]bool{}
+	itemIDs := map[string]bool{}
+	for i, group := range groups {
+		path := fmt.Sprintf("groups[%d]", i)
+		if err := ensure(group, groupIDs); err != nil {
+			return false, nil, err
+		}
+		errs = append(errs, checkFields(path, group, groupType, "items")...)
+		items, listErrs := objectList(path, group, "items")
+		errs = append(errs, listErrs...)
+		if len(items) > maxItemsPerGroup {
+			errs = append(errs, FieldError{path + ".items", fmt.Sprintf("has more than %d entries", maxItemsPerGroup)})
+		}
+		for j, item := range items {
+			if err := ensure(item, itemIDs); err != nil {
+				return false, nil, err
+			}
+			errs = append(errs, checkFields(fmt.Sprintf("%s.items[%d]", path, j), item, itemType)...)
+		}
+	}
+
+	// Dashboards from before groups keep their items at the top level
+	legacyItems, listErrs := objectList("", doc, "items")
+	errs = append(errs, listErrs...)
+	for i, item := range legacyItems {
+		if err := ensure(item, itemIDs); err != nil {
+			return false, nil, err
+		}
+		errs = append(errs, checkFields(fmt.Sprintf("items[%d]", i), item, itemType)...)
+	}
+
+	widgets, listErrs := objectList("", doc, "widgets")
+	errs = append(errs, listErrs...)
+	if len(widgets) > maxWidgets {
+		errs = append(errs, FieldError{"widgets", fmt.Sprintf("has more than %d entries", maxWidgets)})
+	}
+	widgetIDs := map[string]bool{}
+	for i, widget := range widgets {
+		if err := ensure(widget, widgetIDs); err != nil {
+			return false, nil, err
+		}
+		errs = append(errs, checkWidgetFields(fmt.Sprintf("widgets[%d]", i), widget)...)
+	}
+
+	if raw, ok := doc["appConfig"]; ok && raw != nil {
+		if appConfig, ok := raw.(map[string]interface{}); ok {
+			errs = append(errs, checkFields("appConfig", appConfig, appConfigType)...)
+		} else {
+			errs = append(errs, FieldError{"appConfig", "must be an object"})
+		}
+	}
+	for _, key := range []string{"rssFeeds", "rssCategories"} {
+		_, listErrs := objectList("", doc, key)
+		errs = append(errs, listErrs...)
+	}
+	return changed, errs, nil
+}
+
+func checkWidgetFields(path string, widget map[string]interface{}) []FieldError {
+	errs := checkFields(path, widget, widgetType)
+	if layouts, ok := widget["layouts"].(map[string]interface{}); ok {
+		for name := range layouts {
+			if !widgetLayoutNames[name] {
+				errs = append(errs, FieldError{joinPath(path, "layouts."+name), "is not a known layout"})
+			}
+		}
+	}
+	return errs
+}
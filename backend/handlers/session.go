@@ -0,0 +1,429 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/middleware"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var errSessionNotFound = errors.New("session not found")
+var errSessionReused = errors.New("refresh token reused")
+var errAccountDisabled = errors.New("account disabled")
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+func getSessionsFile() string {
+	return filepath.Join(config.DataDir, "sessions.json")
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	bytes := make([]byte, n)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// updateSessions runs fn on the session list under the file lock, dropping
+// expired sessions before writing it back.
+func updateSessions(fn func(sessions []models.Session) ([]models.Session, error)) error {
+	path := getSessionsFile()
+	return utils.WithFileLock(path, func() error {
+		var sessions []models.Session
+		utils.ReadJSONUnlocked(path, &sessions)
+		updated, err := fn(sessions)
+		if err != nil {
+			return err
+		}
+		now := time.Now().Unix()
+		kept := make([]models.Session, 0, len(updated))
+		for _, s := range updated {
+			if s.ExpiresAt > now {
+				kept = append(kept, s)
+			}
+		}
+		return utils.WriteJSONUnlocked(path, kept)
+	})
+}
+
+// clientInfo returns the IP and a bounded user agent recorded for sessions.
+func clientInfo(c *gin.Context) (string, string) {
+	ua := c.Request.UserAgent()
+	if len(ua) > 256 {
+		ua = ua[:256]
+	}
+	return c.ClientIP(), ua
+}
+
+func createSession(username, ip, userAgent string) (*models.Session, string, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return nil, "", err
+	}
+	refreshToken, err := randomHex(32)
+	if err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	session := models.Session{
+		ID:        id,
+		Username:  username,
+		TokenHash: hashRefreshToken(refreshToken),
+		CreatedAt: now.Unix(),
+		LastSeen:  now.Unix(),
+		ExpiresAt: now.Add(refreshTokenTTL).Unix(),
+		IP:        ip,
+		UserAgent: userAgent,
+	}
+	err = updateSessions(func(sessions []models.Session) ([]models.Session, error) {
+		return append(sessions, session), nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return &session, refreshToken, nil
+}
+
+// rotateSession exchanges a refresh token for a new one. Presenting a token
+// that was already rotated out means it leaked, so the session is revoked.
+func rotateSession(refreshToken, ip, userAgent string) (*models.Session, string, error) {
+	next, err := randomHex(32)
+	if err != nil {
+		return nil, "", err
+	}
+	hashed := hashRefreshToken(refreshToken)
+	var rotated *models.Session
+	var reused *models.Session
+	err = updateSessions(func(sessions []models.Session) ([]models.Session, error) {
+		now := time.Now().Unix()
+		for i := range sessions {
+			s := &sessions[i]
+			if s.ExpiresAt <= now {
+				continue
+			}
+			if s.TokenHash == hashed {
+				s.PreviousHash = s.TokenHash
+				s.TokenHash = hashRefreshToken(next)
+				s.LastSeen = now
+				s.IP = ip
+				s.UserAgent = userAgent
+				copied := *s
+				rotated = &copied
+				return sessions, nil
+			}
+			if s.PreviousHash != "" && s.PreviousHash == hashed {
+				copied := *s
+				reused = &copied
+				return append(sessions[:i], sessions[i+1:]...), nil
+			}
+		}
+		return nil, errSessionNotFound
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if reused != nil {
+		middleware.RevokeSession(reused.ID, time.Now().Add(accessTokenTTL))
+		return nil, "", errSessionReused
+	}
+	return rotated, next, nil
+}
+
+func revokeSession(id string) (*models.Session, error) {
+	var removed *models.Session
+	err := updateSessions(func(sessions []models.Session) ([]models.Session, error) {
+		for i := range sessions {
+			if sessions[i].ID == id {
+				copied := sessions[i]
+				removed = &copied
+				return append(sessions[:i], sessions[i+1:]...), nil
+			}
+		}
+		return nil, errSessionNotFound
+	})
+	if err != nil {
+		return nil, err
+	}
+	middleware.RevokeSession(id, time.Now().Add(accessTokenTTL))
+	middleware.ForgetSession(id)
+	return removed, nil
+}
+
+// revokeUserSessions signs username out everywhere except keepSessionID and
+// invalidates every access token issued to them so far. It returns whether
+// the kept session still exists and can be handed a fresh access token.
+func revokeUserSessions(username, keepSessionID string) bool {
+	kept := false
+	var removed []string
+	err := updateSessions(func(sessions []models.Session) ([]models.Session, error) {
+		remaining := sessions[:0]
+		for _, s := range sessions {
+			if s.Username != username {
+				remaining = append(remaining, s)
+				continue
+			}
+			if keepSessionID != "" && s.ID == keepSessionID {
+				kept = true
+				remaining = append(remaining, s)
+				continue
+			}
+			removed = append(removed, s.ID)
+		}
+		return remaining, nil
+	})
+	if err != nil {
+		log.Printf("Failed to revoke sessions of %s: %v", username, err)
+	}
+	middleware.RevokeUserTokens(username)
+	for _, id := range removed {
+		middleware.ForgetSession(id)
+	}
+	return kept
+}
+
+func signAccessToken(username, sessionID string, user *models.User) (string, string, []string, error) {
+	role := models.EffectiveRole(username, user.Role)
+	permissions := models.EffectivePermissions(role, user.Permissions)
+	signed, err := utils.SignToken(config.KeyPurposeSession, jwt.MapClaims{
+		"username":    username,
+		"role":        role,
+		"permissions": permissions,
+		"sid":         sessionID,
+		"tv":          middleware.TokenVersion(username),
+		"exp":         time.Now().Add(accessTokenTTL).Unix(),
+	})
+	return signed, role, permissions, err
+}
+
+// newLoginSession creates a session for a successful login and returns the
+// response body: a short lived access token carrying the role and
+// permissions of the user, and the refresh token used to renew it.
+func newLoginSession(c *gin.Context, username string, user *models.User) (gin.H, error) {
+	if user.Disabled {
+		return nil, errAccountDisabled
+	}
+	ip, userAgent := clientInfo(c)
+	session, refreshToken, err := createSession(username, ip, userAgent)
+	if err != nil {
+		return nil, err
+	}
+	tokenString, role, permissions, err := signAccessToken(username, session.ID, user)
+	if err != nil {
+		return nil, err
+	}
+	auditLogin(c, username, "login.success", gin.H{"via": c.FullPath()})
+	return gin.H{
+		"success":      true,
+		"token":        tokenString,
+		"refreshToken": refreshToken,
+		"expiresIn":    int64(accessTokenTTL / time.Second),
+		"username":     username,
+		"role":         role,
+		"permissions":  permissions,
+	}, nil
+}
+
+func issueLoginToken(c *gin.Context, username string, user *models.User) {
+	body, err := newLoginSession(c, username, user)
+	if errors.Is(err, errAccountDisabled) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "账号已被禁用"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return
+	}
+	c.JSON(http.StatusOK, body)
+}
+
+// RefreshToken rotates the refresh token and issues a new access token with
+// the current role and permissions of the user.
+func RefreshToken(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.RefreshToken == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	ip, userAgent := clientInfo(c)
+	session, refreshToken, err := rotateSession(req.RefreshToken, ip, userAgent)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	user, err := loadUser(session.Username)
+	if err != nil || user.Disabled {
+		revokeSession(session.ID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	tokenString, role, permissions, err := signAccessToken(session.Username, session.ID, user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign token"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success":      true,
+		"token":        tokenString,
+		"refreshToken": refreshToken,
+		"expiresIn":    int64(accessTokenTTL / time.Second),
+		"username":     session.Username,
+		"role":         role,
+		"permissions":  permissions,
+	})
+}
+
+// Logout ends the session identified by the refresh token in the body, or by
+// the access token of the request.
+func Logout(c *gin.Context) {
+	var req RefreshRequest
+	_ = c.ShouldBindJSON(&req)
+
+	sessionID := c.GetString("sessionId")
+	username := c.GetString("username")
+	if req.RefreshToken != "" {
+		hashed := hashRefreshToken(req.RefreshToken)
+		var sessions []models.Session
+		utils.ReadJSON(getSessionsFile(), &sessions)
+		for _, s := range sessions {
+			if s.TokenHash == hashed {
+				sessionID = s.ID
+				username = s.Username
+				break
+			}
+		}
+	}
+	if sessionID != "" {
+		revokeSession(sessionID)
+		auditLogin(c, username, "logout", nil)
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+type SessionInfo struct {
+	ID        string `json:"id"`
+	Username  string `json:"username"`
+	CreatedAt int64  `json:"createdAt"`
+	LastSeen  int64  `json:"lastSeen"`
+	ExpiresAt int64  `json:"expiresAt"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"userAgent"`
+	Current   bool   `json:"current"`
+}
+
+// listSessions returns the live sessions of username, or of everybody when
+// username is empty, most recently active first.
+func listSessions(username, currentID string) []SessionInfo {
+	var sessions []models.Session
+	utils.ReadJSON(getSessionsFile(), &sessions)
+	now := time.Now().Unix()
+	list := make([]SessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		if s.ExpiresAt <= now || (username != "" && s.Username != username) {
+			continue
+		}
+		lastSeen := s.LastSeen
+		if seen := middleware.SessionLastSeen(s.ID); seen > lastSeen {
+			lastSeen = seen
+		}
+		list = append(list, SessionInfo{
+			ID:        s.ID,
+			Username:  s.Username,
+			CreatedAt: s.CreatedAt,
+			LastSeen:  lastSeen,
+			ExpiresAt: s.ExpiresAt,
+			IP:        s.IP,
+			UserAgent: s.UserAgent,
+			Current:   s.ID == currentID,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LastSeen > list[j].LastSeen
+	})
+	return list
+}
+
+func GetSessions(c *gin.Context) {
+	list := listSessions(c.GetString("username"), c.GetString("sessionId"))
+	c.JSON(http.StatusOK, gin.H{"success": true, "sessions": list})
+}
+
+// RevokeSession signs out one of the devices of the current user.
+func RevokeSession(c *gin.Context) {
+	id := c.Param("id")
+	username := c.GetString("username")
+
+	var sessions []models.Session
+	utils.ReadJSON(getSessionsFile(), &sessions)
+	owned := false
+	for _, s := range sessions {
+		if s.ID == id && s.Username == username {
+			owned = true
+			break
+		}
+	}
+	if !owned {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	if _, err := revokeSession(id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// RevokeOtherSessions signs the current user out of every other device.
+func RevokeOtherSessions(c *gin.Context) {
+	username := c.GetString("username")
+	currentID := c.GetString("sessionId")
+	for _, s := range listSessions(username, currentID) {
+		if !s.Current {
+			revokeSession(s.ID)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func GetAllSessions(c *gin.Context) {
+	list := listSessions(c.Query("username"), c.GetString("sessionId"))
+	c.JSON(http.StatusOK, gin.H{"success": true, "sessions": list})
+}
+
+func AdminRevokeSession(c *gin.Context) {
+	session, err := revokeSession(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	audit(c, "session.revoke", session.Username, gin.H{"id": session.ID})
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/middleware"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setupSessionTest creates the accounts sam and tom and routes the session
+// endpoints as sam on the session named by the X-Session header.
+func setupSessionTest(t *testing.T) *gin.Engine {
+	setupDataDir(t, models.SystemConfig{AuthMode: "multi"})
+	for _, name := range []string{"sam", "tom"} {
+		utils.WriteJSON(filepath.Join(config.UsersDir, name+".json"), models.User{Username: name, Role: models.RoleMember})
+	}
+
+	asSam := func(c *gin.Context) {
+		c.Set("username", "sam")
+		c.Set("sessionId", c.GetHeader("X-Session"))
+	}
+	r := gin.New()
+	r.POST("/api/token/refresh", RefreshToken)
+	r.GET("/api/sessions", asSam, GetSessions)
+	r.DELETE("/api/sessions", asSam, RevokeOtherSessions)
+	r.DELETE("/api/sessions/:id", asSam, RevokeSession)
+	return r
+}
+
+func refreshWith(r *gin.Engine, refreshToken string) (int, map[string]interface{}) {
+	req := httptest.NewRequest(http.MethodPost, "/api/token/refresh", strings.NewReader(`{"refreshToken":"`+refreshToken+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	var body map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return w.Code, body
+}
+
+func sessionRequest(r *gin.Engine, method, path, current string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("X-Session", current)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func storedSessions() map[string]models.Session {
+	var sessions []models.Session
+	utils.ReadJSON(getSessionsFile(), &sessions)
+	byID := map[string]models.Session{}
+	for _, s := range sessions {
+		byID[s.ID] = s
+	}
+	return byID
+}
+
+func TestRefreshRotatesTheRefreshToken(t *testing.T) {
+	r := setupSessionTest(t)
+	session, first, err := createSession("sam", "192.0.2.1", "test")
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+
+	code, body := refreshWith(r, first)
+	second, _ := body["refreshToken"].(string)
+	if code != http.StatusOK || body["token"] == "" || second == "" || second == first {
+		t.Fatalf("expected a rotated refresh token, got %d %v", code, body)
+	}
+	stored := storedSessions()[session.ID]
+	if stored.TokenHash != hashRefreshToken(second) || stored.PreviousHash != hashRefreshToken(first) {
+		t.Fatalf("expected the session to hold the new token, got %+v", stored)
+	}
+	if code, _ := refreshWith(r, second); code != http.StatusOK {
+		t.Fatalf("expected the new token to refresh, got %d", code)
+	}
+	if code, _ := refreshWith(r, "unknown"); code != http.StatusUnauthorized {
+		t.Fatalf("expected an unknown token to be refused, got %d", code)
+	}
+}
+
+func TestRefreshTokenReuseRevokesTheSession(t *testing.T) {
+	r := setupSessionTest(t)
+	session, first, _ := createSession("sam", "192.0.2.1", "test")
+	other, otherToken, _ := createSession("sam", "192.0.2.2", "test")
+
+	_, body := refreshWith(r, first)
+	second, _ := body["refreshToken"].(string)
+	access, _ := body["token"].(string)
+
+	// The rotated out token shows up again: somebody copied it
+	if code, _ := refreshWith(r, first); code != http.StatusUnauthorized {
+		t.Fatalf("expected reuse to be refused, got %d", code)
+	}
+	if _, ok := storedSessions()[session.ID]; ok {
+		t.Fatalf("expected the reused session to be removed")
+	}
+	if code, _ := refreshWith(r, second); code != http.StatusUnauthorized {
+		t.Fatalf("expected the current token of the session to stop working, got %d", code)
+	}
+	if _, err := middleware.ParseSessionToken(access); err == nil {
+		t.Fatalf("expected access tokens of the session to be revoked")
+	}
+
+	if _, ok := storedSessions()[other.ID]; !ok {
+		t.Fatalf("expected other sessions to be kept")
+	}
+	if code, _ := refreshWith(r, otherToken); code != http.StatusOK {
+		t.Fatalf("expected other sessions to keep refreshing, got %d", code)
+	}
+}
+
+func TestRevokeSessionRejectsSessionsOfOtherUsers(t *testing.T) {
+	r := setupSessionTest(t)
+	own, _, _ := createSession("sam", "192.0.2.1", "test")
+	foreign, _, _ := createSession("tom", "192.0.2.2", "test")
+
+	if w := sessionRequest(r, http.MethodDelete, "/api/sessions/"+foreign.ID, own.ID); w.Code != http.StatusNotFound {
+		t.Fatalf("expected the session of another user to be refused, got %d", w.Code)
+	}
+	if _, ok := storedSessions()[foreign.ID]; !ok {
+		t.Fatalf("expected the session of another user to be kept")
+	}
+	if w := sessionRequest(r, http.MethodDelete, "/api/sessions/"+own.ID, own.ID); w.Code != http.StatusOK {
+		t.Fatalf("expected own session to be revoked, got %d", w.Code)
+	}
+	if _, ok := storedSessions()[own.ID]; ok {
+		t.Fatalf("expected own session to be removed")
+	}
+}
+
+func TestRevokeOtherSessionsKeepsTheCurrentSession(t *testing.T) {
+	r := setupSessionTest(t)
+	current, _, _ := createSession("sam", "192.0.2.1", "laptop")
+	createSession("sam", "192.0.2.2", "phone")
+	createSession("sam", "192.0.2.3", "tablet")
+	foreign, _, _ := createSession("tom", "192.0.2.4", "test")
+
+	if w := sessionRequest(r, http.MethodGet, "/api/sessions", current.ID); !strings.Contains(w.Body.String(), "tablet") || strings.Contains(w.Body.String(), foreign.ID) {
+		t.Fatalf("expected only the sessions of sam, got %s", w.Body.String())
+	}
+
+	if w := sessionRequest(r, http.MethodDelete, "/api/sessions", current.ID); w.Code != http.StatusOK {
+		t.Fatalf("expected other sessions to be revoked, got %d", w.Code)
+	}
+	stored := storedSessions()
+	if len(stored) != 2 {
+		t.Fatalf("expected the current and the foreign session to be left, got %v", stored)
+	}
+	if _, ok := stored[current.ID]; !ok {
+		t.Fatalf("expected the current session to be kept")
+	}
+	if _, ok := stored[foreign.ID]; !ok {
+		t.Fatalf("expected sessions of other users to be kept")
+	}
+
+	w := sessionRequest(r, http.MethodGet, "/api/sessions", current.ID)
+	var resp struct {
+		Sessions []SessionInfo `json:"sessions"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Sessions) != 1 || resp.Sessions[0].ID != current.ID || !resp.Sessions[0].Current {
+		t.Fatalf("expected only the current session to be listed, got %+v", resp.Sessions)
+	}
+}
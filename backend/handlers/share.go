@@ -0,0 +1,417 @@
+package handlers
+
+import (
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	maxSharesPerUser    = 50
+	maxShareNameLen     = 64
+	defaultShareDays    = 7
+	maxShareDays        = 365
+	sharePasswordHeader = "X-Share-Password"
+)
+
+var errTooManyShares = errors.New("too many shares")
+
+type CreateShareRequest struct {
+	Name          string   `json:"name"`
+	Groups        []string `json:"groups"`
+	Widgets       []string `json:"widgets"`
+	ExpiresInDays int      `json:"expiresInDays"` // Defaults to 7
+	Password      string   `json:"password"`      // Optional, asked for before anything is shown
+}
+
+// ShareClaims is the token of a share link. The ID is the one of the
+// ShareLink record, which has to still exist for the link to work.
+type ShareClaims struct {
+	Groups  []string `json:"groups"`
+	Widgets []string `json:"widgets"`
+	jwt.RegisteredClaims
+}
+
+// ShareSummary is a share link as listed to its owner or an admin.
+type ShareSummary struct {
+	ID          string   `json:"id"`
+	Username    string   `json:"username"`
+	Name        string   `json:"name,omitempty"`
+	Groups      []string `json:"groups"`
+	Widgets     []string `json:"widgets"`
+	HasPassword bool     `json:"hasPassword"`
+	CreatedAt   int64    `json:"createdAt"`
+	ExpiresAt   int64    `json:"expiresAt"`
+	Token       string   `json:"token,omitempty"`
+}
+
+func getSharesFile() string {
+	return filepath.Join(config.DataDir, "shares.json")
+}
+
+// updateShares applies fn to the share links under the file lock. Expired
+// links are dropped on the way.
+func updateShares(fn func(shares []models.ShareLink) ([]models.ShareLink, error)) error {
+	path := getSharesFile()
+	return utils.WithFileLock(path, func() error {
+		var shares []models.ShareLink
+		if err := utils.ReadJSONUnlocked(path, &shares); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		now := time.Now().Unix()
+		live := shares[:0]
+		for _, s := range shares {
+			if s.ExpiresAt > now {
+				live = append(live, s)
+			}
+		}
+		updated, err := fn(live)
+		if err != nil {
+			return err
+		}
+		if updated == nil {
+			updated = []models.ShareLink{}
+		}
+		return utils.WriteJSONUnlocked(path, updated)
+	})
+}
+
+func findShare(id string) (*models.ShareLink, bool) {
+	var shares []models.ShareLink
+	utils.ReadJSON(getSharesFile(), &shares)
+	for i := range shares {
+		if shares[i].ID == id && shares[i].ExpiresAt > time.Now().Unix() {
+			return &shares[i], true
+		}
+	}
+	return nil, false
+}
+
+func signShareToken(s *models.ShareLink) (string, error) {
+	return utils.SignToken(config.KeyPurposeShare, ShareClaims{
+		Groups:  s.Groups,
+		Widgets: s.Widgets,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        s.ID,
+			Subject:   "share",
+			IssuedAt:  jwt.NewNumericDate(time.Unix(s.CreatedAt, 0)),
+			ExpiresAt: jwt.NewNumericDate(time.Unix(s.ExpiresAt, 0)),
+		},
+	})
+}
+
+// summarizeShares lists shares with a link token, optionally of owner only.
+func summarizeShares(owner string) []ShareSummary {
+	var shares []models.ShareLink
+	utils.ReadJSON(getSharesFile(), &shares)
+	now := time.Now().Unix()
+	list := []ShareSummary{}
+	for i := range shares {
+		s := &shares[i]
+		if s.ExpiresAt <= now || (owner != "" && s.Username != owner) {
+			continue
+		}
+		token, _ := signShareToken(s)
+		list = append(list, ShareSummary{
+			ID:          s.ID,
+			Username:    s.Username,
+			Name:        s.Name,
+			Groups:      s.Groups,
+			Widgets:     s.Widgets,
+			HasPassword: s.PasswordHash != "",
+			CreatedAt:   s.CreatedAt,
+			ExpiresAt:   s.ExpiresAt,
+			Token:       token,
+		})
+	}
+	return list
+}
+
+// dashboardIDs collects the IDs of the entries of key ("groups" or
+// "widgets") in a dashboard document.
+func dashboardIDs(doc map[string]interface{}, key string) map[string]bool {
+	ids := map[string]bool{}
+	entries, _ := doc[key].([]interface{})
+	for _, e := range entries {
+		if m, ok := e.(map[string]interface{}); ok {
+			if id, ok := m["id"].(string); ok && id != "" {
+				ids[id] = true
+			}
+		}
+	}
+	return ids
+}
+
+// selectByID keeps the entries of list whose ID is in ids, in dashboard order.
+func selectByID(list interface{}, ids []string) []interface{} {
+	wanted := map[string]bool{}
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	selected := []interface{}{}
+	entries, _ := list.([]interface{})
+	for _, e := range entries {
+		if m, ok := e.(map[string]interface{}); ok {
+			if id, ok := m["id"].(string); ok && wanted[id] {
+				selected = append(selected, m)
+			}
+		}
+	}
+	return selected
+}
+
+// cleanShareIDs trims and deduplicates ids and checks they all exist.
+func cleanShareIDs(ids []string, existing map[string]bool) ([]string, bool) {
+	cleaned := []string{}
+	seen := map[string]bool{}
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		if seen[id] {
+			continue
+		}
+		if !existing[id] {
+			return nil, false
+		}
+		seen[id] = true
+		cleaned = append(cleaned, id)
+	}
+	return cleaned, true
+}
+
+func CreateShare(c *gin.Context) {
+	var req CreateShareRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if len(req.Name) > maxShareNameLen {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid share name"})
+		return
+	}
+	if req.ExpiresInDays == 0 {
+		req.ExpiresInDays = defaultShareDays
+	}
+	if req.ExpiresInDays < 0 || req.ExpiresInDays > maxShareDays {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expiry"})
+		return
+	}
+	if len(req.Password) > maxPasswordBytes {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password too long"})
+		return
+	}
+
+	username := c.GetString("username")
+	var doc map[string]interface{}
+	if err := utils.ReadJSON(userFilePath(username), &doc); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User data not found"})
+		return
+	}
+	groups, okGroups := cleanShareIDs(req.Groups, dashboardIDs(doc, "groups"))
+	widgets, okWidgets := cleanShareIDs(req.Widgets, dashboardIDs(doc, "widgets"))
+	if !okGroups || !okWidgets {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown group or widget"})
+		return
+	}
+	if len(groups) == 0 && len(widgets) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Nothing to share"})
+		return
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create share"})
+		return
+	}
+	now := time.Now()
+	share := models.ShareLink{
+		ID:        id,
+		Username:  username,
+		Name:      req.Name,
+		Groups:    groups,
+		Widgets:   widgets,
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.AddDate(0, 0, req.ExpiresInDays).Unix(),
+	}
+	if req.Password != "" {
+		hashed, err := utils.HashPassword(req.Password)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+			return
+		}
+		share.PasswordHash = hashed
+	}
+
+	err = updateShares(func(shares []models.ShareLink) ([]models.ShareLink, error) {
+		count := 0
+		for _, s := range shares {
+			if s.Username == username {
+				count++
+			}
+		}
+		if count >= maxSharesPerUser {
+			return nil, errTooManyShares
+		}
+		return append(shares, share), nil
+	})
+	if err != nil {
+		if errors.Is(err, errTooManyShares) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Too many shares"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save share"})
+		return
+	}
+	token, err := signShareToken(&share)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign token"})
+		return
+	}
+
+	audit(c, "share.create", username, gin.H{"id": id, "groups": groups, "widgets": widgets, "expiresAt": share.ExpiresAt})
+	c.JSON(http.StatusOK, gin.H{"success": true, "share": ShareSummary{
+		ID:          share.ID,
+		Username:    share.Username,
+		Name:        share.Name,
+		Groups:      share.Groups,
+		Widgets:     share.Widgets,
+		HasPassword: share.PasswordHash != "",
+		CreatedAt:   share.CreatedAt,
+		ExpiresAt:   share.ExpiresAt,
+		Token:       token,
+	}})
+}
+
+func GetShares(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"success": true, "shares": summarizeShares(c.GetString("username"))})
+}
+
+// deleteShare removes the share with id, restricted to owner unless owner is
+// empty.
+func deleteShare(id, owner string) bool {
+	found := false
+	updateShares(func(shares []models.ShareLink) ([]models.ShareLink, error) {
+		kept := shares[:0]
+		for _, s := range shares {
+			if s.ID == id && (owner == "" || s.Username == owner) {
+				found = true
+				continue
+			}
+			kept = append(kept, s)
+		}
+		return kept, nil
+	})
+	return found
+}
+
+func DeleteShare(c *gin.Context) {
+	if !deleteShare(c.Param("id"), c.GetString("username")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share not found"})
+		return
+	}
+	audit(c, "share.delete", c.GetString("username"), gin.H{"id": c.Param("id")})
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// GetAllShares lists the shares of every user, or of ?username= only.
+func GetAllShares(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"success": true, "shares": summarizeShares(c.Query("username"))})
+}
+
+func AdminDeleteShare(c *gin.Context) {
+	if !deleteShare(c.Param("id"), "") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share not found"})
+		return
+	}
+	audit(c, "share.delete", "", gin.H{"id": c.Param("id")})
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// GetShareData returns the groups and widgets a share link points to, with
+// the appearance settings of the owner. Password protected links need the
+// password in the X-Share-Password header; wrong guesses count towards the
+// login lockout of the client.
+func GetShareData(c *gin.Context) {
+	claims := &ShareClaims{}
+	tok, err := utils.ParseToken(config.KeyPurposeShare, c.Param("token"), claims, jwt.WithSubject("share"))
+	if err != nil || tok == nil || !tok.Valid || claims.ID == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "分享链接无效或已过期"})
+		return
+	}
+	share, ok := findShare(claims.ID)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "分享链接无效或已过期"})
+		return
+	}
+
+	if share.PasswordHash != "" {
+		clientIP := c.ClientIP()
+		lockKey := "share:" + share.ID
+		if wait, locked := loginLockedOut(clientIP, lockKey); locked {
+			respondLoginLocked(c, wait)
+			return
+		}
+		password := c.GetHeader(sharePasswordHeader)
+		if password == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "需要密码", "passwordRequired": true})
+			return
+		}
+		if !utils.CheckPasswordHash(password, share.PasswordHash) {
+			recordLoginFailure(clientIP, lockKey)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "密码错误", "passwordRequired": true})
+			return
+		}
+		recordLoginSuccess(clientIP, lockKey)
+	}
+
+	var doc map[string]interface{}
+	if err := utils.ReadJSON(userFilePath(share.Username), &doc); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "分享链接无效或已过期"})
+		return
+	}
+	if disabled, _ := doc["disabled"].(bool); disabled {
+		c.JSON(http.StatusNotFound, gin.H{"error": "分享链接无效或已过期"})
+		return
+	}
+
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	redactSystemConfig(&sysConfig, false)
+	c.JSON(http.StatusOK, gin.H{
+		"username":     share.Username,
+		"groups":       selectByID(doc["groups"], claims.Groups),
+		"widgets":      selectByID(doc["widgets"], claims.Widgets),
+		"appConfig":    doc["appConfig"],
+		"systemConfig": sysConfig,
+		"share":        gin.H{"name": share.Name, "expiresAt": share.ExpiresAt},
+	})
+}
+
+// moveShareLinks hands the links of from over to to, or deletes them when to
+// is empty. It is not a userStore: the IDs a link points to only mean
+// something in the dashboard of the owner, so links follow a rename but are
+// dropped when the data of a deleted user goes to someone else.
+func moveShareLinks(from, to string) error {
+	return updateShares(func(shares []models.ShareLink) ([]models.ShareLink, error) {
+		kept := shares[:0]
+		for _, s := range shares {
+			if s.Username == from {
+				if to == "" {
+					continue
+				}
+				s.Username = to
+			}
+			kept = append(kept, s)
+		}
+		return kept, nil
+	})
+}
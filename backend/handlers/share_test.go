@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestShareLinkShowsSelectionOnly(t *testing.T) {
+	setupDataDir(t, models.SystemConfig{AuthMode: "multi"})
+	utils.WriteJSON(userFilePath("alice"), map[string]interface{}{
+		"username": "alice",
+		"password": "hash",
+		"groups": []interface{}{
+			map[string]interface{}{"id": "g1", "items": []interface{}{map[string]interface{}{"id": "i1"}}},
+			map[string]interface{}{"id": "g2", "items": []interface{}{map[string]interface{}{"id": "i2"}}},
+		},
+		"widgets": []interface{}{
+			map[string]interface{}{"id": "w1"},
+			map[string]interface{}{"id": "w2"},
+		},
+	})
+
+	r := gin.New()
+	asAlice := func(c *gin.Context) { c.Set("username", "alice") }
+	r.POST("/api/shares", asAlice, CreateShare)
+	r.DELETE("/api/shares/:id", asAlice, DeleteShare)
+	r.GET("/api/share/:token/data", GetShareData)
+	view := func(token, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/share/"+token+"/data", nil)
+		if password != "" {
+			req.Header.Set(sharePasswordHeader, password)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := postJSON(r, "/api/shares", `{"groups":["nope"]}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected unknown group to be refused, got %d", w.Code)
+	}
+	w := postJSON(r, "/api/shares", `{"groups":["g2"],"widgets":["w1"],"password":"letmein"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("create share failed: %d %s", w.Code, w.Body.String())
+	}
+	var created struct {
+		Share ShareSummary `json:"share"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	token := created.Share.Token
+
+	if w := view(token, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected password to be required, got %d", w.Code)
+	}
+	if w := view(token, "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected wrong password to fail, got %d", w.Code)
+	}
+	w = view(token, "letmein")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected shared data, got %d %s", w.Code, w.Body.String())
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `"g2"`) || !strings.Contains(body, `"w1"`) || strings.Contains(body, `"g1"`) || strings.Contains(body, `"w2"`) || strings.Contains(body, "hash") {
+		t.Fatalf("share leaked more than the selection: %s", body)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/shares/"+created.Share.ID, nil)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	if w := view(token, "letmein"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected revoked share to be gone, got %d", w.Code)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"flatnasgo-backend/config"
+	"flatnasgo-backend/middleware"
 	"flatnasgo-backend/models"
 	"flatnasgo-backend/utils"
 	"io"
@@ -436,8 +437,7 @@ func DownloadToken(c *gin.Context) {
 			Subject:   "download",
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	signed, err := token.SignedString([]byte(config.GetSecretKeyString()))
+	signed, err := utils.SignToken(config.KeyPurposeDownload, claims)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue token"})
 		return
@@ -466,7 +466,7 @@ func DeleteItem(c *gin.Context) {
 	for _, item := range data.Items {
 		if item.ID == id {
 			// IDOR Check
-			if item.Sender != username && username != "admin" {
+			if item.Sender != username && !middleware.HasPermission(c, models.PermFilesManage) {
 				c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
 				return
 			}
@@ -502,9 +502,7 @@ func ServeFile(c *gin.Context) {
 	tokenStr := c.Query("token")
 	if tokenStr != "" {
 		claims := &DownloadClaims{}
-		tok, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
-			return []byte(config.GetSecretKeyString()), nil
-		}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+		tok, err := utils.ParseToken(config.KeyPurposeDownload, tokenStr, claims, jwt.WithSubject("download"))
 		if err != nil || tok == nil || !tok.Valid || claims.Filename != filename {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 			return
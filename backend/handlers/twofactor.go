@@ -0,0 +1,382 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	twoFactorIssuer       = "FlatNas"
+	twoFactorChallengeTTL = 5 * time.Minute
+	recoveryCodeCount     = 10
+)
+
+var errTwoFactorCode = errors.New("invalid two-factor code")
+var errTwoFactorState = errors.New("invalid two-factor state")
+
+// TwoFactorChallengeClaims is handed out by Login when the password matched
+// but a second factor is still required. It is not a session token.
+type TwoFactorChallengeClaims struct {
+	Username string `json:"username"`
+	jwt.RegisteredClaims
+}
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type TwoFactorDisableRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+type TwoFactorLoginRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+// requiresSecondFactor reports whether a password alone is not enough for
+// user: TOTP is enabled or a passkey is registered.
+func requiresSecondFactor(user *models.User) bool {
+	return (user.TwoFactor != nil && user.TwoFactor.Enabled) || hasPasskeys(user)
+}
+
+// signLoginChallenge signs a short lived token naming a user who passed the
+// password check but must complete another step, told apart by subject.
+func signLoginChallenge(username, subject string) (string, error) {
+	claims := TwoFactorChallengeClaims{
+		Username: username,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(twoFactorChallengeTTL)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Subject:   subject,
+		},
+	}
+	return utils.SignToken(config.KeyPurposeChallenge, claims)
+}
+
+func parseLoginChallenge(tokenStr, subject string) (string, bool) {
+	claims := &TwoFactorChallengeClaims{}
+	tok, err := utils.ParseToken(config.KeyPurposeChallenge, tokenStr, claims, jwt.WithSubject(subject))
+	if err != nil || tok == nil || !tok.Valid || claims.Username == "" {
+		return "", false
+	}
+	return claims.Username, true
+}
+
+func issueTwoFactorChallenge(c *gin.Context, username string, user *models.User) {
+	signed, err := signLoginChallenge(username, "2fa")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign token"})
+		return
+	}
+	methods := []string{}
+	if user.TwoFactor != nil && user.TwoFactor.Enabled {
+		methods = append(methods, "totp")
+	}
+	if hasPasskeys(user) {
+		methods = append(methods, "passkey")
+	}
+	// 401 keeps clients that do not know about 2FA from treating this as a login
+	c.JSON(http.StatusUnauthorized, gin.H{
+		"error":             "需要二次验证",
+		"twoFactorRequired": true,
+		"challenge":         signed,
+		"username":          username,
+		"methods":           methods,
+	})
+}
+
+func parseTwoFactorChallenge(tokenStr string) (string, bool) {
+	return parseLoginChallenge(tokenStr, "2fa")
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateRecoveryCodes returns the plain codes shown once to the user and
+// the hashes stored in the user record.
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		bytes := make([]byte, 5)
+		if _, err := rand.Read(bytes); err != nil {
+			return nil, nil, err
+		}
+		raw := hex.EncodeToString(bytes)
+		code := raw[:5] + "-" + raw[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused recovery
+// code and updates the replay/recovery state in tf accordingly.
+func verifySecondFactor(tf *models.TwoFactor, code string) bool {
+	if tf == nil || !tf.Enabled || tf.Secret == "" {
+		return false
+	}
+	if step, ok := utils.ValidateTOTP(tf.Secret, code, time.Now()); ok {
+		if step <= tf.LastUsedStep {
+			return false
+		}
+		tf.LastUsedStep = step
+		return true
+	}
+	hashed := hashRecoveryCode(code)
+	for i, stored := range tf.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hashed)) == 1 {
+			tf.RecoveryCodes = append(tf.RecoveryCodes[:i], tf.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// LoginTwoFactor completes a login started by Login with the challenge it
+// returned and a TOTP or recovery code.
+func LoginTwoFactor(c *gin.Context) {
+	var req TwoFactorLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	username, ok := parseTwoFactorChallenge(req.Challenge)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "验证已过期，请重新登录"})
+		return
+	}
+
+	clientIP := c.ClientIP()
+	if wait, locked := loginLockedOut(clientIP, username); locked {
+		respondLoginLocked(c, wait)
+		return
+	}
+
+	user, err := updateUserAccount(username, func(user *models.User) error {
+		if !verifySecondFactor(user.TwoFactor, req.Code) {
+			return errTwoFactorCode
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, errTwoFactorCode) {
+			recordLoginFailure(clientIP, username)
+			auditLogin(c, username, "login.failed", gin.H{"method": "2fa"})
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "验证码错误"})
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "用户不存在或密码错误"})
+		return
+	}
+
+	finishPasswordLogin(c, clientIP, username, user)
+}
+
+func GetTwoFactorStatus(c *gin.Context) {
+	user, err := loadUser(c.GetString("username"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	enabled := user.TwoFactor != nil && user.TwoFactor.Enabled
+	remaining := 0
+	if enabled {
+		remaining = len(user.TwoFactor.RecoveryCodes)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success":                true,
+		"enabled":                enabled,
+		"recoveryCodesRemaining": remaining,
+	})
+}
+
+// SetupTwoFactor starts enrollment by generating a pending secret. 2FA stays
+// disabled until EnableTwoFactor verifies a code generated from it.
+func SetupTwoFactor(c *gin.Context) {
+	username := c.GetString("username")
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate secret"})
+		return
+	}
+
+	_, err = updateUserAccount(username, func(user *models.User) error {
+		if user.TwoFactor != nil && user.TwoFactor.Enabled {
+			return errTwoFactorState
+		}
+		user.TwoFactor = &models.TwoFactor{PendingSecret: secret}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, errTwoFactorState) {
+			c.JSON(http.StatusConflict, gin.H{"error": "二次验证已启用"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"secret":  secret,
+		"uri":     utils.TOTPURI(twoFactorIssuer, username, secret),
+	})
+}
+
+func EnableTwoFactor(c *gin.Context) {
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+		return
+	}
+
+	_, err = updateUserAccount(c.GetString("username"), func(user *models.User) error {
+		tf := user.TwoFactor
+		if tf == nil || tf.Enabled || tf.PendingSecret == "" {
+			return errTwoFactorState
+		}
+		step, ok := utils.ValidateTOTP(tf.PendingSecret, req.Code, time.Now())
+		if !ok {
+			return errTwoFactorCode
+		}
+		user.TwoFactor = &models.TwoFactor{
+			Enabled:       true,
+			Secret:        tf.PendingSecret,
+			RecoveryCodes: hashes,
+			LastUsedStep:  step,
+			EnabledAt:     time.Now().Unix(),
+		}
+		return nil
+	})
+	if err != nil {
+		respondTwoFactorError(c, err)
+		return
+	}
+
+	audit(c, "2fa.enable", c.GetString("username"), nil)
+	c.JSON(http.StatusOK, gin.H{"success": true, "recoveryCodes": codes})
+}
+
+func DisableTwoFactor(c *gin.Context) {
+	var req TwoFactorDisableRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	_, err := updateUserAccount(c.GetString("username"), func(user *models.User) error {
+		if user.TwoFactor == nil || !user.TwoFactor.Enabled {
+			return errTwoFactorState
+		}
+		if !passwordMatches(user.Password, req.Password) || !verifySecondFactor(user.TwoFactor, req.Code) {
+			return errTwoFactorCode
+		}
+		user.TwoFactor = nil
+		return nil
+	})
+	if err != nil {
+		respondTwoFactorError(c, err)
+		return
+	}
+
+	audit(c, "2fa.disable", c.GetString("username"), nil)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func RegenerateRecoveryCodes(c *gin.Context) {
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+		return
+	}
+
+	_, err = updateUserAccount(c.GetString("username"), func(user *models.User) error {
+		if user.TwoFactor == nil || !user.TwoFactor.Enabled {
+			return errTwoFactorState
+		}
+		if !verifySecondFactor(user.TwoFactor, req.Code) {
+			return errTwoFactorCode
+		}
+		user.TwoFactor.RecoveryCodes = hashes
+		return nil
+	})
+	if err != nil {
+		respondTwoFactorError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "recoveryCodes": codes})
+}
+
+// ResetUserTwoFactor lets an admin remove 2FA from an account that lost its
+// authenticator and recovery codes. Passkeys are removed too, as they are a
+// second factor as well.
+func ResetUserTwoFactor(c *gin.Context) {
+	username := c.Param("usr")
+	if username == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid username"})
+		return
+	}
+
+	_, err := updateUserAccount(username, func(user *models.User) error {
+		user.TwoFactor = nil
+		user.WebAuthn = nil
+		return nil
+	})
+	if err != nil {
+		if os.IsNotExist(err) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+		return
+	}
+
+	audit(c, "user.2fa.reset", username, nil)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func respondTwoFactorError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errTwoFactorCode):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "验证码错误"})
+	case errors.Is(err, errTwoFactorState):
+		c.JSON(http.StatusConflict, gin.H{"error": "二次验证状态无效"})
+	case os.IsNotExist(err):
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save user"})
+	}
+}
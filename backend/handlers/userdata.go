@@ -0,0 +1,278 @@
+package handlers
+
+import (
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/middleware"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/storage"
+	"flatnasgo-backend/utils"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errUsernameTaken = errors.New("username taken")
+
+// fetchedWallpaperPattern matches wallpapers saved by FetchWallpaper, which
+// are named after the user that fetched them: prefix_username_millis.ext
+var fetchedWallpaperPattern = regexp.MustCompile(`^(api_m?bg)_(.+)_(\d+)(\.[A-Za-z0-9]+)$`)
+
+type RenameUserRequest struct {
+	Username string `json:"username"`
+}
+
+// userStore is data a user owns outside their record. move hands the data of
+// from over to to, or deletes it when to is empty.
+type userStore struct {
+	name string
+	move func(from, to string) error
+}
+
+var userStores = []userStore{
+	{"custom scripts", moveCustomScripts},
+	{"transfer items", moveTransferItems},
+	{"config versions", moveConfigVersions},
+	{"wallpapers", moveWallpapers},
+}
+
+// moveUserData runs every user store. A failing store is logged and the
+// others still run, the account change itself has already happened.
+func moveUserData(from, to string) {
+	for _, store := range userStores {
+		if err := store.move(from, to); err != nil {
+			log.Printf("Failed to move %s of %s to %q: %v", store.name, from, to, err)
+		}
+	}
+}
+
+// isManagedUsername reports whether an admin may disable, rename or delete
+// username. Names registered before usernames were validated are accepted as
+// long as they can not escape the users directory.
+func isManagedUsername(username string) bool {
+	if username == "" || username == "admin" || strings.HasPrefix(username, ".") {
+		return false
+	}
+	return !strings.ContainsAny(username, `/\`)
+}
+
+func moveCustomScripts(from, to string) error {
+	path := filepath.Join(config.DataDir, "custom_scripts.json")
+	return utils.WithFileLock(path, func() error {
+		var data map[string]CustomScriptsPayload
+		if err := utils.ReadJSONUnlocked(path, &data); err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		entry, ok := data[from]
+		if !ok {
+			return nil
+		}
+		delete(data, from)
+		if to != "" {
+			// Scripts of the heir come first so theirs keep applying last
+			merged := data[to]
+			merged.CSS = append(merged.CSS, entry.CSS...)
+			merged.JS = append(merged.JS, entry.JS...)
+			data[to] = merged
+		}
+		return utils.WriteJSONUnlocked(path, data)
+	})
+}
+
+func moveTransferItems(from, to string) error {
+	indexFile := getTransferIndexFile()
+	var orphaned []string
+	err := utils.WithFileLock(indexFile, func() error {
+		var data models.TransferData
+		if err := utils.ReadJSONUnlocked(indexFile, &data); err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		kept := data.Items[:0]
+		for _, item := range data.Items {
+			if item.Sender == from {
+				if to == "" {
+					if item.Type == "file" && item.File != nil {
+						orphaned = append(orphaned, filepath.Base(item.File.Url))
+					}
+					continue
+				}
+				item.Sender = to
+			}
+			kept = append(kept, item)
+		}
+		data.Items = kept
+		return utils.WriteJSONUnlocked(indexFile, data)
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range orphaned {
+		os.Remove(filepath.Join(getUploadsDir(), name))
+	}
+	// Unfinished uploads can only be resumed by the user that started them
+	return os.RemoveAll(filepath.Dir(getUserUploadsDir(from)))
+}
+
+func moveConfigVersions(from, to string) error {
+	names, err := storage.ReadDir(config.ConfigVersionsDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var firstErr error
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		path := filepath.Join(config.ConfigVersionsDir, name)
+		var vf VersionFile
+		if err := utils.ReadJSON(path, &vf); err != nil || versionOwner(&vf) != from {
+			continue
+		}
+		if to == "" {
+			err = storage.Remove(path)
+		} else {
+			vf.Owner = to
+			if vf.Data != nil {
+				vf.Data["username"] = to
+				rewriteWallpaperRefs(vf.Data, from, to)
+			}
+			err = utils.WriteJSON(path, vf)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func moveWallpapers(from, to string) error {
+	var firstErr error
+	for _, dir := range []string{config.BackgroundsDir, config.MobileBackgroundsDir} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			m := fetchedWallpaperPattern.FindStringSubmatch(e.Name())
+			if e.IsDir() || m == nil || m[2] != from {
+				continue
+			}
+			path := filepath.Join(dir, e.Name())
+			if to == "" {
+				err = os.Remove(path)
+			} else {
+				target := filepath.Join(dir, m[1]+"_"+to+"_"+m[3]+m[4])
+				if _, statErr := os.Stat(target); statErr == nil {
+					continue
+				}
+				err = os.Rename(path, target)
+			}
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// rewriteWallpaperRefs points references to wallpapers fetched by from at
+// the names moveWallpapers gives them.
+func rewriteWallpaperRefs(doc map[string]interface{}, from, to string) {
+	pattern := regexp.MustCompile(`(api_m?bg_)` + regexp.QuoteMeta(from) + `(_\d+\.)`)
+	var walk func(v interface{}) interface{}
+	walk = func(v interface{}) interface{} {
+		switch t := v.(type) {
+		case string:
+			return pattern.ReplaceAllString(t, "${1}"+to+"${2}")
+		case map[string]interface{}:
+			for k, e := range t {
+				t[k] = walk(e)
+			}
+		case []interface{}:
+			for i, e := range t {
+				t[i] = walk(e)
+			}
+		}
+		return v
+	}
+	walk(doc)
+}
+
+// renameUserFile moves the record of from to the name to. An account
+// registered under the new name meanwhile is never replaced.
+func renameUserFile(from, to string) error {
+	oldFile := filepath.Join(config.UsersDir, from+".json")
+	newFile := filepath.Join(config.UsersDir, to+".json")
+	return utils.WithFileLock(oldFile, func() error {
+		var raw map[string]interface{}
+		if err := utils.ReadJSONUnlocked(oldFile, &raw); err != nil {
+			return err
+		}
+		raw["username"] = to
+		rewriteWallpaperRefs(raw, from, to)
+
+		if err := createUserFile(newFile, raw); err != nil {
+			return err
+		}
+		return storage.Remove(oldFile)
+	})
+}
+
+// RenameUser changes the username of an account and moves everything the
+// user owns to the new name. The user has to sign in again.
+func RenameUser(c *gin.Context) {
+	username := c.Param("usr")
+	if !isManagedUsername(username) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid username"})
+		return
+	}
+	var req RenameUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	newName := strings.TrimSpace(req.Username)
+	if newName == "admin" || !utils.IsValidUsername(newName) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid new username"})
+		return
+	}
+	if newName == username {
+		c.JSON(http.StatusOK, gin.H{"success": true, "username": newName})
+		return
+	}
+
+	if err := renameUserFile(username, newName); err != nil {
+		switch {
+		case errors.Is(err, errUsernameTaken):
+			c.JSON(http.StatusConflict, gin.H{"error": "用户名已存在"})
+		case os.IsNotExist(err):
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rename user"})
+		}
+		return
+	}
+	revokeUserSessions(username, "")
+	middleware.RenameUserAPITokens(username, newName)
+	moveUserData(username, newName)
+	if err := moveShareLinks(username, newName); err != nil {
+		log.Printf("Failed to move share links of %s to %q: %v", username, newName, err)
+	}
+	audit(c, "user.rename", username, gin.H{"username": newName})
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "username": newName})
+}
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func setupUserDataDirs(t *testing.T) {
+	setupDataDir(t, models.SystemConfig{AuthMode: "multi"})
+	config.DocDir = filepath.Join(config.DataDir, "doc")
+	config.ConfigVersionsDir = filepath.Join(config.DataDir, "versions")
+	config.BackgroundsDir = filepath.Join(config.DataDir, "backgrounds")
+	config.MobileBackgroundsDir = filepath.Join(config.DataDir, "mobile_backgrounds")
+	for _, dir := range []string{config.ConfigVersionsDir, config.BackgroundsDir, config.MobileBackgroundsDir, getUploadsDir(), getUserUploadsDir("alice")} {
+		os.MkdirAll(dir, 0755)
+	}
+
+	utils.WriteJSON(userFilePath("alice"), map[string]interface{}{
+		"username":  "alice",
+		"appConfig": map[string]interface{}{"background": "/backgrounds/api_bg_alice_100.jpg"},
+	})
+	utils.WriteJSON(userFilePath("bob"), map[string]interface{}{"username": "bob"})
+	utils.WriteJSON(filepath.Join(config.DataDir, "custom_scripts.json"), map[string]CustomScriptsPayload{
+		"alice": {CSS: []interface{}{"a"}, JS: []interface{}{}},
+	})
+	utils.WriteJSON(getTransferIndexFile(), models.TransferData{Items: []models.TransferItem{
+		{ID: "1", Type: "file", Sender: "alice", File: &models.TransferFile{Url: "/api/transfer/file/a.bin"}},
+		{ID: "2", Type: "text", Sender: "bob", Content: "hi"},
+	}})
+	os.WriteFile(filepath.Join(getUploadsDir(), "a.bin"), []byte("x"), 0644)
+	utils.WriteJSON(filepath.Join(config.ConfigVersionsDir, "1.json"), VersionFile{ID: "1", Data: map[string]interface{}{"username": "alice"}})
+	os.WriteFile(filepath.Join(config.BackgroundsDir, "api_bg_alice_100.jpg"), []byte("x"), 0644)
+	os.WriteFile(filepath.Join(config.BackgroundsDir, "api_bg_alice_b_200.jpg"), []byte("x"), 0644)
+}
+
+func adminRouter() *gin.Engine {
+	r := gin.New()
+	asAdmin := func(c *gin.Context) { c.Set("username", "admin") }
+	r.POST("/api/admin/users/:usr/rename", asAdmin, RenameUser)
+	r.DELETE("/api/admin/users/:usr", asAdmin, DeleteUser)
+	return r
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestRenameUserMovesOwnedData(t *testing.T) {
+	setupUserDataDirs(t)
+	r := adminRouter()
+
+	if w := postJSON(r, "/api/admin/users/alice/rename", `{"username":"bob"}`); w.Code != http.StatusConflict {
+		t.Fatalf("expected conflict, got %d", w.Code)
+	}
+	if w := postJSON(r, "/api/admin/users/alice/rename", `{"username":"carol"}`); w.Code != http.StatusOK {
+		t.Fatalf("rename: %d %s", w.Code, w.Body.String())
+	}
+
+	var doc map[string]interface{}
+	if err := utils.ReadJSON(userFilePath("carol"), &doc); err != nil || doc["username"] != "carol" {
+		t.Fatalf("expected carol record, got %v %v", doc, err)
+	}
+	if exists(userFilePath("alice")) {
+		t.Fatal("old record still exists")
+	}
+	if bg := doc["appConfig"].(map[string]interface{})["background"]; bg != "/backgrounds/api_bg_carol_100.jpg" {
+		t.Fatalf("wallpaper reference not rewritten: %v", bg)
+	}
+	if !exists(filepath.Join(config.BackgroundsDir, "api_bg_carol_100.jpg")) || !exists(filepath.Join(config.BackgroundsDir, "api_bg_alice_b_200.jpg")) {
+		t.Fatal("wallpapers not moved to the new name")
+	}
+
+	var scripts map[string]CustomScriptsPayload
+	utils.ReadJSON(filepath.Join(config.DataDir, "custom_scripts.json"), &scripts)
+	if _, ok := scripts["alice"]; ok || len(scripts["carol"].CSS) != 1 {
+		t.Fatalf("custom scripts not moved: %v", scripts)
+	}
+	var index models.TransferData
+	utils.ReadJSON(getTransferIndexFile(), &index)
+	if index.Items[0].Sender != "carol" {
+		t.Fatalf("transfer item not moved: %+v", index.Items[0])
+	}
+	var vf VersionFile
+	utils.ReadJSON(filepath.Join(config.ConfigVersionsDir, "1.json"), &vf)
+	if versionOwner(&vf) != "carol" {
+		t.Fatalf("version not moved: %+v", vf)
+	}
+}
+
+func TestDeleteUserCascades(t *testing.T) {
+	setupUserDataDirs(t)
+	r := adminRouter()
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/admin/users/alice", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", w.Code, w.Body.String())
+	}
+
+	if exists(filepath.Join(getUploadsDir(), "a.bin")) || exists(filepath.Dir(getUserUploadsDir("alice"))) {
+		t.Fatal("transfer files left behind")
+	}
+	if exists(filepath.Join(config.ConfigVersionsDir, "1.json")) || exists(filepath.Join(config.BackgroundsDir, "api_bg_alice_100.jpg")) {
+		t.Fatal("versions or wallpapers left behind")
+	}
+	if !exists(filepath.Join(config.BackgroundsDir, "api_bg_alice_b_200.jpg")) {
+		t.Fatal("wallpaper of another user removed")
+	}
+	var index models.TransferData
+	utils.ReadJSON(getTransferIndexFile(), &index)
+	if len(index.Items) != 1 || index.Items[0].Sender != "bob" {
+		t.Fatalf("unexpected transfer index: %+v", index.Items)
+	}
+}
+
+func TestDeleteUserTransfersOwnership(t *testing.T) {
+	setupUserDataDirs(t)
+	r := adminRouter()
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/admin/users/alice?transferTo=bob", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete: %d %s", w.Code, w.Body.String())
+	}
+
+	var index models.TransferData
+	utils.ReadJSON(getTransferIndexFile(), &index)
+	for _, item := range index.Items {
+		if item.Sender != "bob" {
+			t.Fatalf("item not handed over: %+v", item)
+		}
+	}
+	if !exists(filepath.Join(getUploadsDir(), "a.bin")) || !exists(filepath.Join(config.BackgroundsDir, "api_bg_bob_100.jpg")) {
+		t.Fatal("files of the handed over data removed")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"flatnasgo-backend/config"
 	"flatnasgo-backend/models"
+	"flatnasgo-backend/storage"
 	"flatnasgo-backend/utils"
 	"net/http"
 	"os"
@@ -27,11 +28,31 @@ type VersionFile struct {
 	ID        string                 `json:"id"`
 	Label     string                 `json:"label"`
 	CreatedAt int64                  `json:"createdAt"`
+	Owner     string                 `json:"owner,omitempty"`
 	Data      map[string]interface{} `json:"data"`
 }
 
+// versionOwner returns the user a version belongs to. Versions saved before
+// the owner was recorded are attributed by the username in their data, or
+// to the admin when that is missing too.
+func versionOwner(vf *VersionFile) string {
+	if vf.Owner != "" {
+		return vf.Owner
+	}
+	if owner, _ := vf.Data["username"].(string); owner != "" {
+		return owner
+	}
+	return "admin"
+}
+
+func isValidVersionID(id string) bool {
+	_, err := strconv.ParseInt(id, 10, 64)
+	return err == nil
+}
+
 func GetConfigVersions(c *gin.Context) {
-	files, err := os.ReadDir(config.ConfigVersionsDir)
+	username := c.GetString("username")
+	files, err := storage.ReadDir(config.ConfigVersionsDir)
 	if err != nil {
 		// If dir doesn't exist, return empty list
 		if os.IsNotExist(err) {
@@ -43,19 +64,19 @@ func GetConfigVersions(c *gin.Context) {
 	}
 
 	var versions []ConfigVersion
-	for _, f := range files {
-		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+	for _, name := range files {
+		if !strings.HasSuffix(name, ".json") {
 			continue
 		}
 
 		// Read file to get label and created time
-		content, err := os.ReadFile(filepath.Join(config.ConfigVersionsDir, f.Name()))
+		content, err := storage.ReadFile(filepath.Join(config.ConfigVersionsDir, name))
 		if err != nil {
 			continue
 		}
 		
 		var vf VersionFile
-		if err := json.Unmarshal(content, &vf); err != nil {
+		if err := json.Unmarshal(content, &vf); err != nil || versionOwner(&vf) != username {
 			continue
 		}
 
@@ -111,6 +132,7 @@ func SaveConfigVersion(c *gin.Context) {
 		ID:        id,
 		Label:     payload.Label,
 		CreatedAt: now,
+		Owner:     username,
 		Data:      currentData,
 	}
 
@@ -138,9 +160,14 @@ func RestoreConfigVersion(c *gin.Context) {
 		return
 	}
 
+	if !isValidVersionID(payload.ID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
 	filename := filepath.Join(config.ConfigVersionsDir, payload.ID+".json")
 	var vf VersionFile
-	if err := utils.ReadJSON(filename, &vf); err != nil {
+	if err := utils.ReadJSON(filename, &vf); err != nil || versionOwner(&vf) != username {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
 		return
 	}
@@ -157,8 +184,18 @@ func RestoreConfigVersion(c *gin.Context) {
 	utils.ReadJSON(userFile, &currentData)
 
 	newData := vf.Data
-	
+	if newData == nil {
+		newData = map[string]interface{}{}
+	}
+	delete(newData, "password")
+	if !upgradeDashboard(c, newData) {
+		return
+	}
+
 	// Preserve critical fields
+	for _, k := range protectedUserKeys {
+		delete(newData, k)
+	}
 	if currentData != nil {
 		if pwd, ok := currentData["password"]; ok {
 			newData["password"] = pwd
@@ -166,16 +203,22 @@ func RestoreConfigVersion(c *gin.Context) {
 		if usr, ok := currentData["username"]; ok {
 			newData["username"] = usr
 		}
+		for _, k := range protectedUserKeys {
+			if v, ok := currentData[k]; ok {
+				newData[k] = v
+			}
+		}
 	} else {
 		newData["username"] = username
 	}
+	rev := bumpRevision(newData, currentData)
 
 	if err := utils.WriteJSON(userFile, newData); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore version"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"success": true})
+	c.JSON(http.StatusOK, gin.H{"success": true, "revision": rev})
 }
 
 func DeleteConfigVersion(c *gin.Context) {
@@ -185,13 +228,18 @@ func DeleteConfigVersion(c *gin.Context) {
 		return
 	}
 
-	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+	if !isValidVersionID(id) {
 		 c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
 		 return
 	}
 
 	filename := filepath.Join(config.ConfigVersionsDir, id+".json")
-	if err := os.Remove(filename); err != nil {
+	var vf VersionFile
+	if err := utils.ReadJSON(filename, &vf); err != nil || versionOwner(&vf) != c.GetString("username") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+		return
+	}
+	if err := storage.Remove(filename); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete version"})
 		return
 	}
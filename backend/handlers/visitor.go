@@ -15,6 +15,12 @@ import (
 var visitorMutex sync.Mutex
 
 func TrackVisitor(c *gin.Context) {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	if !requireChallenge(c, &sysConfig, "visitor") {
+		return
+	}
+
 	visitorMutex.Lock()
 	defer visitorMutex.Unlock()
 
@@ -2,6 +2,8 @@ package handlers
 
 import (
 	"flatnasgo-backend/config"
+	"flatnasgo-backend/middleware"
+	"flatnasgo-backend/models"
 	"fmt"
 	"io"
 	"net/http"
@@ -196,7 +198,7 @@ func deleteBackground(c *gin.Context, dir string) {
 	}
 
 	// Admin can delete anything. Users can only delete their own (files containing their username)
-	if username != "admin" {
+	if !middleware.HasPermission(c, models.PermFilesManage) {
 		// Heuristic check based on filename format: prefix_username_timestamp.ext
 		// We check if "_username_" exists in the filename.
 		if !strings.Contains(name, "_"+username+"_") {
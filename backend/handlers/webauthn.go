@@ -0,0 +1,571 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/storage"
+	"flatnasgo-backend/utils"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const (
+	webauthnRPName       = "FlatNas"
+	webauthnCeremonyTTL  = 5 * time.Minute
+	maxPasskeysPerUser   = 20
+	maxPasskeyNameLength = 64
+)
+
+var (
+	errWebAuthnOrigin    = errors.New("webauthn origin not allowed")
+	errWebAuthnAssertion = errors.New("invalid passkey assertion")
+	errPasskeyLimit      = errors.New("too many passkeys")
+	errPasskeyNotFound   = errors.New("passkey not found")
+)
+
+// webauthnCeremony is kept between the begin and finish calls of a
+// registration or login, keyed by a random session ID.
+type webauthnCeremony struct {
+	WebAuthn  *webauthn.WebAuthn
+	Session   webauthn.SessionData
+	Username  string // Empty for a passkey login, where the authenticator names the user
+	ExpiresAt time.Time
+}
+
+var (
+	webauthnCeremonies   = map[string]webauthnCeremony{}
+	webauthnCeremoniesMu sync.Mutex
+)
+
+// webauthnUser adapts the passkeys of an account to the library.
+type webauthnUser struct {
+	username string
+	account  *models.WebAuthn
+}
+
+func (u *webauthnUser) WebAuthnID() []byte {
+	id, _ := base64.RawURLEncoding.DecodeString(u.account.UserID)
+	return id
+}
+
+func (u *webauthnUser) WebAuthnName() string        { return u.username }
+func (u *webauthnUser) WebAuthnDisplayName() string { return u.username }
+
+func (u *webauthnUser) WebAuthnCredentials() []webauthn.Credential {
+	creds := make([]webauthn.Credential, 0, len(u.account.Passkeys))
+	for _, pk := range u.account.Passkeys {
+		id, err := base64.RawURLEncoding.DecodeString(pk.ID)
+		if err != nil {
+			continue
+		}
+		transports := make([]protocol.AuthenticatorTransport, 0, len(pk.Transports))
+		for _, t := range pk.Transports {
+			transports = append(transports, protocol.AuthenticatorTransport(t))
+		}
+		creds = append(creds, webauthn.Credential{
+			ID:              id,
+			PublicKey:       pk.PublicKey,
+			AttestationType: pk.AttestationType,
+			Transport:       transports,
+			Flags:           webauthn.CredentialFlags{BackupEligible: pk.BackupEligible, BackupState: pk.BackupState},
+			Authenticator:   webauthn.Authenticator{AAGUID: pk.AAGUID, SignCount: pk.SignCount},
+		})
+	}
+	return creds
+}
+
+func hasPasskeys(user *models.User) bool {
+	return user.WebAuthn != nil && len(user.WebAuthn.Passkeys) > 0
+}
+
+// newWebAuthn returns the relying party for a request: the configured one,
+// or else the origin of the page, which must be served from the same host.
+func newWebAuthn(c *gin.Context) (*webauthn.WebAuthn, error) {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+
+	cfg := &webauthn.Config{RPDisplayName: webauthnRPName}
+	if wc := sysConfig.WebAuthn; wc != nil && wc.RPID != "" {
+		cfg.RPID = wc.RPID
+		cfg.RPOrigins = wc.Origins
+		if len(cfg.RPOrigins) == 0 {
+			cfg.RPOrigins = []string{"https://" + wc.RPID}
+		}
+	} else {
+		origin, err := url.Parse(c.GetHeader("Origin"))
+		if err != nil || origin.Host == "" || (origin.Scheme != "http" && origin.Scheme != "https") {
+			return nil, errWebAuthnOrigin
+		}
+		host, _, err := net.SplitHostPort(c.Request.Host)
+		if err != nil {
+			host = c.Request.Host
+		}
+		if !strings.EqualFold(origin.Hostname(), host) {
+			return nil, errWebAuthnOrigin
+		}
+		cfg.RPID = origin.Hostname()
+		cfg.RPOrigins = []string{origin.Scheme + "://" + origin.Host}
+	}
+	return webauthn.New(cfg)
+}
+
+func pruneWebAuthnCeremoniesLocked(now time.Time) {
+	for k, v := range webauthnCeremonies {
+		if now.After(v.ExpiresAt) {
+			delete(webauthnCeremonies, k)
+		}
+	}
+}
+
+func storeWebAuthnCeremony(w *webauthn.WebAuthn, session *webauthn.SessionData, username string) (string, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	webauthnCeremoniesMu.Lock()
+	pruneWebAuthnCeremoniesLocked(now)
+	webauthnCeremonies[id] = webauthnCeremony{
+		WebAuthn:  w,
+		Session:   *session,
+		Username:  username,
+		ExpiresAt: now.Add(webauthnCeremonyTTL),
+	}
+	webauthnCeremoniesMu.Unlock()
+	return id, nil
+}
+
+// takeWebAuthnCeremony returns and forgets a ceremony, so every challenge can
+// be answered once.
+func takeWebAuthnCeremony(id string) (*webauthnCeremony, bool) {
+	webauthnCeremoniesMu.Lock()
+	ceremony, ok := webauthnCeremonies[id]
+	delete(webauthnCeremonies, id)
+	webauthnCeremoniesMu.Unlock()
+	if !ok || time.Now().After(ceremony.ExpiresAt) {
+		return nil, false
+	}
+	return &ceremony, true
+}
+
+// findPasskeyUser returns the account whose passkey user handle is handle.
+func findPasskeyUser(handle []byte) string {
+	encoded := base64.RawURLEncoding.EncodeToString(handle)
+	matches := func(path string) bool {
+		var account struct {
+			WebAuthn *models.WebAuthn `json:"webauthn"`
+		}
+		if err := utils.ReadJSON(path, &account); err != nil || account.WebAuthn == nil {
+			return false
+		}
+		return account.WebAuthn.UserID == encoded
+	}
+
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	if sysConfig.AuthMode == "single" {
+		if matches(filepath.Join(config.DataDir, "data.json")) {
+			return "admin"
+		}
+		return ""
+	}
+	files, err := storage.ReadDir(config.UsersDir)
+	if err != nil {
+		return ""
+	}
+	for _, name := range files {
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		if matches(filepath.Join(config.UsersDir, name)) {
+			return strings.TrimSuffix(name, ".json")
+		}
+	}
+	return ""
+}
+
+type PasskeySummary struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	CreatedAt int64  `json:"createdAt"`
+	LastUsed  int64  `json:"lastUsed,omitempty"`
+	Syncable  bool   `json:"syncable"` // Backup eligible, e.g. synced through a password manager
+	BackedUp  bool   `json:"backedUp"`
+}
+
+type PasskeyRegisterFinishRequest struct {
+	Session    string          `json:"session"`
+	Name       string          `json:"name"`
+	Credential json.RawMessage `json:"credential"`
+}
+
+type PasskeyLoginBeginRequest struct {
+	Challenge string `json:"challenge,omitempty"` // From Login when the passkey is the second factor
+}
+
+type PasskeyLoginFinishRequest struct {
+	Session    string          `json:"session"`
+	Credential json.RawMessage `json:"credential"`
+}
+
+func GetPasskeys(c *gin.Context) {
+	user, err := loadUser(c.GetString("username"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	list := []PasskeySummary{}
+	if user.WebAuthn != nil {
+		for _, pk := range user.WebAuthn.Passkeys {
+			list = append(list, PasskeySummary{
+				ID:        pk.ID,
+				Name:      pk.Name,
+				CreatedAt: pk.CreatedAt,
+				LastUsed:  pk.LastUsed,
+				Syncable:  pk.BackupEligible,
+				BackedUp:  pk.BackupState,
+			})
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "passkeys": list})
+}
+
+// BeginPasskeyRegistration returns the options for navigator.credentials.create.
+// The user handle is generated on the first registration.
+func BeginPasskeyRegistration(c *gin.Context) {
+	username := c.GetString("username")
+	w, err := newWebAuthn(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Passkeys are not available on this address"})
+		return
+	}
+
+	user, err := updateUserAccount(username, func(user *models.User) error {
+		if user.WebAuthn == nil {
+			user.WebAuthn = &models.WebAuthn{Passkeys: []models.Passkey{}}
+		}
+		if user.WebAuthn.UserID != "" {
+			return nil
+		}
+		handle := make([]byte, 32)
+		if _, err := rand.Read(handle); err != nil {
+			return err
+		}
+		user.WebAuthn.UserID = base64.RawURLEncoding.EncodeToString(handle)
+		return nil
+	})
+	if err != nil {
+		respondTwoFactorError(c, err)
+		return
+	}
+	if len(user.WebAuthn.Passkeys) >= maxPasskeysPerUser {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many passkeys"})
+		return
+	}
+
+	waUser := &webauthnUser{username: username, account: user.WebAuthn}
+	options, session, err := w.BeginRegistration(waUser,
+		webauthn.WithExclusions(webauthn.Credentials(waUser.WebAuthnCredentials()).CredentialDescriptors()),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start registration"})
+		return
+	}
+	id, err := storeWebAuthnCeremony(w, session, username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start registration"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "session": id, "options": options})
+}
+
+func FinishPasskeyRegistration(c *gin.Context) {
+	var req PasskeyRegisterFinishRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Session == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	username := c.GetString("username")
+	ceremony, ok := takeWebAuthnCeremony(req.Session)
+	if !ok || ceremony.Username != username {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "注册已过期，请重试"})
+		return
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(req.Credential)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid credential"})
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+	if len(name) > maxPasskeyNameLength {
+		name = name[:maxPasskeyNameLength]
+	}
+
+	var added models.Passkey
+	_, err = updateUserAccount(username, func(user *models.User) error {
+		if user.WebAuthn == nil {
+			return errWebAuthnAssertion
+		}
+		if len(user.WebAuthn.Passkeys) >= maxPasskeysPerUser {
+			return errPasskeyLimit
+		}
+		cred, err := ceremony.WebAuthn.CreateCredential(&webauthnUser{username: username, account: user.WebAuthn}, ceremony.Session, parsed)
+		if err != nil {
+			return errWebAuthnAssertion
+		}
+		id := base64.RawURLEncoding.EncodeToString(cred.ID)
+		for _, pk := range user.WebAuthn.Passkeys {
+			if pk.ID == id {
+				return errWebAuthnAssertion
+			}
+		}
+		transports := make([]string, 0, len(cred.Transport))
+		for _, t := range cred.Transport {
+			transports = append(transports, string(t))
+		}
+		added = models.Passkey{
+			ID:              id,
+			Name:            name,
+			PublicKey:       cred.PublicKey,
+			AttestationType: cred.AttestationType,
+			Transports:      transports,
+			AAGUID:          cred.Authenticator.AAGUID,
+			SignCount:       cred.Authenticator.SignCount,
+			BackupEligible:  cred.Flags.BackupEligible,
+			BackupState:     cred.Flags.BackupState,
+			CreatedAt:       time.Now().Unix(),
+		}
+		user.WebAuthn.Passkeys = append(user.WebAuthn.Passkeys, added)
+		return nil
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, errPasskeyLimit):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Too many passkeys"})
+		case errors.Is(err, errWebAuthnAssertion):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Passkey verification failed"})
+		default:
+			respondTwoFactorError(c, err)
+		}
+		return
+	}
+
+	audit(c, "passkey.register", c.GetString("username"), gin.H{"id": added.ID, "name": added.Name})
+	c.JSON(http.StatusOK, gin.H{"success": true, "passkey": PasskeySummary{
+		ID:        added.ID,
+		Name:      added.Name,
+		CreatedAt: added.CreatedAt,
+		Syncable:  added.BackupEligible,
+		BackedUp:  added.BackupState,
+	}})
+}
+
+func DeletePasskey(c *gin.Context) {
+	id := c.Param("id")
+	_, err := updateUserAccount(c.GetString("username"), func(user *models.User) error {
+		if user.WebAuthn == nil {
+			return errPasskeyNotFound
+		}
+		for i, pk := range user.WebAuthn.Passkeys {
+			if pk.ID == id {
+				user.WebAuthn.Passkeys = append(user.WebAuthn.Passkeys[:i], user.WebAuthn.Passkeys[i+1:]...)
+				return nil
+			}
+		}
+		return errPasskeyNotFound
+	})
+	if err != nil {
+		if errors.Is(err, errPasskeyNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Passkey not found"})
+			return
+		}
+		respondTwoFactorError(c, err)
+		return
+	}
+	audit(c, "passkey.delete", c.GetString("username"), gin.H{"id": id})
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// BeginPasskeyLogin returns the options for navigator.credentials.get. With a
+// challenge from Login, it completes a password login as the second factor
+// and only the passkeys of that user are offered. Without one, any passkey of
+// this site may be used and must verify the user (PIN or biometrics), as it
+// replaces both the password and the second factor.
+func BeginPasskeyLogin(c *gin.Context) {
+	var req PasskeyLoginBeginRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+	w, err := newWebAuthn(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Passkeys are not available on this address"})
+		return
+	}
+
+	username := ""
+	var options *protocol.CredentialAssertion
+	var session *webauthn.SessionData
+	if req.Challenge != "" {
+		var ok bool
+		username, ok = parseTwoFactorChallenge(req.Challenge)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "验证已过期，请重新登录"})
+			return
+		}
+		user, err := loadUser(username)
+		if err != nil || !hasPasskeys(user) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No passkeys registered"})
+			return
+		}
+		options, session, err = w.BeginLogin(&webauthnUser{username: username, account: user.WebAuthn})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+			return
+		}
+	} else {
+		options, session, err = w.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+			return
+		}
+	}
+
+	id, err := storeWebAuthnCeremony(w, session, username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "session": id, "options": options})
+}
+
+// FinishPasskeyLogin verifies the assertion and signs the user in.
+func FinishPasskeyLogin(c *gin.Context) {
+	var req PasskeyLoginFinishRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Session == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	ceremony, ok := takeWebAuthnCeremony(req.Session)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "验证已过期，请重新登录"})
+		return
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(req.Credential)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid credential"})
+		return
+	}
+
+	username := ceremony.Username
+	if username == "" {
+		username = findPasskeyUser(parsed.Response.UserHandle)
+	}
+	clientIP := c.ClientIP()
+	if wait, locked := loginLockedOut(clientIP, username); locked {
+		respondLoginLocked(c, wait)
+		return
+	}
+	if username == "" {
+		recordLoginFailure(clientIP, "")
+		auditLogin(c, "", "login.failed", gin.H{"method": "passkey", "reason": "unknown passkey"})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Passkey not recognized"})
+		return
+	}
+
+	user, err := updateUserAccount(username, func(user *models.User) error {
+		if !hasPasskeys(user) {
+			return errWebAuthnAssertion
+		}
+		waUser := &webauthnUser{username: username, account: user.WebAuthn}
+		var cred *webauthn.Credential
+		var err error
+		if ceremony.Username != "" {
+			cred, err = ceremony.WebAuthn.ValidateLogin(waUser, ceremony.Session, parsed)
+		} else {
+			_, cred, err = ceremony.WebAuthn.ValidatePasskeyLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+				if !bytes.Equal(userHandle, waUser.WebAuthnID()) {
+					return nil, errWebAuthnAssertion
+				}
+				return waUser, nil
+			}, ceremony.Session, parsed)
+		}
+		// A counter that went backwards means the key may have been cloned
+		if err != nil || cred.Authenticator.CloneWarning {
+			return errWebAuthnAssertion
+		}
+		id := base64.RawURLEncoding.EncodeToString(cred.ID)
+		for i := range user.WebAuthn.Passkeys {
+			pk := &user.WebAuthn.Passkeys[i]
+			if pk.ID == id {
+				pk.SignCount = cred.Authenticator.SignCount
+				pk.BackupState = cred.Flags.BackupState
+				pk.LastUsed = time.Now().Unix()
+				return nil
+			}
+		}
+		return errWebAuthnAssertion
+	})
+	if err != nil {
+		recordLoginFailure(clientIP, username)
+		auditLogin(c, username, "login.failed", gin.H{"method": "passkey"})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Passkey verification failed"})
+		return
+	}
+
+	// Signing in without a password still has to honour a forced change
+	finishPasswordLogin(c, clientIP, username, user)
+}
+
+// parseWebAuthnConfig validates the webauthn section of a system config update.
+func parseWebAuthnConfig(raw interface{}) (*models.WebAuthnConfig, string) {
+	if raw == nil {
+		return nil, ""
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, "Invalid webauthn"
+	}
+	var wc models.WebAuthnConfig
+	if err := json.Unmarshal(data, &wc); err != nil {
+		return nil, "Invalid webauthn"
+	}
+	wc.RPID = strings.ToLower(strings.TrimSpace(wc.RPID))
+	if wc.RPID == "" {
+		return nil, ""
+	}
+	if strings.ContainsAny(wc.RPID, ":/ ") {
+		return nil, "Invalid webauthn rpId"
+	}
+	for _, origin := range wc.Origins {
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, "Invalid webauthn origin: " + origin
+		}
+		host := u.Hostname()
+		if host != wc.RPID && !strings.HasSuffix(host, "."+wc.RPID) {
+			return nil, "Origin " + origin + " does not belong to " + wc.RPID
+		}
+	}
+	return &wc, ""
+}
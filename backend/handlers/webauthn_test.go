@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testOrigin = "http://nas.local"
+
+// softAuthenticator is a minimal platform authenticator: one P-256 passkey,
+// "none" attestation.
+type softAuthenticator struct {
+	key    *ecdsa.PrivateKey
+	credID []byte
+	handle []byte
+	count  uint32
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func (a *softAuthenticator) authData(flags byte, attested bool) []byte {
+	rpHash := sha256.Sum256([]byte("nas.local"))
+	data := append([]byte{}, rpHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.count)
+	if attested {
+		data = append(data, make([]byte, 16)...) // AAGUID
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.credID)))
+		data = append(data, a.credID...)
+		coseKey, _ := cbor.Marshal(map[int]interface{}{
+			1: 2, 3: -7, -1: 1,
+			-2: a.key.PublicKey.X.FillBytes(make([]byte, 32)),
+			-3: a.key.PublicKey.Y.FillBytes(make([]byte, 32)),
+		})
+		data = append(data, coseKey...)
+	}
+	return data
+}
+
+func clientData(typ, challenge string) []byte {
+	data, _ := json.Marshal(map[string]string{"type": typ, "challenge": challenge, "origin": testOrigin})
+	return data
+}
+
+func (a *softAuthenticator) create(challenge string) string {
+	attObj, _ := cbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authData(0x45, true), // UP, UV, AT
+	})
+	cred, _ := json.Marshal(map[string]interface{}{
+		"id":    b64(a.credID),
+		"rawId": b64(a.credID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64(clientData("webauthn.create", challenge)),
+			"attestationObject": b64(attObj),
+		},
+	})
+	return string(cred)
+}
+
+func (a *softAuthenticator) get(challenge string) string {
+	a.count++
+	authData := a.authData(0x05, false) // UP, UV
+	cd := clientData("webauthn.get", challenge)
+	cdHash := sha256.Sum256(cd)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), cdHash[:]...))
+	sig, _ := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	cred, _ := json.Marshal(map[string]interface{}{
+		"id":    b64(a.credID),
+		"rawId": b64(a.credID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64(cd),
+			"authenticatorData": b64(authData),
+			"signature":         b64(sig),
+			"userHandle":        b64(a.handle),
+		},
+	})
+	return string(cred)
+}
+
+type ceremonyResponse struct {
+	Session string `json:"session"`
+	Options struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			User      struct {
+				ID string `json:"id"`
+			} `json:"user"`
+		} `json:"publicKey"`
+	} `json:"options"`
+}
+
+func postJSON(r http.Handler, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Host = "nas.local"
+	req.Header.Set("Origin", testOrigin)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestPasskeyRegistrationAndLogin(t *testing.T) {
+	setupDataDir(t, models.SystemConfig{AuthMode: "multi"})
+	hashed, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	utils.WriteJSON(filepath.Join(config.UsersDir, "alice.json"), models.User{Username: "alice", Password: string(hashed)})
+
+	r := gin.New()
+	r.POST("/api/login", Login)
+	r.POST("/api/login/passkey/begin", BeginPasskeyLogin)
+	r.POST("/api/login/passkey/finish", FinishPasskeyLogin)
+	asAlice := func(c *gin.Context) { c.Set("username", "alice") }
+	r.POST("/api/passkeys/register/begin", asAlice, BeginPasskeyRegistration)
+	r.POST("/api/passkeys/register/finish", asAlice, FinishPasskeyRegistration)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	auth := &softAuthenticator{key: key, credID: []byte("credential-0001")}
+
+	w := postJSON(r, "/api/passkeys/register/begin", "")
+	var begin ceremonyResponse
+	json.Unmarshal(w.Body.Bytes(), &begin)
+	if w.Code != http.StatusOK || begin.Session == "" {
+		t.Fatalf("register begin: %d %s", w.Code, w.Body.String())
+	}
+	auth.handle, _ = base64.RawURLEncoding.DecodeString(begin.Options.PublicKey.User.ID)
+
+	body := `{"session":"` + begin.Session + `","name":"Phone","credential":` + auth.create(begin.Options.PublicKey.Challenge) + `}`
+	if w = postJSON(r, "/api/passkeys/register/finish", body); w.Code != http.StatusOK {
+		t.Fatalf("register finish: %d %s", w.Code, w.Body.String())
+	}
+
+	// The password alone no longer signs alice in
+	w = postJSON(r, "/api/login", `{"username":"alice","password":"secret"}`)
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), `"passkey"`) {
+		t.Fatalf("expected passkey second factor, got %d %s", w.Code, w.Body.String())
+	}
+
+	// Passwordless login with the discoverable credential
+	w = postJSON(r, "/api/login/passkey/begin", "")
+	json.Unmarshal(w.Body.Bytes(), &begin)
+	finish := `{"session":"` + begin.Session + `","credential":` + auth.get(begin.Options.PublicKey.Challenge) + `}`
+	w = postJSON(r, "/api/login/passkey/finish", finish)
+	var resp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusOK || resp["token"] == nil || resp["username"] != "alice" {
+		t.Fatalf("passkey login: %d %s", w.Code, w.Body.String())
+	}
+
+	user, err := loadUser("alice")
+	if err != nil || !hasPasskeys(user) || user.WebAuthn.Passkeys[0].SignCount != 1 || user.WebAuthn.Passkeys[0].Name != "Phone" {
+		t.Fatalf("expected stored passkey with updated counter, got %+v %v", user.WebAuthn, err)
+	}
+
+	// A ceremony can only be finished once
+	if w = postJSON(r, "/api/login/passkey/finish", finish); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected replay to fail, got %d", w.Code)
+	}
+
+	// A password reset by an admin must be completed before a passwordless login
+	updateUserAccount("alice", func(user *models.User) error {
+		user.MustChangePassword = true
+		return nil
+	})
+	w = postJSON(r, "/api/login/passkey/begin", "")
+	json.Unmarshal(w.Body.Bytes(), &begin)
+	finish = `{"session":"` + begin.Session + `","credential":` + auth.get(begin.Options.PublicKey.Challenge) + `}`
+	w = postJSON(r, "/api/login/passkey/finish", finish)
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), `"passwordChangeRequired":true`) || strings.Contains(w.Body.String(), `"token"`) {
+		t.Fatalf("expected a forced password change, got %d %s", w.Code, w.Body.String())
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"flatnasgo-backend/config"
 	"flatnasgo-backend/handlers"
 	"flatnasgo-backend/middleware"
+	"flatnasgo-backend/migrations"
 	"fmt"
 	"log"
 	"net/http"
@@ -24,11 +25,24 @@ import (
 func main() {
 	fmt.Println("Backend process started")
 	config.Init()
+	if runCommand(os.Args[1:]) {
+		return
+	}
+	if err := config.OpenStorage(); err != nil {
+		log.Fatalf("Failed to open %s storage: %v", config.StorageBackend, err)
+	}
+	if err := migrations.Run(); err != nil {
+		log.Fatalf("Failed to migrate data: %v", err)
+	}
 	handlers.InitDocker()
 	handlers.StartIPFetcher()
 	handlers.StartDataWarmup()
 
 	r := gin.New()
+	// Client addresses are resolved from the trusted proxies of the system config
+	r.TrustedPlatform = middleware.ClientIPHeader
+	r.SetTrustedProxies(nil)
+	r.Use(middleware.ResolveClientIP())
 	r.Use(gin.Logger())
 	r.Use(middleware.RecoveryMiddleware())
 
@@ -56,9 +70,9 @@ func main() {
 		AllowOriginFunc: func(origin string) bool {
 			return allowOriginFunc(origin)
 		},
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS", "HEAD"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "Accept", "X-Requested-With"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS", "HEAD"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "Accept", "X-Requested-With", "X-Challenge", "X-Challenge-Solution", "X-Share-Password", "If-Match"},
+		ExposeHeaders:    []string{"Content-Length", "ETag"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
@@ -144,96 +158,7 @@ func main() {
 		}
 	})
 
-	// API Routes
-	api := r.Group("/api")
-	{
-		api.POST("/login", handlers.Login)
-		api.POST("/register", handlers.Register)
-		api.GET("/data", middleware.OptionalAuthMiddleware(), handlers.GetData)
-		api.GET("/system-config", handlers.GetSystemConfig)
-		api.GET("/ip", handlers.GetIP)                                                             // Added GetIP
-		api.GET("/weather", handlers.GetWeather)                                                   // Added Weather
-		api.GET("/custom-scripts", middleware.OptionalAuthMiddleware(), handlers.GetCustomScripts) // Added Custom Scripts
-		api.GET("/docker-status", handlers.GetDockerStatus)                                        // Added Docker Status
-		api.GET("/docker/debug", handlers.GetDockerDebug)
-		api.GET("/config/proxy-status", handlers.GetProxyStatus)
-
-		// Icon Routes
-		api.GET("/ali-icons", handlers.GetAliIcons)
-		api.GET("/get-icon-base64", handlers.GetIconBase64)
-
-		// Amap Proxy Routes
-		api.GET("/amap/weather", handlers.ProxyAmapWeather)
-		api.GET("/amap/ip", handlers.ProxyAmapIP)
-
-		api.GET("/ping", handlers.Ping)                   // Added Ping
-		api.GET("/rtt", handlers.RTT)                     // Added RTT for frontend latency check
-		api.GET("/lucky/stun", handlers.LuckyStun)        // Added STUN server information
-		api.POST("/visitor/track", handlers.TrackVisitor) // Public endpoint
-		api.GET("/transfer/file/:filename", middleware.OptionalAuthMiddleware(), handlers.ServeFile)
-		api.GET("/music-list", handlers.GetMusicList) // Added Music List
-
-		// Protected Routes
-		authorized := api.Group("/")
-		authorized.Use(middleware.AuthMiddleware())
-		{
-			// Widget Data
-			authorized.GET("/widgets/:id", handlers.GetWidget)
-
-			// User Management
-			authorized.GET("/admin/users", handlers.GetUsers)
-			authorized.POST("/admin/users", handlers.AddUser)
-			authorized.DELETE("/admin/users/:usr", handlers.DeleteUser)
-			authorized.POST("/admin/license", handlers.UploadLicense)
-
-			// Invite Code Management
-			authorized.GET("/admin/invite-codes", handlers.GetInviteCodes)
-			authorized.POST("/admin/invite-codes", handlers.GenerateInviteCode)
-			authorized.DELETE("/admin/invite-codes/:code", handlers.DeleteInviteCode)
-
-			authorized.POST("/save", handlers.SaveData)                    // Added SaveData
-			authorized.POST("/system-config", handlers.UpdateSystemConfig) // Added SystemConfig Update
-			authorized.POST("/data/import", handlers.ImportData)           // Added ImportData
-			authorized.POST("/default/save", handlers.SaveDefault)
-			authorized.POST("/reset", handlers.ResetData)
-			authorized.GET("/system/stats", handlers.GetSystemStats)
-			authorized.GET("/docker/containers", handlers.ListContainers)
-			authorized.GET("/docker/info", handlers.GetDockerInfo)
-			authorized.GET("/docker/export-logs", handlers.ExportDockerLogs)
-			authorized.GET("/docker/container/:id/inspect-lite", handlers.ContainerInspectLite)
-			authorized.POST("/docker/check-updates", handlers.TriggerUpdateCheck)
-			authorized.POST("/docker/container/:id/:action", handlers.ContainerAction)
-			authorized.POST("/custom-scripts", handlers.SaveCustomScripts)
-
-			// Wallpaper
-			authorized.GET("/wallpaper/proxy", handlers.ProxyWallpaper)
-			authorized.POST("/wallpaper/resolve", handlers.ResolveWallpaper)
-			authorized.POST("/wallpaper/fetch", handlers.FetchWallpaper)
-
-			// Backgrounds Management
-			authorized.GET("/backgrounds", handlers.ListBackgrounds)
-			authorized.GET("/mobile_backgrounds", handlers.ListMobileBackgrounds)
-			authorized.DELETE("/backgrounds/:name", handlers.DeleteBackground)
-			authorized.DELETE("/mobile_backgrounds/:name", handlers.DeleteMobileBackground)
-			authorized.POST("/backgrounds/upload", handlers.UploadBackground)
-			authorized.POST("/mobile_backgrounds/upload", handlers.UploadMobileBackground)
-
-			// Transfer
-			api.GET("/transfer/items", handlers.GetTransferItems)
-			authorized.POST("/transfer/text", handlers.SendText)
-			authorized.POST("/transfer/upload/init", handlers.UploadInit)
-			authorized.POST("/transfer/upload/chunk", handlers.UploadChunk)
-			authorized.POST("/transfer/upload/complete", handlers.UploadComplete)
-			authorized.POST("/transfer/download-token", handlers.DownloadToken)
-			authorized.DELETE("/transfer/items/:id", handlers.DeleteItem)
-
-			// Config Versions
-			authorized.GET("/config-versions", handlers.GetConfigVersions)
-			authorized.POST("/config-versions", handlers.SaveConfigVersion)
-			authorized.POST("/config-versions/restore", handlers.RestoreConfigVersion)
-			authorized.DELETE("/config-versions/:id", handlers.DeleteConfigVersion)
-		}
-	}
+	registerAPIRoutes(r.Group("/api"))
 
 	port := os.Getenv("PORT")
 	if port == "" {
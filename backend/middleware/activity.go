@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+)
+
+// sessionActivity remembers when each session last made an authenticated
+// request. It is kept in memory only; the session store persists it when the
+// session refreshes its token.
+var sessionActivity sync.Map
+
+func touchSession(sessionID string) {
+	if sessionID == "" {
+		return
+	}
+	sessionActivity.Store(sessionID, time.Now().Unix())
+}
+
+// SessionLastSeen returns the unix time of the last request made with an
+// access token of the session, or 0 if none was seen since startup.
+func SessionLastSeen(sessionID string) int64 {
+	if v, ok := sessionActivity.Load(sessionID); ok {
+		return v.(int64)
+	}
+	return 0
+}
+
+func ForgetSession(sessionID string) {
+	sessionActivity.Delete(sessionID)
+}
@@ -0,0 +1,192 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// APITokenPrefix marks personal access tokens so AuthMiddleware can tell
+// them apart from session JWTs without trying to parse them.
+const APITokenPrefix = "fnp_"
+
+// apiTokenTouchInterval limits how often LastUsed is written to disk.
+const apiTokenTouchInterval = 60
+
+var (
+	apiTokens   []models.APIToken
+	apiTokensOk bool
+	apiTokensMu sync.Mutex
+)
+
+func getAPITokensFile() string {
+	return filepath.Join(config.DataDir, "api_tokens.json")
+}
+
+func HashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func loadAPITokensLocked() {
+	if apiTokensOk {
+		return
+	}
+	apiTokens = nil
+	utils.ReadJSON(getAPITokensFile(), &apiTokens)
+	apiTokensOk = true
+}
+
+func saveAPITokensLocked() error {
+	if apiTokens == nil {
+		apiTokens = []models.APIToken{}
+	}
+	if err := utils.WriteJSON(getAPITokensFile(), apiTokens); err != nil {
+		log.Printf("Failed to save API tokens: %v", err)
+		return err
+	}
+	return nil
+}
+
+// UpdateAPITokens runs fn on the token list and saves the result.
+func UpdateAPITokens(fn func(tokens []models.APIToken) ([]models.APIToken, error)) error {
+	apiTokensMu.Lock()
+	defer apiTokensMu.Unlock()
+	loadAPITokensLocked()
+	updated, err := fn(append([]models.APIToken(nil), apiTokens...))
+	if err != nil {
+		return err
+	}
+	apiTokens = updated
+	return saveAPITokensLocked()
+}
+
+// ListAPITokens returns the tokens of username, or of everyone when username
+// is empty, without their hashes.
+func ListAPITokens(username string) []models.APIToken {
+	apiTokensMu.Lock()
+	defer apiTokensMu.Unlock()
+	loadAPITokensLocked()
+	list := []models.APIToken{}
+	for _, t := range apiTokens {
+		if username == "" || t.Username == username {
+			t.TokenHash = ""
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+// RestrictAPITokens drops scopes the user no longer holds, e.g. after a role
+// change, so a token never grants more than its owner has.
+func RestrictAPITokens(username string, permissions []string) {
+	allowed := make(map[string]bool, len(permissions))
+	for _, p := range permissions {
+		allowed[p] = true
+	}
+	UpdateAPITokens(func(tokens []models.APIToken) ([]models.APIToken, error) {
+		for i := range tokens {
+			if tokens[i].Username != username {
+				continue
+			}
+			scopes := []string{}
+			for _, s := range tokens[i].Scopes {
+				if allowed[s] {
+					scopes = append(scopes, s)
+				}
+			}
+			tokens[i].Scopes = scopes
+		}
+		return tokens, nil
+	})
+}
+
+// DeleteUserAPITokens removes every token owned by username.
+func DeleteUserAPITokens(username string) {
+	UpdateAPITokens(func(tokens []models.APIToken) ([]models.APIToken, error) {
+		kept := tokens[:0]
+		for _, t := range tokens {
+			if t.Username != username {
+				kept = append(kept, t)
+			}
+		}
+		return kept, nil
+	})
+}
+
+// RenameUserAPITokens hands every token of from over to to.
+func RenameUserAPITokens(from, to string) {
+	UpdateAPITokens(func(tokens []models.APIToken) ([]models.APIToken, error) {
+		for i := range tokens {
+			if tokens[i].Username == from {
+				tokens[i].Username = to
+			}
+		}
+		return tokens, nil
+	})
+}
+
+// authenticateAPIToken resolves a personal access token to its stored record.
+func authenticateAPIToken(token string) (*models.APIToken, bool) {
+	hash := HashAPIToken(token)
+	now := time.Now().Unix()
+
+	apiTokensMu.Lock()
+	defer apiTokensMu.Unlock()
+	loadAPITokensLocked()
+	for i := range apiTokens {
+		t := &apiTokens[i]
+		if t.TokenHash != hash {
+			continue
+		}
+		if t.ExpiresAt != 0 && t.ExpiresAt <= now {
+			return nil, false
+		}
+		if now-t.LastUsed >= apiTokenTouchInterval {
+			t.LastUsed = now
+			saveAPITokensLocked()
+		}
+		found := *t
+		return &found, true
+	}
+	return nil, false
+}
+
+func isAPIToken(token string) bool {
+	return strings.HasPrefix(token, APITokenPrefix)
+}
+
+// setAPITokenIdentity grants the request exactly the scopes of the token.
+func setAPITokenIdentity(c *gin.Context, t *models.APIToken) {
+	c.Set("username", t.Username)
+	c.Set("permissions", append([]string(nil), t.Scopes...))
+	c.Set("apiTokenId", t.ID)
+}
+
+// IsAPITokenRequest reports whether the request authenticated with a
+// personal access token rather than a login session.
+func IsAPITokenRequest(c *gin.Context) bool {
+	return c.GetString("apiTokenId") != ""
+}
+
+// RequireSession rejects personal access tokens on routes that manage the
+// account itself (sessions, 2FA, tokens). Must run after AuthMiddleware.
+func RequireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if IsAPITokenRequest(c) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "This endpoint requires an interactive login"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,103 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// setupAPITokenTest stores tokens under a fresh data directory and returns
+// the secret of a token of alice limited to scopes.
+func setupAPITokenTest(t *testing.T, scopes ...string) string {
+	gin.SetMode(gin.TestMode)
+	config.DataDir = t.TempDir()
+	config.SystemConfigFile = filepath.Join(config.DataDir, "system.json")
+	config.SecretKey = []byte("test-secret")
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{AuthMode: "multi"})
+	apiTokens, apiTokensOk = nil, false
+
+	secret := APITokenPrefix + "scoped"
+	UpdateAPITokens(func(tokens []models.APIToken) ([]models.APIToken, error) {
+		return append(tokens,
+			models.APIToken{ID: "scoped", Username: "alice", TokenHash: HashAPIToken(secret), Scopes: scopes},
+			models.APIToken{ID: "expired", Username: "alice", TokenHash: HashAPIToken(APITokenPrefix + "expired"), Scopes: scopes, ExpiresAt: time.Now().Add(-time.Hour).Unix()},
+		), nil
+	})
+	return secret
+}
+
+func bearer(r *gin.Engine, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestAPITokenGrantsExactlyItsScopes(t *testing.T) {
+	secret := setupAPITokenTest(t, models.PermDataRead, models.PermTransferRead)
+
+	r := gin.New()
+	r.GET("/perms", AuthMiddleware(), func(c *gin.Context) {
+		perms, _ := c.Get("permissions")
+		c.JSON(http.StatusOK, gin.H{"username": c.GetString("username"), "role": c.GetString("role"), "permissions": perms})
+	})
+	r.GET("/check", AuthMiddleware(), func(c *gin.Context) {
+		if RequirePermission(c.Query("perm"))(c); !c.IsAborted() {
+			c.Status(http.StatusOK)
+		}
+	})
+
+	w := bearer(r, http.MethodGet, "/perms", secret)
+	if w.Code != http.StatusOK || w.Body.String() != `{"permissions":["data:read","transfer:read"],"role":"","username":"alice"}` {
+		t.Fatalf("expected the scopes as the only permissions, got %d %s", w.Code, w.Body.String())
+	}
+	for _, perm := range models.AllPermissions {
+		expected := http.StatusForbidden
+		if perm == models.PermDataRead || perm == models.PermTransferRead {
+			expected = http.StatusOK
+		}
+		if w := bearer(r, http.MethodGet, "/check?perm="+perm, secret); w.Code != expected {
+			t.Fatalf("%s: expected %d, got %d", perm, expected, w.Code)
+		}
+	}
+
+	if w := bearer(r, http.MethodGet, "/perms", APITokenPrefix+"expired"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected an expired token to be refused, got %d", w.Code)
+	}
+	if w := bearer(r, http.MethodGet, "/perms", APITokenPrefix+"unknown"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected an unknown token to be refused, got %d", w.Code)
+	}
+}
+
+func TestRequireSessionRejectsAPITokens(t *testing.T) {
+	secret := setupAPITokenTest(t, models.AllPermissions...)
+
+	r := gin.New()
+	r.GET("/sessions", AuthMiddleware(), RequireSession(), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	if w := bearer(r, http.MethodGet, "/sessions", secret); w.Code != http.StatusForbidden {
+		t.Fatalf("expected an API token to be refused, got %d", w.Code)
+	}
+
+	session, err := utils.SignToken(config.KeyPurposeSession, jwt.MapClaims{
+		"username": "alice",
+		"exp":      time.Now().Add(time.Minute).Unix(),
+	})
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+	if w := bearer(r, http.MethodGet, "/sessions", session); w.Code != http.StatusOK {
+		t.Fatalf("expected a login session to pass, got %d", w.Code)
+	}
+}
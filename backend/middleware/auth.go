@@ -1,7 +1,9 @@
 package middleware
 
 import (
+	"errors"
 	"flatnasgo-backend/config"
+	"flatnasgo-backend/utils"
 	"net/http"
 	"strings"
 
@@ -9,6 +11,9 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
+var errNotSessionToken = errors.New("not a session token")
+var errRevokedToken = errors.New("token revoked")
+
 func parseToken(c *gin.Context) (*jwt.Token, error) {
 	tokenString := c.GetHeader("Authorization")
 	if tokenString == "" {
@@ -21,26 +26,69 @@ func parseToken(c *gin.Context) (*jwt.Token, error) {
 		return nil, nil
 	}
 
-	return jwt.Parse(
-		tokenString,
-		func(token *jwt.Token) (interface{}, error) {
-			return []byte(config.GetSecretKeyString()), nil
-		},
-		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
-	)
+	return ParseSessionToken(tokenString)
 }
 
-func AuthMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		token, err := parseToken(c)
+// ParseSessionToken validates a login session token, including revocation.
+// It is shared by the HTTP middleware and the socket handlers.
+func ParseSessionToken(tokenString string) (*jwt.Token, error) {
+	token, err := utils.ParseToken(config.KeyPurposeSession, tokenString, jwt.MapClaims{})
+	if err != nil {
+		return token, err
+	}
+	if !IsSessionClaims(token.Claims) {
+		return nil, errNotSessionToken
+	}
+	if claims, ok := token.Claims.(jwt.MapClaims); !ok || isRevoked(claims) {
+		return nil, errRevokedToken
+	}
+	return token, nil
+}
 
-		if err != nil || token == nil || !token.Valid {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-			return
+// IsSessionClaims reports whether claims belong to a login session. Purpose
+// bound tokens (downloads, 2FA challenges) carry a subject and must not be
+// accepted as sessions, even when signed with the shared legacy key.
+func IsSessionClaims(claims jwt.Claims) bool {
+	sub, err := claims.GetSubject()
+	return err == nil && sub == ""
+}
+
+// authenticate sets the identity of the request from a session token, a
+// personal access token or a trusted proxy header and reports whether one
+// was valid. Access tokens are only accepted in the Authorization header.
+func authenticate(c *gin.Context) bool {
+	if header := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "); isAPIToken(header) {
+		t, ok := authenticateAPIToken(header)
+		// Tokens outlive sessions, so a disabled account is checked on every use
+		if ok && accountDisabled(t.Username) {
+			ok = false
+		}
+		if ok {
+			setAPITokenIdentity(c, t)
 		}
+		return ok
+	}
 
+	token, err := parseToken(c)
+	if err == nil && token != nil && token.Valid {
 		if claims, ok := token.Claims.(jwt.MapClaims); ok {
-			c.Set("username", claims["username"])
+			setIdentity(c, claims)
+		}
+		return true
+	}
+
+	if u, ok := ProxyIdentity(c.Request.RemoteAddr, c.Request.Header); ok {
+		setProxyIdentity(c, u)
+		return true
+	}
+	return false
+}
+
+func AuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !authenticate(c) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
 		}
 		c.Next()
 	}
@@ -48,13 +96,7 @@ func AuthMiddleware() gin.HandlerFunc {
 
 func OptionalAuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		token, err := parseToken(c)
-
-		if err == nil && token != nil && token.Valid {
-			if claims, ok := token.Claims.(jwt.MapClaims); ok {
-				c.Set("username", claims["username"])
-			}
-		}
+		authenticate(c)
 		c.Next()
 	}
 }
@@ -59,3 +59,59 @@ func TestParseTokenAcceptsHS256(t *testing.T) {
 		t.Fatalf("expected valid token, got err=%v", err)
 	}
 }
+
+func TestRequirePermissionResolvesLegacyTokens(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	config.SecretKey = []byte("test-secret")
+
+	cases := []struct {
+		claims jwt.MapClaims
+		status int
+	}{
+		{jwt.MapClaims{"username": "admin"}, 200},
+		{jwt.MapClaims{"username": "alice"}, 403},
+		{jwt.MapClaims{"username": "alice", "role": "admin", "permissions": []string{"users:manage"}}, 200},
+	}
+
+	for _, tc := range cases {
+		signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, tc.claims).SignedString([]byte(config.GetSecretKeyString()))
+		if err != nil {
+			t.Fatalf("sign token: %v", err)
+		}
+
+		r := gin.New()
+		r.GET("/", AuthMiddleware(), RequirePermission("users:manage"), func(c *gin.Context) {
+			c.Status(200)
+		})
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+signed)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+
+		if w.Code != tc.status {
+			t.Fatalf("claims=%v expected %d, got %d", tc.claims, tc.status, w.Code)
+		}
+	}
+}
+
+func TestParseSessionTokenRejectsRevokedVersion(t *testing.T) {
+	config.SecretKey = []byte("test-secret")
+	config.DataDir = t.TempDir()
+	revocations = nil
+
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"username": "alice",
+		"tv":       TokenVersion("alice"),
+	}).SignedString([]byte(config.GetSecretKeyString()))
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+
+	if _, err := ParseSessionToken(signed); err != nil {
+		t.Fatalf("expected valid token, got err=%v", err)
+	}
+	RevokeUserTokens("alice")
+	if _, err := ParseSessionToken(signed); err == nil {
+		t.Fatalf("expected revoked token to be rejected")
+	}
+}
@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ClientIPHeader carries the address resolved by ResolveClientIP. The router
+// registers it as gin's TrustedPlatform, so c.ClientIP() returns it.
+const ClientIPHeader = "X-Flatnas-Client-Ip"
+
+// defaultTrustedProxies covers a reverse proxy on the same host when none
+// are configured. A proxy in a container network or elsewhere on the LAN
+// has to be listed, as any device there could otherwise pick its address.
+var defaultTrustedProxies = []string{"127.0.0.0/8", "::1"}
+
+// maxWarnedProxies bounds how many peers warnUntrustedProxy remembers.
+const maxWarnedProxies = 64
+
+var (
+	warnedProxies   = map[string]bool{}
+	warnedProxiesMu sync.Mutex
+)
+
+func loadNetworkConfig() *models.NetworkConfig {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	if sysConfig.Network == nil {
+		return &models.NetworkConfig{}
+	}
+	return sysConfig.Network
+}
+
+// ipInNetworks reports whether ip is one of entries, given as CIDRs or single
+// addresses.
+func ipInNetworks(ip net.IP, entries []string) bool {
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "/") {
+			if _, network, err := net.ParseCIDR(entry); err == nil && network.Contains(ip) {
+				return true
+			}
+		} else if other := net.ParseIP(entry); other != nil && other.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func peerIP(remoteAddr string) net.IP {
+	host, _, err := net.SplitHostPort(strings.TrimSpace(remoteAddr))
+	if err != nil {
+		host = remoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// ClientAddress returns the address of the client behind r. Forwarded-for
+// headers are only read when the peer is a trusted proxy, and are walked from
+// the right up to the first address that is not one.
+func ClientAddress(r *http.Request, nc *models.NetworkConfig) string {
+	trusted := defaultTrustedProxies
+	if nc != nil && len(nc.TrustedProxies) > 0 {
+		trusted = nc.TrustedProxies
+	}
+	peer := peerIP(r.RemoteAddr)
+	if peer == nil {
+		return ""
+	}
+	if !ipInNetworks(peer, trusted) {
+		if r.Header.Get("X-Forwarded-For") != "" || r.Header.Get("X-Real-IP") != "" {
+			warnUntrustedProxy(peer)
+		}
+		return peer.String()
+	}
+	if hops := strings.Split(r.Header.Get("X-Forwarded-For"), ","); hops[0] != "" {
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				break
+			}
+			if i == 0 || !ipInNetworks(ip, trusted) {
+				return ip.String()
+			}
+		}
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return peer.String()
+}
+
+// warnUntrustedProxy logs once per peer that its forwarded-for headers were
+// ignored. After an upgrade this usually means a reverse proxy outside this
+// host has to be added to the trusted proxies.
+func warnUntrustedProxy(peer net.IP) {
+	key := peer.String()
+	warnedProxiesMu.Lock()
+	if warnedProxies[key] || len(warnedProxies) >= maxWarnedProxies {
+		warnedProxiesMu.Unlock()
+		return
+	}
+	warnedProxies[key] = true
+	warnedProxiesMu.Unlock()
+	log.Printf("Ignoring X-Forwarded-For from %s: not a trusted proxy. Add it to network.trustedProxies in the system config if a reverse proxy runs there", key)
+}
+
+// NetworkAllows reports whether ip may reach the routes of group.
+func NetworkAllows(nc *models.NetworkConfig, group, ip string) bool {
+	if nc == nil || len(nc.Allowlists[group]) == 0 {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	return addr != nil && ipInNetworks(addr, nc.Allowlists[group])
+}
+
+// ResolveClientIP works out the client address once per request. Any value of
+// ClientIPHeader sent by the client is replaced.
+func ResolveClientIP() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request.Header.Set(ClientIPHeader, ClientAddress(c.Request, loadNetworkConfig()))
+		c.Next()
+	}
+}
+
+// RequireNetwork limits a route group to the addresses allowed for it.
+func RequireNetwork(group string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !NetworkAllows(loadNetworkConfig(), group, c.ClientIP()) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "当前网络无权访问此接口"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequireNetworkUsesTrustedProxies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	config.DataDir = t.TempDir()
+	config.SystemConfigFile = filepath.Join(config.DataDir, "system.json")
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{
+		Network: &models.NetworkConfig{
+			TrustedProxies: []string{"10.0.0.1"},
+			Allowlists:     map[string][]string{models.NetworkGroupSystem: {"192.168.1.0/24"}},
+		},
+	})
+
+	r := gin.New()
+	r.TrustedPlatform = ClientIPHeader
+	r.Use(ResolveClientIP())
+	r.GET("/admin", RequireNetwork(models.NetworkGroupSystem), func(c *gin.Context) {
+		c.String(http.StatusOK, c.ClientIP())
+	})
+	r.GET("/public", func(c *gin.Context) {
+		c.String(http.StatusOK, c.ClientIP())
+	})
+
+	request := func(path, peer string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = peer + ":12345"
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := request("/admin", "192.168.1.20", nil); w.Code != http.StatusOK {
+		t.Fatalf("expected LAN client to pass, got %d", w.Code)
+	}
+	if w := request("/admin", "203.0.113.5", nil); w.Code != http.StatusForbidden {
+		t.Fatalf("expected outside client to be refused, got %d", w.Code)
+	}
+	if w := request("/admin", "10.0.0.1", map[string]string{"X-Forwarded-For": "192.168.1.20"}); w.Code != http.StatusOK {
+		t.Fatalf("expected LAN client behind trusted proxy to pass, got %d", w.Code)
+	}
+	if w := request("/admin", "10.0.0.1", map[string]string{"X-Forwarded-For": "192.168.1.20, 203.0.113.5"}); w.Code != http.StatusForbidden {
+		t.Fatalf("expected spoofed hop before the proxy to be ignored, got %d", w.Code)
+	}
+	if w := request("/admin", "203.0.113.5", map[string]string{"X-Forwarded-For": "192.168.1.20", ClientIPHeader: "192.168.1.20"}); w.Code != http.StatusForbidden {
+		t.Fatalf("expected headers from an untrusted peer to be ignored, got %d", w.Code)
+	}
+	if w := request("/public", "203.0.113.5", nil); w.Code != http.StatusOK || w.Body.String() != "203.0.113.5" {
+		t.Fatalf("expected public route to stay open, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestClientAddressTrustsOnlyLoopbackByDefault(t *testing.T) {
+	request := func(peer string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = net.JoinHostPort(peer, "12345")
+		req.Header.Set("X-Forwarded-For", "192.168.1.20")
+		return req
+	}
+
+	if ip := ClientAddress(request("127.0.0.1"), &models.NetworkConfig{}); ip != "192.168.1.20" {
+		t.Fatalf("expected forwarded address from a local proxy, got %s", ip)
+	}
+	for _, peer := range []string{"10.0.0.1", "172.17.0.2", "192.168.1.50", "fd00::1"} {
+		if ip := ClientAddress(request(peer), &models.NetworkConfig{}); ip != peer {
+			t.Fatalf("expected X-Forwarded-For from LAN peer %s to be ignored, got %s", peer, ip)
+		}
+	}
+	if ip := ClientAddress(request("172.17.0.2"), &models.NetworkConfig{TrustedProxies: []string{"172.16.0.0/12"}}); ip != "192.168.1.20" {
+		t.Fatalf("expected forwarded address from a listed proxy, got %s", ip)
+	}
+}
+
+func TestClientAddressWarnsOncePerUntrustedProxy(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	request := func(peer string, forwarded bool) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = net.JoinHostPort(peer, "12345")
+		if forwarded {
+			req.Header.Set("X-Forwarded-For", "192.168.1.20")
+		}
+		return req
+	}
+
+	ClientAddress(request("198.51.100.20", false), &models.NetworkConfig{})
+	if logs.Len() != 0 {
+		t.Fatalf("expected no warning without forwarded headers, got %q", logs.String())
+	}
+	ClientAddress(request("127.0.0.1", true), &models.NetworkConfig{})
+	if logs.Len() != 0 {
+		t.Fatalf("expected no warning for a trusted proxy, got %q", logs.String())
+	}
+
+	ClientAddress(request("198.51.100.20", true), &models.NetworkConfig{})
+	ClientAddress(request("198.51.100.20", true), &models.NetworkConfig{})
+	ClientAddress(request("198.51.100.21", true), &models.NetworkConfig{})
+	if got := strings.Count(logs.String(), "198.51.100.20: not a trusted proxy"); got != 1 {
+		t.Fatalf("expected one warning for the proxy, got %d in %q", got, logs.String())
+	}
+	if !strings.Contains(logs.String(), "198.51.100.21") || !strings.Contains(logs.String(), "network.trustedProxies") {
+		t.Fatalf("expected each proxy to be reported with the setting to change, got %q", logs.String())
+	}
+}
@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"flatnasgo-backend/models"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// setIdentity copies the identity carried by the token claims into the
+// request context. Tokens issued before roles existed carry no role, so the
+// role is resolved from the username the same way user records are.
+func setIdentity(c *gin.Context, claims jwt.MapClaims) {
+	username, _ := claims["username"].(string)
+	role, _ := claims["role"].(string)
+	role = models.EffectiveRole(username, role)
+
+	var perms []string
+	if raw, ok := claims["permissions"].([]interface{}); ok {
+		for _, p := range raw {
+			if s, ok := p.(string); ok {
+				perms = append(perms, s)
+			}
+		}
+	} else {
+		perms = models.EffectivePermissions(role, nil)
+	}
+
+	sessionID, _ := claims["sid"].(string)
+	touchSession(sessionID)
+
+	c.Set("username", username)
+	c.Set("role", role)
+	c.Set("permissions", perms)
+	c.Set("sessionId", sessionID)
+}
+
+// HasPermission reports whether the authenticated user of the request holds perm.
+func HasPermission(c *gin.Context, perm string) bool {
+	perms, ok := c.Get("permissions")
+	if !ok {
+		return false
+	}
+	list, ok := perms.([]string)
+	if !ok {
+		return false
+	}
+	for _, p := range list {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// RequirePermission must run after AuthMiddleware.
+func RequirePermission(perm string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !HasPermission(c, perm) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,160 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/migrations"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/storage"
+	"flatnasgo-backend/utils"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultProxyAuthHeader = "Remote-User"
+
+// ProxyUser is the identity asserted by a trusted authenticating proxy.
+type ProxyUser struct {
+	Username    string
+	Role        string
+	Permissions []string
+}
+
+func loadProxyAuthConfig() (*models.SystemConfig, *models.ProxyAuthConfig) {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	pa := sysConfig.ProxyAuth
+	if pa == nil || !pa.Enabled || len(pa.TrustedProxies) == 0 {
+		return &sysConfig, nil
+	}
+	return &sysConfig, pa
+}
+
+// isTrustedProxy checks the address of the peer itself. Forwarded-for headers
+// are deliberately ignored: they are set by whoever sends the request.
+func isTrustedProxy(remoteAddr string, trusted []string) bool {
+	ip := peerIP(remoteAddr)
+	return ip != nil && ipInNetworks(ip, trusted)
+}
+
+func proxyUserFile(sysConfig *models.SystemConfig, username string) string {
+	if username == "admin" && sysConfig.AuthMode == "single" {
+		return filepath.Join(config.DataDir, "data.json")
+	}
+	return filepath.Join(config.UsersDir, username+".json")
+}
+
+// accountDisabled reports whether an admin disabled the account of username.
+// Only the flag is decoded, dashboard content is irrelevant here.
+func accountDisabled(username string) bool {
+	var sysConfig models.SystemConfig
+	utils.ReadJSON(config.SystemConfigFile, &sysConfig)
+	var user struct {
+		Disabled bool `json:"disabled"`
+	}
+	utils.ReadJSON(proxyUserFile(&sysConfig, username), &user)
+	return user.Disabled
+}
+
+// ProvisionUser creates the record of a user signing in through an external
+// authenticator for the first time, with the dashboard of the default
+// template. The password is random so the account can only be used through
+// that authenticator until one is set. It reports false when the record
+// already exists.
+func ProvisionUser(path, username, role string, external *models.External) (bool, error) {
+	created := false
+	err := utils.WithFileLock(path, func() error {
+		if exists, err := storage.Exists(path); err != nil || exists {
+			return err
+		}
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		hashed, err := utils.HashPassword(hex.EncodeToString(secret))
+		if err != nil {
+			return err
+		}
+
+		record := map[string]interface{}{}
+		utils.ReadJSON(config.DefaultFile, &record)
+		for _, k := range []string{"role", "permissions", "twoFactor", "external", "webauthn", "mustChangePassword", "disabled", "publicPage"} {
+			delete(record, k)
+		}
+		record["username"] = username
+		record["password"] = hashed
+		if models.IsValidRole(role) {
+			record["role"] = role
+		}
+		if external != nil {
+			record["external"] = external
+		}
+		if _, err := migrations.Upgrade(migrations.User, record); err != nil {
+			return err
+		}
+		if err := utils.WriteJSONUnlocked(path, record); err != nil {
+			return err
+		}
+		created = true
+		return nil
+	})
+	return created, err
+}
+
+// ProxyIdentity returns the user asserted by the configured proxy header, or
+// false when proxy auth is off, the peer is not trusted or the user is
+// unknown and may not be provisioned.
+func ProxyIdentity(remoteAddr string, header http.Header) (*ProxyUser, bool) {
+	sysConfig, pa := loadProxyAuthConfig()
+	if pa == nil || !isTrustedProxy(remoteAddr, pa.TrustedProxies) {
+		return nil, false
+	}
+	name := pa.Header
+	if name == "" {
+		name = defaultProxyAuthHeader
+	}
+	username := strings.TrimSpace(header.Get(name))
+	if username == "" || !utils.IsValidUsername(username) {
+		return nil, false
+	}
+	if sysConfig.AuthMode == "single" && username != "admin" {
+		return nil, false
+	}
+
+	path := proxyUserFile(sysConfig, username)
+	if exists, err := storage.Exists(path); err == nil && !exists {
+		if !pa.AutoProvision || sysConfig.AuthMode == "single" {
+			return nil, false
+		}
+		if _, err := ProvisionUser(path, username, pa.DefaultRole, nil); err != nil {
+			return nil, false
+		}
+	}
+
+	// Only the account fields, dashboard content is irrelevant here
+	var user struct {
+		Role        string   `json:"role"`
+		Permissions []string `json:"permissions"`
+		Disabled    bool     `json:"disabled"`
+	}
+	if err := utils.ReadJSON(path, &user); err != nil || user.Disabled {
+		return nil, false
+	}
+	role := models.EffectiveRole(username, user.Role)
+	return &ProxyUser{
+		Username:    username,
+		Role:        role,
+		Permissions: models.EffectivePermissions(role, user.Permissions),
+	}, true
+}
+
+func setProxyIdentity(c *gin.Context, u *ProxyUser) {
+	c.Set("username", u.Username)
+	c.Set("role", u.Role)
+	c.Set("permissions", u.Permissions)
+	c.Set("authSource", "proxy")
+}
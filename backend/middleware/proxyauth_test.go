@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/models"
+	"flatnasgo-backend/utils"
+	"github.com/gin-gonic/gin"
+)
+
+// setupProxyAuthTest trusts identity headers from 10.0.0.0/24 only and
+// creates the accounts bob and the disabled carol.
+func setupProxyAuthTest(t *testing.T, autoProvision bool) {
+	gin.SetMode(gin.TestMode)
+	config.DataDir = t.TempDir()
+	config.UsersDir = filepath.Join(config.DataDir, "users")
+	config.SystemConfigFile = filepath.Join(config.DataDir, "system.json")
+	os.MkdirAll(config.UsersDir, 0755)
+	utils.WriteJSON(config.SystemConfigFile, models.SystemConfig{
+		AuthMode: "multi",
+		ProxyAuth: &models.ProxyAuthConfig{
+			Enabled:        true,
+			TrustedProxies: []string{"10.0.0.0/24"},
+			AutoProvision:  autoProvision,
+		},
+	})
+	utils.WriteJSON(filepath.Join(config.UsersDir, "bob.json"), models.User{Username: "bob", Role: models.RoleMember})
+	utils.WriteJSON(filepath.Join(config.UsersDir, "carol.json"), models.User{Username: "carol", Disabled: true})
+}
+
+func TestProxyIdentityIgnoresUntrustedPeers(t *testing.T) {
+	setupProxyAuthTest(t, false)
+
+	asserted := func(user string, extra ...string) http.Header {
+		h := http.Header{}
+		h.Set("Remote-User", user)
+		for i := 0; i+1 < len(extra); i += 2 {
+			h.Set(extra[i], extra[i+1])
+		}
+		return h
+	}
+
+	if u, ok := ProxyIdentity(net.JoinHostPort("10.0.0.5", "40000"), asserted("bob")); !ok || u.Username != "bob" || u.Role != models.RoleMember {
+		t.Fatalf("expected the trusted proxy to name bob, got %+v %v", u, ok)
+	}
+	cases := []struct {
+		name   string
+		peer   string
+		header http.Header
+	}{
+		{"untrusted peer", "203.0.113.5", asserted("bob")},
+		{"forwarded for a trusted proxy", "203.0.113.5", asserted("bob", "X-Forwarded-For", "10.0.0.5", "X-Real-IP", "10.0.0.5")},
+		{"IPv6 peer", "2001:db8::1", asserted("bob")},
+		{"unknown user", "10.0.0.5", asserted("mallory")},
+		{"disabled user", "10.0.0.5", asserted("carol")},
+		{"invalid username", "10.0.0.5", asserted("../bob")},
+	}
+	for _, c := range cases {
+		if u, ok := ProxyIdentity(net.JoinHostPort(c.peer, "40000"), c.header); ok {
+			t.Fatalf("%s: expected no identity, got %+v", c.name, u)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(config.UsersDir, "mallory.json")); !os.IsNotExist(err) {
+		t.Fatalf("expected unknown users not to be provisioned")
+	}
+}
+
+func TestProxyIdentityProvisionsOnlyForTrustedPeers(t *testing.T) {
+	setupProxyAuthTest(t, true)
+	header := http.Header{}
+	header.Set("Remote-User", "dave")
+
+	if _, ok := ProxyIdentity(net.JoinHostPort("203.0.113.5", "40000"), header); ok {
+		t.Fatalf("expected an untrusted peer to be ignored")
+	}
+	if _, err := os.Stat(filepath.Join(config.UsersDir, "dave.json")); !os.IsNotExist(err) {
+		t.Fatalf("expected an untrusted peer not to provision an account")
+	}
+	if u, ok := ProxyIdentity(net.JoinHostPort("10.0.0.5", "40000"), header); !ok || u.Username != "dave" {
+		t.Fatalf("expected the trusted proxy to provision dave, got %+v %v", u, ok)
+	}
+}
+
+func TestAuthMiddlewareIgnoresProxyHeaderFromUntrustedPeers(t *testing.T) {
+	setupProxyAuthTest(t, false)
+
+	r := gin.New()
+	r.GET("/me", AuthMiddleware(), func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString("username"))
+	})
+	request := func(peer string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/me", nil)
+		req.RemoteAddr = net.JoinHostPort(peer, "40000")
+		req.Header.Set("Remote-User", "bob")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := request("10.0.0.5"); w.Code != http.StatusOK || w.Body.String() != "bob" {
+		t.Fatalf("expected the trusted proxy to authenticate bob, got %d %s", w.Code, w.Body.String())
+	}
+	if w := request("203.0.113.5"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected the header of an untrusted peer to be ignored, got %d", w.Code)
+	}
+}
@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/utils"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// revocationState invalidates session tokens before they expire. Bumping the
+// token version of a user kills every token issued to them; revoking a
+// session kills the access tokens of one login until they would expire anyway.
+type revocationState struct {
+	TokenVersions   map[string]int   `json:"tokenVersions"`
+	RevokedSessions map[string]int64 `json:"revokedSessions"` // Session ID -> unix time the entry can be dropped
+}
+
+var (
+	revocations   *revocationState
+	revocationsMu sync.Mutex
+)
+
+func getRevocationsFile() string {
+	return filepath.Join(config.DataDir, "revocations.json")
+}
+
+func loadRevocationsLocked() {
+	if revocations != nil {
+		return
+	}
+	revocations = &revocationState{}
+	utils.ReadJSON(getRevocationsFile(), revocations)
+	if revocations.TokenVersions == nil {
+		revocations.TokenVersions = make(map[string]int)
+	}
+	if revocations.RevokedSessions == nil {
+		revocations.RevokedSessions = make(map[string]int64)
+	}
+}
+
+func saveRevocationsLocked() {
+	now := time.Now().Unix()
+	for id, until := range revocations.RevokedSessions {
+		if until < now {
+			delete(revocations.RevokedSessions, id)
+		}
+	}
+	if err := utils.WriteJSON(getRevocationsFile(), revocations); err != nil {
+		log.Printf("Failed to save token revocations: %v", err)
+	}
+}
+
+// TokenVersion returns the version new tokens of username must carry.
+func TokenVersion(username string) int {
+	revocationsMu.Lock()
+	defer revocationsMu.Unlock()
+	loadRevocationsLocked()
+	return revocations.TokenVersions[username]
+}
+
+// RevokeUserTokens invalidates every token issued to username so far.
+func RevokeUserTokens(username string) {
+	revocationsMu.Lock()
+	defer revocationsMu.Unlock()
+	loadRevocationsLocked()
+	revocations.TokenVersions[username]++
+	saveRevocationsLocked()
+}
+
+// RevokeSession invalidates the access tokens of a session. until should be
+// the latest expiry of any access token issued for it.
+func RevokeSession(sessionID string, until time.Time) {
+	if sessionID == "" {
+		return
+	}
+	revocationsMu.Lock()
+	defer revocationsMu.Unlock()
+	loadRevocationsLocked()
+	revocations.RevokedSessions[sessionID] = until.Unix()
+	saveRevocationsLocked()
+}
+
+// isRevoked checks the version and session carried by session claims. Tokens
+// issued before revocation existed carry neither and count as version 0.
+func isRevoked(claims jwt.MapClaims) bool {
+	username, _ := claims["username"].(string)
+	version := 0
+	if v, ok := claims["tv"].(float64); ok {
+		version = int(v)
+	}
+	sessionID, _ := claims["sid"].(string)
+
+	revocationsMu.Lock()
+	defer revocationsMu.Unlock()
+	loadRevocationsLocked()
+	if revocations.TokenVersions[username] != version {
+		return true
+	}
+	if sessionID != "" {
+		if until, ok := revocations.RevokedSessions[sessionID]; ok && until >= time.Now().Unix() {
+			return true
+		}
+	}
+	return false
+}
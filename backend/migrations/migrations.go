@@ -0,0 +1,196 @@
+// Package migrations upgrades the documents of the data directory from the
+// layout older releases wrote to the current one. Every document carries
+// the schemaVersion it was written with; a document without one is at
+// version 0.
+package migrations
+
+import (
+	"encoding/json"
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/storage"
+	"flatnasgo-backend/utils"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Kinds of documents with a schema of their own.
+const (
+	System = "system"
+	User   = "user"
+)
+
+// VersionKey is the field holding the schema version of a document.
+const VersionKey = "schemaVersion"
+
+// ErrNewerSchema is returned for documents written by a newer release,
+// which this one would damage by rewriting them.
+var ErrNewerSchema = errors.New("document was written by a newer version of FlatNas")
+
+// Migration upgrades a document from the version before Version to Version.
+// Steps have to leave documents alone that already have the new layout, as
+// clients may send current data without a version.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(doc map[string]interface{}) error
+}
+
+// registry lists the migrations of every kind, in version order. New steps
+// are only ever appended.
+var registry = map[string][]Migration{
+	System: {
+		{1, "back-fill authMode, enableDocker and allowRegistration", backfillSystemDefaults},
+	},
+	User: {
+		{1, "move legacy top-level items into a group", groupLegacyItems},
+		{2, "hash plaintext passwords", hashPlaintextPassword},
+	},
+}
+
+// Latest returns the schema version documents of kind are written with.
+func Latest(kind string) int {
+	steps := registry[kind]
+	if len(steps) == 0 {
+		return 0
+	}
+	return steps[len(steps)-1].Version
+}
+
+// Version returns the schema version of doc.
+func Version(doc map[string]interface{}) int {
+	switch v := doc[VersionKey].(type) {
+	case float64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
+
+// Upgrade applies the migrations of kind that doc has not seen yet, in
+// order, and stamps it with the latest version. It reports whether doc
+// was at an older version.
+func Upgrade(kind string, doc map[string]interface{}) (bool, error) {
+	from := Version(doc)
+	latest := Latest(kind)
+	if from > latest {
+		return false, fmt.Errorf("%w: schema version %d, supported up to %d", ErrNewerSchema, from, latest)
+	}
+	if from == latest {
+		return false, nil
+	}
+	for _, m := range registry[kind] {
+		if m.Version <= from {
+			continue
+		}
+		if err := m.Up(doc); err != nil {
+			return false, fmt.Errorf("migration %d (%s): %w", m.Version, m.Description, err)
+		}
+	}
+	doc[VersionKey] = latest
+	return true, nil
+}
+
+// Run upgrades the system config and every dashboard at startup. Files a
+// migration changes are copied to a backup directory first. A dashboard
+// that can not be upgraded is logged and left as it is, so one damaged or
+// newer file does not keep the server from starting; only a failure of
+// the system config is returned.
+func Run() error {
+	backupDir := filepath.Join(config.MigrationBackupsDir, time.Now().Format("20060102-150405"))
+	files := []struct{ kind, path string }{
+		{System, config.SystemConfigFile},
+		{User, filepath.Join(config.DataDir, "data.json")},
+	}
+	names, err := storage.ReadDir(config.UsersDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, name := range names {
+		if strings.HasSuffix(name, ".json") {
+			files = append(files, struct{ kind, path string }{User, filepath.Join(config.UsersDir, name)})
+		}
+	}
+	for _, f := range files {
+		err := upgradeFile(f.kind, f.path, backupDir)
+		switch {
+		case err == nil:
+		case f.kind == System:
+			return fmt.Errorf("%s: %w", f.path, err)
+		default:
+			log.Printf("Skipping migration of %s: %v", f.path, err)
+		}
+	}
+	return nil
+}
+
+// upgradeFile upgrades the document at path in place. A document that only
+// gets its version stamped is not backed up, nothing of it is lost.
+func upgradeFile(kind, path, backupDir string) error {
+	return utils.WithFileLock(path, func() error {
+		original, err := storage.ReadFile(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(original, &doc); err != nil {
+			return err
+		}
+		if doc == nil {
+			return nil
+		}
+		from := Version(doc)
+		var before map[string]interface{}
+		json.Unmarshal(original, &before)
+
+		changed, err := Upgrade(kind, doc)
+		if err != nil || !changed {
+			return err
+		}
+		if !sameContent(before, doc) {
+			if err := backup(path, original, backupDir); err != nil {
+				return err
+			}
+			log.Printf("Upgraded %s from schema version %d to %d", path, from, Latest(kind))
+		}
+		return utils.WriteJSONUnlocked(path, doc)
+	})
+}
+
+// sameContent reports whether two versions of a document differ in nothing
+// but their schema version.
+func sameContent(a, b map[string]interface{}) bool {
+	strip := func(doc map[string]interface{}) map[string]interface{} {
+		copied := make(map[string]interface{}, len(doc))
+		for k, v := range doc {
+			if k != VersionKey {
+				copied[k] = v
+			}
+		}
+		return copied
+	}
+	return reflect.DeepEqual(strip(a), strip(b))
+}
+
+// backup keeps the original of the document at path below dir, under the
+// same path relative to the data directory.
+func backup(path string, original []byte, dir string) error {
+	rel, err := filepath.Rel(config.DataDir, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(path)
+	}
+	target := filepath.Join(dir, rel)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(target, original, 0600)
+}
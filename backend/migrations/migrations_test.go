@@ -0,0 +1,108 @@
+package migrations
+
+import (
+	"errors"
+	"flatnasgo-backend/config"
+	"flatnasgo-backend/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunUpgradesDocumentsAndKeepsBackups(t *testing.T) {
+	config.DataDir = t.TempDir()
+	config.UsersDir = filepath.Join(config.DataDir, "users")
+	config.SystemConfigFile = filepath.Join(config.DataDir, "system.json")
+	config.MigrationBackupsDir = filepath.Join(config.DataDir, "migration-backups")
+	os.MkdirAll(config.UsersDir, 0755)
+
+	utils.WriteJSON(config.SystemConfigFile, map[string]interface{}{"authMode": "multi"})
+	utils.WriteJSON(filepath.Join(config.UsersDir, "alice.json"), map[string]interface{}{
+		"username": "alice",
+		"password": "secret",
+		"items":    []interface{}{map[string]interface{}{"id": "i1", "title": "Router"}},
+		"custom":   "kept",
+	})
+	utils.WriteJSON(filepath.Join(config.UsersDir, "bob.json"), map[string]interface{}{
+		"username": "bob",
+		"groups":   []interface{}{},
+	})
+
+	if err := Run(); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+
+	var system map[string]interface{}
+	utils.ReadJSON(config.SystemConfigFile, &system)
+	if system["authMode"] != "multi" || system["enableDocker"] != true || system["allowRegistration"] != false || Version(system) != Latest(System) {
+		t.Fatalf("system config was not upgraded: %v", system)
+	}
+
+	var alice map[string]interface{}
+	utils.ReadJSON(filepath.Join(config.UsersDir, "alice.json"), &alice)
+	groups, _ := alice["groups"].([]interface{})
+	if _, hasItems := alice["items"]; hasItems || len(groups) != 1 || Version(alice) != Latest(User) {
+		t.Fatalf("legacy items were not grouped: %v", alice)
+	}
+	if password, _ := alice["password"].(string); !utils.CheckPasswordHash("secret", password) || alice["custom"] != "kept" {
+		t.Fatalf("unexpected upgraded document %v", alice)
+	}
+
+	// Only documents whose content changed are backed up
+	backups, _ := filepath.Glob(filepath.Join(config.MigrationBackupsDir, "*", "users", "*.json"))
+	if len(backups) != 1 || filepath.Base(backups[0]) != "alice.json" {
+		t.Fatalf("unexpected backups %v", backups)
+	}
+	original, _ := os.ReadFile(backups[0])
+	if !strings.Contains(string(original), `"password": "secret"`) {
+		t.Fatalf("backup does not hold the original: %s", original)
+	}
+
+	// A second run has nothing left to do
+	if err := Run(); err != nil {
+		t.Fatalf("second run failed: %v", err)
+	}
+	if runs, _ := os.ReadDir(config.MigrationBackupsDir); len(runs) != 1 {
+		t.Fatalf("expected one backup run, got %d", len(runs))
+	}
+
+	newer := map[string]interface{}{VersionKey: float64(Latest(User) + 1)}
+	if _, err := Upgrade(User, newer); !errors.Is(err, ErrNewerSchema) {
+		t.Fatalf("expected newer document to be refused, got %v", err)
+	}
+}
+
+func TestRunSkipsUnreadableUserDocuments(t *testing.T) {
+	config.DataDir = t.TempDir()
+	config.UsersDir = filepath.Join(config.DataDir, "users")
+	config.SystemConfigFile = filepath.Join(config.DataDir, "system.json")
+	config.MigrationBackupsDir = filepath.Join(config.DataDir, "migration-backups")
+	os.MkdirAll(config.UsersDir, 0755)
+
+	utils.WriteJSON(config.SystemConfigFile, map[string]interface{}{"authMode": "multi"})
+	os.WriteFile(filepath.Join(config.UsersDir, "broken.json"), []byte("{not json"), 0644)
+	newer := map[string]interface{}{"username": "newer", VersionKey: float64(Latest(User) + 1)}
+	utils.WriteJSON(filepath.Join(config.UsersDir, "newer.json"), newer)
+	utils.WriteJSON(filepath.Join(config.UsersDir, "carol.json"), map[string]interface{}{"username": "carol", "password": "secret"})
+
+	if err := Run(); err != nil {
+		t.Fatalf("expected damaged dashboards to be skipped, got %v", err)
+	}
+	var carol map[string]interface{}
+	utils.ReadJSON(filepath.Join(config.UsersDir, "carol.json"), &carol)
+	if Version(carol) != Latest(User) {
+		t.Fatalf("remaining dashboards were not upgraded: %v", carol)
+	}
+	var kept map[string]interface{}
+	utils.ReadJSON(filepath.Join(config.UsersDir, "newer.json"), &kept)
+	if Version(kept) != Latest(User)+1 {
+		t.Fatalf("newer dashboard was rewritten: %v", kept)
+	}
+
+	// The system config is required
+	os.WriteFile(config.SystemConfigFile, []byte("{not json"), 0644)
+	if err := Run(); err == nil {
+		t.Fatalf("expected a damaged system config to fail")
+	}
+}
@@ -0,0 +1,65 @@
+package migrations
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flatnasgo-backend/utils"
+	"strings"
+)
+
+// backfillSystemDefaults adds the keys configs from before they existed
+// lack. Their zero values would mean something else than the defaults.
+func backfillSystemDefaults(doc map[string]interface{}) error {
+	if v, ok := doc["authMode"].(string); !ok || strings.TrimSpace(v) == "" {
+		doc["authMode"] = "single"
+	}
+	if _, ok := doc["enableDocker"].(bool); !ok {
+		doc["enableDocker"] = true
+	}
+	if _, ok := doc["allowRegistration"].(bool); !ok {
+		doc["allowRegistration"] = false
+	}
+	return nil
+}
+
+// groupLegacyItems moves the items of dashboards from before groups into a
+// group of their own, the way the frontend showed them. Next to groups the
+// old list is stale and dropped, else deleting every group would bring it
+// back.
+func groupLegacyItems(doc map[string]interface{}) error {
+	items, hasItems := doc["items"]
+	if !hasItems {
+		return nil
+	}
+	delete(doc, "items")
+	if _, hasGroups := doc["groups"]; hasGroups {
+		return nil
+	}
+	list, _ := items.([]interface{})
+	if len(list) == 0 {
+		return nil
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	doc["groups"] = []interface{}{
+		map[string]interface{}{"id": hex.EncodeToString(id), "title": "默认分组", "items": list},
+	}
+	return nil
+}
+
+// hashPlaintextPassword replaces a password stored in plain text by its
+// hash. An empty password keeps meaning the default one.
+func hashPlaintextPassword(doc map[string]interface{}) error {
+	password, _ := doc["password"].(string)
+	if password == "" || strings.HasPrefix(password, "$") {
+		return nil
+	}
+	hashed, err := utils.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	doc["password"] = hashed
+	return nil
+}
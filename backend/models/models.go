@@ -1,13 +1,61 @@
 package models
 
 type User struct {
-	Username      string    `json:"username"`
-	Password      string    `json:"password"` // Hashed
-	Groups        []Group   `json:"groups"`
-	Widgets       []Widget  `json:"widgets"`
-	AppConfig     AppConfig `json:"appConfig"`
-	RssFeeds      []any     `json:"rssFeeds"`      // Simplified for now
-	RssCategories []any     `json:"rssCategories"` // Simplified for now
+	SchemaVersion      int        `json:"schemaVersion,omitempty"` // See the migrations package
+	Username           string     `json:"username"`
+	Password           string     `json:"password"` // Hashed
+	Role               string     `json:"role,omitempty"`
+	Permissions        []string   `json:"permissions,omitempty"` // Extra grants on top of the role
+	TwoFactor          *TwoFactor `json:"twoFactor,omitempty"`
+	External           *External  `json:"external,omitempty"`           // Set for accounts linked to an identity provider
+	MustChangePassword bool       `json:"mustChangePassword,omitempty"` // Set by an admin reset, cleared by the next password change
+	WebAuthn           *WebAuthn  `json:"webauthn,omitempty"`
+	Disabled           bool       `json:"disabled,omitempty"`   // Set by an admin; the account can not sign in
+	PublicPage         bool       `json:"publicPage,omitempty"` // Public items and widgets are shown at /u/<username>
+	Groups             []Group    `json:"groups"`
+	Widgets            []Widget   `json:"widgets"`
+	AppConfig          AppConfig  `json:"appConfig"`
+	RssFeeds           []any      `json:"rssFeeds"`      // Simplified for now
+	RssCategories      []any      `json:"rssCategories"` // Simplified for now
+}
+
+// External links an account to a user of an external identity provider so
+// later logins match on the provider's stable ID rather than the username.
+type External struct {
+	Provider string `json:"provider"` // "oidc" or "ldap"
+	Issuer   string `json:"issuer"`
+	Subject  string `json:"subject"`
+	LinkedAt int64  `json:"linkedAt"`
+}
+
+type TwoFactor struct {
+	Enabled       bool     `json:"enabled"`
+	Secret        string   `json:"secret,omitempty"`        // Base32 TOTP secret
+	PendingSecret string   `json:"pendingSecret,omitempty"` // Set during enrollment until the first code is verified
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"` // SHA-256 hashes, removed once used
+	LastUsedStep  int64    `json:"lastUsedStep,omitempty"`  // Rejects replays of an accepted code
+	EnabledAt     int64    `json:"enabledAt,omitempty"`
+}
+
+// WebAuthn holds the passkeys of a user. UserID is the random user handle
+// given to authenticators, so passkeys survive a change of username.
+type WebAuthn struct {
+	UserID   string    `json:"userId"` // base64url
+	Passkeys []Passkey `json:"passkeys"`
+}
+
+type Passkey struct {
+	ID              string   `json:"id"` // Credential ID, base64url
+	Name            string   `json:"name"`
+	PublicKey       []byte   `json:"publicKey"` // COSE encoded
+	AttestationType string   `json:"attestationType,omitempty"`
+	Transports      []string `json:"transports,omitempty"`
+	AAGUID          []byte   `json:"aaguid,omitempty"`
+	SignCount       uint32   `json:"signCount"`
+	BackupEligible  bool     `json:"backupEligible"`
+	BackupState     bool     `json:"backupState"`
+	CreatedAt       int64    `json:"createdAt"`
+	LastUsed        int64    `json:"lastUsed,omitempty"`
 }
 
 type Group struct {
@@ -79,21 +127,138 @@ type WallpaperConfig struct {
 }
 
 type SystemConfig struct {
-	AuthMode          string `json:"authMode"` // "single" or "multi"
-	EnableDocker      bool   `json:"enableDocker"`
-	DockerHost        string `json:"dockerHost,omitempty"`
-	AllowRegistration bool   `json:"allowRegistration"`
+	SchemaVersion     int              `json:"schemaVersion,omitempty"` // See the migrations package
+	AuthMode          string           `json:"authMode"`                // "single" or "multi"
+	EnableDocker      bool             `json:"enableDocker"`
+	DockerHost        string           `json:"dockerHost,omitempty"`
+	AllowRegistration bool             `json:"allowRegistration"`
+	ProxyAuth         *ProxyAuthConfig `json:"proxyAuth,omitempty"`
+	OIDC              *OIDCConfig      `json:"oidc,omitempty"`
+	LDAP              *LDAPConfig      `json:"ldap,omitempty"`
+	WebAuthn          *WebAuthnConfig  `json:"webauthn,omitempty"`
+	PasswordPolicy    *PasswordPolicy  `json:"passwordPolicy,omitempty"`
+	Challenge         *ChallengeConfig `json:"challenge,omitempty"`
+	Network           *NetworkConfig   `json:"network,omitempty"`
+}
+
+// ProxyAuthConfig lets an authenticating reverse proxy (Authelia, Authentik,
+// ...) pass the signed in user in a header. The header is only trusted on
+// requests whose peer address is one of TrustedProxies.
+type ProxyAuthConfig struct {
+	Enabled        bool     `json:"enabled"`
+	Header         string   `json:"header"`         // e.g. "Remote-User", defaults to it when empty
+	TrustedProxies []string `json:"trustedProxies"` // CIDRs or single addresses
+	AutoProvision  bool     `json:"autoProvision"`  // Create unknown users on first sight
+	DefaultRole    string   `json:"defaultRole,omitempty"`
+}
+
+// OIDCConfig configures single sign-on with an OpenID Connect provider using
+// the authorization code flow with PKCE.
+type OIDCConfig struct {
+	Enabled       bool              `json:"enabled"`
+	Issuer        string            `json:"issuer"` // Discovery is read from <issuer>/.well-known/openid-configuration
+	ClientID      string            `json:"clientId"`
+	ClientSecret  string            `json:"clientSecret,omitempty"`
+	RedirectURL   string            `json:"redirectUrl"` // Must point to /api/oidc/callback
+	Scopes        []string          `json:"scopes,omitempty"`
+	UsernameClaim string            `json:"usernameClaim,omitempty"` // Defaults to preferred_username
+	GroupsClaim   string            `json:"groupsClaim,omitempty"`   // e.g. "groups", enables RoleMapping
+	RoleMapping   map[string]string `json:"roleMapping,omitempty"`   // Group -> role, the most privileged match wins
+	AutoProvision bool              `json:"autoProvision"`
+	DefaultRole   string            `json:"defaultRole,omitempty"`
+	LinkExisting  bool              `json:"linkExisting"` // Allow signing in to unlinked local accounts of the same name
+	ButtonText    string            `json:"buttonText,omitempty"`
+}
+
+// LDAPConfig lets Login check passwords against a directory. Users are found
+// with a search (as BindDN, or anonymously) and verified by binding as them.
+type LDAPConfig struct {
+	Enabled            bool              `json:"enabled"`
+	URL                string            `json:"url"` // ldap://host:389 or ldaps://host:636
+	StartTLS           bool              `json:"startTls"`
+	InsecureSkipVerify bool              `json:"insecureSkipVerify"`
+	BindDN             string            `json:"bindDn,omitempty"`
+	BindPassword       string            `json:"bindPassword,omitempty"`
+	BaseDN             string            `json:"baseDn"`
+	UserFilter         string            `json:"userFilter,omitempty"`     // {username} is replaced, defaults to (uid={username})
+	GroupAttribute     string            `json:"groupAttribute,omitempty"` // Defaults to memberOf
+	GroupBaseDN        string            `json:"groupBaseDn,omitempty"`    // With GroupFilter, search groups instead of reading GroupAttribute
+	GroupFilter        string            `json:"groupFilter,omitempty"`    // {dn} and {username} are replaced, e.g. (member={dn})
+	RoleMapping        map[string]string `json:"roleMapping,omitempty"`    // Group DN or CN -> role, the most privileged match wins
+	DefaultRole        string            `json:"defaultRole,omitempty"`
+}
+
+// WebAuthnConfig pins the relying party used for passkeys. When unset, the
+// RP ID and origin are taken from the Origin of each request, which must
+// match its Host.
+type WebAuthnConfig struct {
+	RPID    string   `json:"rpId,omitempty"`    // e.g. "nas.example.com"
+	Origins []string `json:"origins,omitempty"` // e.g. "https://nas.example.com"
+}
+
+// PasswordPolicy applies whenever a password is chosen: registration, a
+// change by the user and a reset by an admin. Existing passwords are not
+// checked again. Without a policy only empty passwords are rejected.
+type PasswordPolicy struct {
+	MinLength        int  `json:"minLength"` // Defaults to 8 once a policy is set
+	RequireUpper     bool `json:"requireUpper"`
+	RequireLower     bool `json:"requireLower"`
+	RequireDigit     bool `json:"requireDigit"`
+	RequireSymbol    bool `json:"requireSymbol"`
+	DisallowUsername bool `json:"disallowUsername"` // Reject passwords containing the username
+}
+
+// ChallengeConfig controls the proof-of-work puzzle the public login,
+// registration and visitor endpoints ask for.
+type ChallengeConfig struct {
+	Enabled       bool `json:"enabled"`       // Always require a solved puzzle
+	AfterFailures int  `json:"afterFailures"` // Require one after this many failed attempts from a client IP, 0 for never
+	Difficulty    int  `json:"difficulty"`    // Leading zero bits of the hash, defaults to 16
+}
+
+// Route groups a NetworkConfig allowlist can restrict.
+const (
+	NetworkGroupUsers   = "users"   // User, invite, session and token management
+	NetworkGroupSystem  = "system"  // System config, signing keys, audit log
+	NetworkGroupDocker  = "docker"  // Container listing and control
+	NetworkGroupScripts = "scripts" // Saving custom scripts
+)
+
+// NetworkConfig decides which client addresses are believed and where the
+// privileged APIs may be reached from. The public dashboard is never
+// restricted.
+type NetworkConfig struct {
+	TrustedProxies []string            `json:"trustedProxies,omitempty"` // Peers whose X-Forwarded-For is believed; loopback only when empty
+	Allowlists     map[string][]string `json:"allowlists,omitempty"`     // Route group to CIDRs or single addresses; a group without entries is open
 }
 
 type InviteCode struct {
-	Code        string `json:"code"`
-	CreatedBy   string `json:"createdBy"`   // Admin username who created it
-	CreatedAt   int64  `json:"createdAt"`   // Unix timestamp
-	MaxUses     int    `json:"maxUses"`     // 0 means unlimited
-	UsedCount   int    `json:"usedCount"`   // How many times it has been used
-	ExpiresAt   int64  `json:"expiresAt"`   // 0 means never expires
-	IsActive    bool   `json:"isActive"`    // Can be deactivated
-	Description string `json:"description"` // Optional description
+	Code        string             `json:"code"`
+	CreatedBy   string             `json:"createdBy"`          // Admin username who created it
+	CreatedAt   int64              `json:"createdAt"`          // Unix timestamp
+	MaxUses     int                `json:"maxUses"`            // 0 means unlimited
+	UsedCount   int                `json:"usedCount"`          // How many times it has been used
+	ExpiresAt   int64              `json:"expiresAt"`          // 0 means never expires
+	IsActive    bool               `json:"isActive"`           // Can be deactivated
+	Description string             `json:"description"`        // Optional description
+	Role        string             `json:"role,omitempty"`     // Role of accounts registered with the code
+	Template    string             `json:"template,omitempty"` // "default", a config version ID, or empty for a blank dashboard
+	RedeemedBy  []InviteRedemption `json:"redeemedBy,omitempty"`
+}
+
+type InviteRedemption struct {
+	Username   string `json:"username"`
+	RedeemedAt int64  `json:"redeemedAt"`
+}
+
+// AuditEntry is one line of the audit log.
+type AuditEntry struct {
+	Time     int64                  `json:"time"` // Unix milliseconds
+	Action   string                 `json:"action"`
+	Username string                 `json:"username,omitempty"` // Who acted, empty for anonymous requests
+	Target   string                 `json:"target,omitempty"`   // The user, code or container acted on
+	IP       string                 `json:"ip,omitempty"`
+	Details  map[string]interface{} `json:"details,omitempty"`
 }
 
 type LoginRequest struct {
@@ -101,6 +266,53 @@ type LoginRequest struct {
 	Password string `json:"password"`
 }
 
+type LoginAttempt struct {
+	Key         string `json:"key"`         // "user:<name>" or "ip:<address>"
+	Failures    int    `json:"failures"`    // Consecutive failures since the last success
+	LastFailure int64  `json:"lastFailure"` // Unix timestamp
+	LockedUntil int64  `json:"lockedUntil"` // Unix timestamp, 0 when not locked
+}
+
+// Session is a login backed by a rotating refresh token.
+type Session struct {
+	ID           string `json:"id"`
+	Username     string `json:"username"`
+	TokenHash    string `json:"tokenHash"`              // SHA-256 of the current refresh token
+	PreviousHash string `json:"previousHash,omitempty"` // Rotated-out token, presenting it again revokes the session
+	CreatedAt    int64  `json:"createdAt"`
+	LastSeen     int64  `json:"lastSeen"`
+	ExpiresAt    int64  `json:"expiresAt"`
+	IP           string `json:"ip"`
+	UserAgent    string `json:"userAgent"`
+}
+
+// APIToken is a long lived personal access token. Only the SHA-256 of the
+// token is stored; its scopes are permissions the owner held when creating it.
+type APIToken struct {
+	ID        string   `json:"id"`
+	Username  string   `json:"username"`
+	Name      string   `json:"name"`
+	Prefix    string   `json:"prefix"` // First characters of the token, to tell tokens apart
+	TokenHash string   `json:"tokenHash,omitempty"`
+	Scopes    []string `json:"scopes"`
+	CreatedAt int64    `json:"createdAt"`
+	LastUsed  int64    `json:"lastUsed,omitempty"`
+	ExpiresAt int64    `json:"expiresAt,omitempty"` // 0 means the token does not expire
+}
+
+// ShareLink is a read-only link to some groups and widgets of a dashboard.
+// The link carries a signed token; deleting the record revokes it.
+type ShareLink struct {
+	ID           string   `json:"id"`
+	Username     string   `json:"username"` // Owner of the shared dashboard
+	Name         string   `json:"name,omitempty"`
+	Groups       []string `json:"groups"`
+	Widgets      []string `json:"widgets"`
+	PasswordHash string   `json:"passwordHash,omitempty"`
+	CreatedAt    int64    `json:"createdAt"`
+	ExpiresAt    int64    `json:"expiresAt"`
+}
+
 type VisitorStats struct {
 	TotalVisitors int64  `json:"totalVisitors"`
 	TodayVisitors int64  `json:"todayVisitors"`
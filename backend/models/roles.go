@@ -0,0 +1,114 @@
+package models
+
+const (
+	RoleAdmin    = "admin"
+	RoleOperator = "operator"
+	RoleMember   = "member"
+	RoleViewer   = "viewer"
+)
+
+const (
+	PermDataRead      = "data:read"
+	PermDataWrite     = "data:write"
+	PermTransferRead  = "transfer:read"
+	PermTransferWrite = "transfer:write"
+	PermFilesManage   = "files:manage" // Delete uploads and backgrounds owned by other users
+	PermDockerRead    = "docker:read"
+	PermDockerControl = "docker:control"
+	PermUsersManage   = "users:manage"
+	PermInvitesManage = "invites:manage"
+	PermSystemManage  = "system:manage"
+)
+
+var AllPermissions = []string{
+	PermDataRead,
+	PermDataWrite,
+	PermTransferRead,
+	PermTransferWrite,
+	PermFilesManage,
+	PermDockerRead,
+	PermDockerControl,
+	PermUsersManage,
+	PermInvitesManage,
+	PermSystemManage,
+}
+
+var RolePermissions = map[string][]string{
+	RoleAdmin: AllPermissions,
+	RoleOperator: {
+		PermDataRead, PermDataWrite,
+		PermTransferRead, PermTransferWrite,
+		PermDockerRead, PermDockerControl,
+	},
+	RoleMember: {
+		PermDataRead, PermDataWrite,
+		PermTransferRead, PermTransferWrite,
+		PermDockerRead,
+	},
+	RoleViewer: {
+		PermDataRead,
+		PermTransferRead,
+		PermDockerRead,
+	},
+}
+
+// Roles lists the built-in roles from most to least privileged.
+var Roles = []string{RoleAdmin, RoleOperator, RoleMember, RoleViewer}
+
+// MostPrivilegedRole returns the role of candidates that grants the most,
+// or "" when none is valid.
+func MostPrivilegedRole(candidates []string) string {
+	for _, role := range Roles {
+		for _, c := range candidates {
+			if c == role {
+				return role
+			}
+		}
+	}
+	return ""
+}
+
+func IsValidRole(role string) bool {
+	_, ok := RolePermissions[role]
+	return ok
+}
+
+func IsValidPermission(perm string) bool {
+	for _, p := range AllPermissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// EffectiveRole resolves the role of a user record. Records written before
+// roles existed have no role: the built-in admin account stays admin and
+// everybody else becomes a member.
+func EffectiveRole(username, role string) string {
+	if IsValidRole(role) {
+		return role
+	}
+	if username == "admin" {
+		return RoleAdmin
+	}
+	return RoleMember
+}
+
+// EffectivePermissions merges the permissions granted by the role with the
+// extra per-user grants, dropping unknown and duplicate entries.
+func EffectivePermissions(role string, extra []string) []string {
+	seen := make(map[string]struct{})
+	perms := make([]string, 0, len(AllPermissions))
+	for _, p := range append(append([]string{}, RolePermissions[role]...), extra...) {
+		if !IsValidPermission(p) {
+			continue
+		}
+		if _, ok := seen[p]; ok {
+			continue
+		}
+		seen[p] = struct{}{}
+		perms = append(perms, p)
+	}
+	return perms
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"flatnasgo-backend/handlers"
+	"flatnasgo-backend/middleware"
+	"flatnasgo-backend/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// registerAPIRoutes adds every route of the HTTP API to api.
+func registerAPIRoutes(api *gin.RouterGroup) {
+	api.POST("/login", handlers.Login)
+	api.POST("/login/2fa", handlers.LoginTwoFactor)
+	api.POST("/login/password", handlers.LoginChangePassword)
+	api.POST("/login/passkey/begin", handlers.BeginPasskeyLogin)
+	api.POST("/login/passkey/finish", handlers.FinishPasskeyLogin)
+	api.POST("/login/proxy", handlers.ProxyLogin)
+	api.GET("/oidc/login", handlers.OIDCLogin)
+	api.GET("/oidc/callback", handlers.OIDCCallback)
+	api.POST("/oidc/exchange", handlers.OIDCExchange)
+	api.POST("/token/refresh", handlers.RefreshToken)
+	api.POST("/logout", middleware.OptionalAuthMiddleware(), handlers.Logout)
+	api.POST("/register", handlers.Register)
+	api.GET("/challenge", handlers.GetChallenge)
+	api.GET("/data", middleware.OptionalAuthMiddleware(), handlers.GetData)
+	api.GET("/public/:username/data", handlers.GetPublicData)
+	api.GET("/share/:token/data", handlers.GetShareData)
+	api.GET("/system-config", middleware.OptionalAuthMiddleware(), handlers.GetSystemConfig)
+	api.GET("/ip", handlers.GetIP)                                                             // Added GetIP
+	api.GET("/weather", handlers.GetWeather)                                                   // Added Weather
+	api.GET("/custom-scripts", middleware.OptionalAuthMiddleware(), handlers.GetCustomScripts) // Added Custom Scripts
+	api.GET("/docker-status", handlers.GetDockerStatus)                                        // Added Docker Status
+	api.GET("/docker/debug", handlers.GetDockerDebug)
+	api.GET("/config/proxy-status", handlers.GetProxyStatus)
+
+	// Icon Routes
+	api.GET("/ali-icons", handlers.GetAliIcons)
+	api.GET("/get-icon-base64", handlers.GetIconBase64)
+
+	// Amap Proxy Routes
+	api.GET("/amap/weather", handlers.ProxyAmapWeather)
+	api.GET("/amap/ip", handlers.ProxyAmapIP)
+
+	api.GET("/ping", handlers.Ping)                   // Added Ping
+	api.GET("/rtt", handlers.RTT)                     // Added RTT for frontend latency check
+	api.GET("/lucky/stun", handlers.LuckyStun)        // Added STUN server information
+	api.POST("/visitor/track", handlers.TrackVisitor) // Public endpoint
+	api.GET("/transfer/file/:filename", middleware.OptionalAuthMiddleware(), handlers.ServeFile)
+	api.GET("/transfer/items", handlers.GetTransferItems)
+	api.GET("/music-list", handlers.GetMusicList) // Added Music List
+
+	// Protected Routes
+	registerProtectedRoutes(api.Group("/", middleware.AuthMiddleware()))
+}
+
+// registerProtectedRoutes adds the routes that need a login. Every route
+// checks the permission or session it needs, since authorized also accepts
+// personal access tokens limited to their scopes.
+func registerProtectedRoutes(authorized *gin.RouterGroup) {
+	canReadData := middleware.RequirePermission(models.PermDataRead)
+	canWriteData := middleware.RequirePermission(models.PermDataWrite)
+	canReadTransfer := middleware.RequirePermission(models.PermTransferRead)
+	canWriteTransfer := middleware.RequirePermission(models.PermTransferWrite)
+	canReadDocker := middleware.RequirePermission(models.PermDockerRead)
+	canControlDocker := middleware.RequirePermission(models.PermDockerControl)
+	canManageUsers := middleware.RequirePermission(models.PermUsersManage)
+	canManageInvites := middleware.RequirePermission(models.PermInvitesManage)
+	canManageSystem := middleware.RequirePermission(models.PermSystemManage)
+	sessionOnly := middleware.RequireSession()
+
+	// Privileged routes are only reachable from the networks allowed for their group
+	userAdmin := authorized.Group("/", middleware.RequireNetwork(models.NetworkGroupUsers))
+	systemAdmin := authorized.Group("/", middleware.RequireNetwork(models.NetworkGroupSystem))
+	dockerAdmin := authorized.Group("/", middleware.RequireNetwork(models.NetworkGroupDocker))
+	scriptsAdmin := authorized.Group("/", middleware.RequireNetwork(models.NetworkGroupScripts))
+
+	// Widget Data
+	authorized.GET("/widgets/:id", canReadData, handlers.GetWidget)
+
+	// Dashboard Groups, Items and Widgets
+	authorized.GET("/groups", canReadData, handlers.GetGroups)
+	authorized.POST("/groups", canWriteData, handlers.CreateGroup)
+	authorized.PUT("/groups/order", canWriteData, handlers.ReorderGroups)
+	authorized.PATCH("/groups/:id", canWriteData, handlers.UpdateGroup)
+	authorized.DELETE("/groups/:id", canWriteData, handlers.DeleteGroup)
+	authorized.POST("/groups/:id/items", canWriteData, handlers.CreateGroupItem)
+	authorized.PATCH("/groups/:id/items/:itemId", canWriteData, handlers.UpdateGroupItem)
+	authorized.DELETE("/groups/:id/items/:itemId", canWriteData, handlers.DeleteGroupItem)
+	authorized.POST("/groups/:id/items/:itemId/move", canWriteData, handlers.MoveGroupItem)
+	authorized.GET("/widgets", canReadData, handlers.GetWidgets)
+	authorized.POST("/widgets", canWriteData, handlers.CreateWidget)
+	authorized.PATCH("/widgets/:id", canWriteData, handlers.UpdateWidget)
+	authorized.DELETE("/widgets/:id", canWriteData, handlers.DeleteWidget)
+	authorized.PUT("/widgets/:id/layouts/:name", canWriteData, handlers.SetWidgetLayout)
+	authorized.DELETE("/widgets/:id/layouts/:name", canWriteData, handlers.DeleteWidgetLayout)
+
+	// User Management
+	userAdmin.GET("/admin/users", canManageUsers, handlers.GetUsers)
+	userAdmin.POST("/admin/users", canManageUsers, handlers.AddUser)
+	userAdmin.PUT("/admin/users/:usr", canManageUsers, handlers.UpdateUser)
+	userAdmin.DELETE("/admin/users/:usr", canManageUsers, handlers.DeleteUser)
+	userAdmin.POST("/admin/users/:usr/rename", canManageUsers, handlers.RenameUser)
+	userAdmin.DELETE("/admin/users/:usr/2fa", canManageUsers, handlers.ResetUserTwoFactor)
+	userAdmin.POST("/admin/users/:usr/password", canManageUsers, handlers.ResetUserPassword)
+	userAdmin.GET("/admin/lockouts", canManageUsers, handlers.GetLoginLockouts)
+	userAdmin.DELETE("/admin/lockouts", canManageUsers, handlers.ClearLoginLockout)
+	userAdmin.DELETE("/admin/lockouts/:key", canManageUsers, handlers.ClearLoginLockout)
+	systemAdmin.POST("/admin/license", canManageSystem, handlers.UploadLicense)
+	systemAdmin.GET("/admin/keys", canManageSystem, handlers.GetSigningKeys)
+	systemAdmin.GET("/admin/audit", canManageSystem, handlers.GetAuditLog)
+	systemAdmin.POST("/admin/keys/rotate", canManageSystem, handlers.RotateSigningKeys)
+
+	// Sessions
+	authorized.GET("/sessions", sessionOnly, handlers.GetSessions)
+	authorized.DELETE("/sessions", sessionOnly, handlers.RevokeOtherSessions)
+	authorized.DELETE("/sessions/:id", sessionOnly, handlers.RevokeSession)
+	userAdmin.GET("/admin/sessions", canManageUsers, handlers.GetAllSessions)
+	userAdmin.DELETE("/admin/sessions/:id", canManageUsers, handlers.AdminRevokeSession)
+
+	// Personal API Tokens
+	authorized.GET("/tokens", sessionOnly, handlers.GetAPITokens)
+	authorized.POST("/tokens", sessionOnly, handlers.CreateAPIToken)
+	authorized.DELETE("/tokens/:id", sessionOnly, handlers.DeleteAPIToken)
+	userAdmin.GET("/admin/tokens", canManageUsers, handlers.GetAllAPITokens)
+	userAdmin.DELETE("/admin/tokens/:id", canManageUsers, handlers.AdminDeleteAPIToken)
+
+	// Personal Data Export
+	authorized.GET("/export", sessionOnly, handlers.ExportUserData)
+
+	// Public Page
+	authorized.PUT("/public-page", canWriteData, handlers.SetPublicPage)
+
+	// Share Links
+	authorized.GET("/shares", canReadData, handlers.GetShares)
+	authorized.POST("/shares", canWriteData, handlers.CreateShare)
+	authorized.DELETE("/shares/:id", canWriteData, handlers.DeleteShare)
+	userAdmin.GET("/admin/shares", canManageUsers, handlers.GetAllShares)
+	userAdmin.DELETE("/admin/shares/:id", canManageUsers, handlers.AdminDeleteShare)
+
+	// Password
+	authorized.POST("/password", sessionOnly, handlers.ChangePassword)
+
+	// Two-Factor Authentication
+	authorized.GET("/2fa/status", sessionOnly, handlers.GetTwoFactorStatus)
+	authorized.POST("/2fa/setup", sessionOnly, handlers.SetupTwoFactor)
+	authorized.POST("/2fa/enable", sessionOnly, handlers.EnableTwoFactor)
+	authorized.POST("/2fa/disable", sessionOnly, handlers.DisableTwoFactor)
+	authorized.POST("/2fa/recovery-codes", sessionOnly, handlers.RegenerateRecoveryCodes)
+	authorized.GET("/passkeys", sessionOnly, handlers.GetPasskeys)
+	authorized.POST("/passkeys/register/begin", sessionOnly, handlers.BeginPasskeyRegistration)
+	authorized.POST("/passkeys/register/finish", sessionOnly, handlers.FinishPasskeyRegistration)
+	authorized.DELETE("/passkeys/:id", sessionOnly, handlers.DeletePasskey)
+
+	// Invite Code Management
+	userAdmin.GET("/admin/invite-codes", canManageInvites, handlers.GetInviteCodes)
+	userAdmin.POST("/admin/invite-codes", canManageInvites, handlers.GenerateInviteCode)
+	userAdmin.PATCH("/admin/invite-codes/:code", canManageInvites, handlers.UpdateInviteCode)
+	userAdmin.DELETE("/admin/invite-codes/:code", canManageInvites, handlers.DeleteInviteCode)
+
+	authorized.POST("/save", canWriteData, handlers.SaveData)                        // Added SaveData
+	systemAdmin.POST("/system-config", canManageSystem, handlers.UpdateSystemConfig) // Added SystemConfig Update
+	authorized.POST("/data/import", canWriteData, handlers.ImportData)               // Added ImportData
+	systemAdmin.POST("/default/save", canManageSystem, handlers.SaveDefault)
+	authorized.POST("/reset", canWriteData, handlers.ResetData)
+	authorized.GET("/system/stats", canReadData, handlers.GetSystemStats)
+	dockerAdmin.GET("/docker/containers", canReadDocker, handlers.ListContainers)
+	dockerAdmin.GET("/docker/info", canReadDocker, handlers.GetDockerInfo)
+	dockerAdmin.GET("/docker/export-logs", canReadDocker, handlers.ExportDockerLogs)
+	dockerAdmin.GET("/docker/container/:id/inspect-lite", canReadDocker, handlers.ContainerInspectLite)
+	dockerAdmin.POST("/docker/check-updates", canControlDocker, handlers.TriggerUpdateCheck)
+	dockerAdmin.POST("/docker/container/:id/:action", canControlDocker, handlers.ContainerAction)
+	scriptsAdmin.POST("/custom-scripts", canWriteData, handlers.SaveCustomScripts)
+
+	// Wallpaper
+	authorized.GET("/wallpaper/proxy", canReadData, handlers.ProxyWallpaper)
+	authorized.POST("/wallpaper/resolve", canReadData, handlers.ResolveWallpaper)
+	authorized.POST("/wallpaper/fetch", canWriteData, handlers.FetchWallpaper)
+
+	// Backgrounds Management
+	authorized.GET("/backgrounds", canReadData, handlers.ListBackgrounds)
+	authorized.GET("/mobile_backgrounds", canReadData, handlers.ListMobileBackgrounds)
+	authorized.DELETE("/backgrounds/:name", canWriteData, handlers.DeleteBackground)
+	authorized.DELETE("/mobile_backgrounds/:name", canWriteData, handlers.DeleteMobileBackground)
+	authorized.POST("/backgrounds/upload", canWriteData, handlers.UploadBackground)
+	authorized.POST("/mobile_backgrounds/upload", canWriteData, handlers.UploadMobileBackground)
+
+	// Transfer
+	authorized.POST("/transfer/text", canWriteTransfer, handlers.SendText)
+	authorized.POST("/transfer/upload/init", canWriteTransfer, handlers.UploadInit)
+	authorized.POST("/transfer/upload/chunk", canWriteTransfer, handlers.UploadChunk)
+	authorized.POST("/transfer/upload/complete", canWriteTransfer, handlers.UploadComplete)
+	authorized.POST("/transfer/download-token", canReadTransfer, handlers.DownloadToken)
+	authorized.DELETE("/transfer/items/:id", canWriteTransfer, handlers.DeleteItem)
+
+	// Config Versions
+	authorized.GET("/config-versions", canReadData, handlers.GetConfigVersions)
+	authorized.POST("/config-versions", canWriteData, handlers.SaveConfigVersion)
+	authorized.POST("/config-versions/restore", canWriteData, handlers.RestoreConfigVersion)
+	authorized.DELETE("/config-versions/:id", canWriteData, handlers.DeleteConfigVersion)
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const boltFileName = "flatnas.db"
+
+var documentsBucket = []byte("documents")
+
+// BoltStore keeps all documents in a single embedded bbolt database. The
+// database can only be opened by one process at a time.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func OpenBolt(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		if errors.Is(err, bolt.ErrTimeout) {
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(documentsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Get(key string) ([]byte, error) {
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(documentsBucket).Get([]byte(key))
+		if v == nil {
+			return notExist("read", key)
+		}
+		data = append([]byte(nil), v...)
+		return nil
+	})
+	return data, err
+}
+
+func (s *BoltStore) Put(key string, data []byte) error {
+	if key == "" {
+		return errEmptyKey
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(documentsBucket).Put([]byte(key), data)
+	})
+}
+
+func (s *BoltStore) Create(key string, data []byte) error {
+	if key == "" {
+		return errEmptyKey
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(documentsBucket)
+		if b.Get([]byte(key)) != nil {
+			return exists("create", key)
+		}
+		return b.Put([]byte(key), data)
+	})
+}
+
+func (s *BoltStore) Delete(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(documentsBucket)
+		if b.Get([]byte(key)) == nil {
+			return notExist("remove", key)
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+func (s *BoltStore) Exists(key string) (bool, error) {
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket(documentsBucket).Get([]byte(key)) != nil
+		return nil
+	})
+	return found, err
+}
+
+func (s *BoltStore) List(dir string) ([]string, error) {
+	prefix := []byte(strings.TrimSuffix(dir, "/") + "/")
+	names := []string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(documentsBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, _ = c.Next() {
+			name := string(k[len(prefix):])
+			if !strings.Contains(name, "/") {
+				names = append(names, name)
+			}
+		}
+		return nil
+	})
+	return names, err
+}
+
+func (s *BoltStore) Keys() ([]string, error) {
+	var keys []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(documentsBucket).ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	return keys, err
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
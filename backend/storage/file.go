@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileStore keeps every document in a JSON file of its own, which is how
+// the server has always stored its data.
+type FileStore struct {
+	layout Layout
+}
+
+func NewFileStore(layout Layout) *FileStore {
+	return &FileStore{layout: layout}
+}
+
+func (s *FileStore) Get(key string) ([]byte, error) {
+	return os.ReadFile(s.layout.Path(key))
+}
+
+func (s *FileStore) Put(key string, data []byte) error {
+	if key == "" {
+		return errEmptyKey
+	}
+	path := s.layout.Path(key)
+	tempFile := path + ".tmp"
+	if err := os.WriteFile(tempFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempFile, path)
+}
+
+func (s *FileStore) Create(key string, data []byte) error {
+	if key == "" {
+		return errEmptyKey
+	}
+	path := s.layout.Path(key)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	if err := s.Put(key, data); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) Delete(key string) error {
+	return os.Remove(s.layout.Path(key))
+}
+
+func (s *FileStore) Exists(key string) (bool, error) {
+	_, err := os.Stat(s.layout.Path(key))
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (s *FileStore) List(dir string) ([]string, error) {
+	entries, err := os.ReadDir(s.layout.Path(dir))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s *FileStore) Keys() ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(s.layout.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == s.layout.Dir {
+			return nil
+		}
+		key, ok := s.layout.Key(path)
+		if !ok {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() && strings.HasSuffix(key, ".json") {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for key, path := range s.layout.Files {
+		if _, err := os.Stat(path); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (s *FileStore) Close() error {
+	return nil
+}
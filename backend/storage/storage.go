@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	BackendJSON = "json"
+	BackendBolt = "bolt"
+)
+
+// Store keeps the JSON documents the server state is made of: dashboards,
+// the system config, invite codes and so on. Keys are slash separated
+// paths such as "system.json" or "users/alice.json".
+//
+// Missing documents are reported with errors for which os.IsNotExist
+// holds, and Create fails with one for which os.IsExist holds, so callers
+// can treat every backend like the filesystem.
+type Store interface {
+	Get(key string) ([]byte, error)
+	Put(key string, data []byte) error
+	// Create stores data under key unless the key is taken.
+	Create(key string, data []byte) error
+	Delete(key string) error
+	Exists(key string) (bool, error)
+	// List returns the names of the documents directly inside dir.
+	List(dir string) ([]string, error)
+	// Keys returns every document of the store, for migrations.
+	Keys() ([]string, error)
+	Close() error
+}
+
+// Layout tells where documents live on disk. Keys are paths relative to
+// Dir, except the ones in Files which are kept elsewhere. Entries of Skip
+// are files or directories below Dir that are not documents.
+type Layout struct {
+	Dir   string
+	Files map[string]string
+	Skip  []string
+}
+
+// Path returns the file a document is kept in by the JSON backend.
+func (l Layout) Path(key string) string {
+	if p, ok := l.Files[key]; ok {
+		return p
+	}
+	return filepath.Join(l.Dir, filepath.FromSlash(key))
+}
+
+// Key returns the document kept in the file at path, or false when the
+// file is not part of the layout.
+func (l Layout) Key(path string) (string, bool) {
+	path = filepath.Clean(path)
+	for key, p := range l.Files {
+		if filepath.Clean(p) == path {
+			return key, true
+		}
+	}
+	if l.Dir == "" {
+		return "", false
+	}
+	rel, err := filepath.Rel(l.Dir, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	key := filepath.ToSlash(rel)
+	if l.skipped(key) {
+		return "", false
+	}
+	return key, true
+}
+
+func (l Layout) skipped(key string) bool {
+	for _, s := range l.Skip {
+		if key == s || strings.HasPrefix(key, s+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Open opens the backend kind for the documents of layout.
+func Open(kind string, layout Layout) (Store, error) {
+	switch kind {
+	case "", BackendJSON:
+		return NewFileStore(layout), nil
+	case BackendBolt:
+		return OpenBolt(filepath.Join(layout.Dir, boltFileName))
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", kind)
+}
+
+// Copy writes every document of src into dst and returns how many there
+// were. Documents dst has already are replaced.
+func Copy(dst, src Store) (int, error) {
+	keys, err := src.Keys()
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		data, err := src.Get(key)
+		if err != nil {
+			return i, fmt.Errorf("read %s: %w", key, err)
+		}
+		if err := dst.Put(key, data); err != nil {
+			return i, fmt.Errorf("write %s: %w", key, err)
+		}
+	}
+	return len(keys), nil
+}
+
+var (
+	mu      sync.RWMutex
+	current Store
+	layout  Layout
+	// direct serves paths outside the layout straight from the filesystem
+	direct = NewFileStore(Layout{})
+)
+
+// Use makes s the store for the files of l. Paths given to the functions
+// below that belong to l are served by s from then on.
+func Use(s Store, l Layout) {
+	mu.Lock()
+	defer mu.Unlock()
+	current = s
+	layout = l
+}
+
+// Current returns the store in use, or nil when documents are read from
+// the filesystem directly.
+func Current() Store {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+func resolve(path string) (Store, string) {
+	mu.RLock()
+	defer mu.RUnlock()
+	if current != nil {
+		if key, ok := layout.Key(path); ok {
+			return current, key
+		}
+	}
+	return direct, path
+}
+
+func ReadFile(path string) ([]byte, error) {
+	s, key := resolve(path)
+	return s.Get(key)
+}
+
+func WriteFile(path string, data []byte) error {
+	s, key := resolve(path)
+	return s.Put(key, data)
+}
+
+// CreateFile is WriteFile for a file that must not exist yet.
+func CreateFile(path string, data []byte) error {
+	s, key := resolve(path)
+	return s.Create(key, data)
+}
+
+func Remove(path string) error {
+	s, key := resolve(path)
+	return s.Delete(key)
+}
+
+func Exists(path string) (bool, error) {
+	s, key := resolve(path)
+	return s.Exists(key)
+}
+
+// ReadDir returns the names of the files in dir.
+func ReadDir(dir string) ([]string, error) {
+	s, key := resolve(dir)
+	return s.List(key)
+}
+
+func notExist(op, key string) error {
+	return &fs.PathError{Op: op, Path: key, Err: fs.ErrNotExist}
+}
+
+func exists(op, key string) error {
+	return &fs.PathError{Op: op, Path: key, Err: fs.ErrExist}
+}
+
+var errEmptyKey = errors.New("empty storage key")
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func testLayout(t *testing.T) Layout {
+	root := t.TempDir()
+	dir := filepath.Join(root, "data")
+	os.MkdirAll(filepath.Join(dir, "users"), 0755)
+	os.MkdirAll(filepath.Join(root, "transfer"), 0755)
+	return Layout{
+		Dir:   dir,
+		Files: map[string]string{"transfer/index.json": filepath.Join(root, "transfer", "index.json")},
+		Skip:  []string{"keys.json"},
+	}
+}
+
+func TestBackendsBehaveAlike(t *testing.T) {
+	for _, kind := range []string{BackendJSON, BackendBolt} {
+		t.Run(kind, func(t *testing.T) {
+			s, err := Open(kind, testLayout(t))
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			defer s.Close()
+
+			if _, err := s.Get("users/alice.json"); !os.IsNotExist(err) {
+				t.Fatalf("expected missing document, got %v", err)
+			}
+			if err := s.Create("users/alice.json", []byte(`{"a":1}`)); err != nil {
+				t.Fatalf("create: %v", err)
+			}
+			if err := s.Create("users/alice.json", []byte(`{}`)); !os.IsExist(err) {
+				t.Fatalf("expected create of a taken key to fail, got %v", err)
+			}
+			s.Put("users/bob.json", []byte(`{}`))
+			s.Put("system.json", []byte(`{}`))
+			s.Put("transfer/index.json", []byte(`{}`))
+			if data, err := s.Get("users/alice.json"); err != nil || string(data) != `{"a":1}` {
+				t.Fatalf("unexpected document %q %v", data, err)
+			}
+
+			names, err := s.List("users")
+			sort.Strings(names)
+			if err != nil || len(names) != 2 || names[0] != "alice.json" || names[1] != "bob.json" {
+				t.Fatalf("unexpected listing %v %v", names, err)
+			}
+			keys, _ := s.Keys()
+			if len(keys) != 4 {
+				t.Fatalf("expected 4 documents, got %v", keys)
+			}
+
+			if err := s.Delete("users/bob.json"); err != nil {
+				t.Fatalf("delete: %v", err)
+			}
+			if err := s.Delete("users/bob.json"); !os.IsNotExist(err) {
+				t.Fatalf("expected deleting a missing document to fail, got %v", err)
+			}
+			if ok, err := s.Exists("users/bob.json"); ok || err != nil {
+				t.Fatalf("expected deleted document to be gone, got %v %v", ok, err)
+			}
+		})
+	}
+}
+
+func TestCopyAndPathRouting(t *testing.T) {
+	layout := testLayout(t)
+	os.WriteFile(filepath.Join(layout.Dir, "system.json"), []byte(`{"authMode":"multi"}`), 0644)
+	os.WriteFile(filepath.Join(layout.Dir, "users", "alice.json"), []byte(`{}`), 0644)
+	os.WriteFile(filepath.Join(layout.Dir, "keys.json"), []byte(`{}`), 0600)
+	os.WriteFile(layout.Files["transfer/index.json"], []byte(`{"items":[]}`), 0644)
+
+	src, _ := Open(BackendJSON, layout)
+	dst, err := Open(BackendBolt, layout)
+	if err != nil {
+		t.Fatalf("open bolt: %v", err)
+	}
+	defer dst.Close()
+	n, err := Copy(dst, src)
+	if err != nil || n != 3 {
+		t.Fatalf("expected 3 documents copied, got %d %v", n, err)
+	}
+
+	Use(dst, layout)
+	defer Use(nil, Layout{})
+	if data, err := ReadFile(filepath.Join(layout.Dir, "system.json")); err != nil || string(data) != `{"authMode":"multi"}` {
+		t.Fatalf("unexpected system config %q %v", data, err)
+	}
+	WriteFile(layout.Files["transfer/index.json"], []byte(`{"items":[1]}`))
+	if data, _ := os.ReadFile(layout.Files["transfer/index.json"]); string(data) != `{"items":[]}` {
+		t.Fatalf("expected the file on disk to stay untouched, got %q", data)
+	}
+	// Files outside the layout still go to disk
+	if _, err := ReadFile(filepath.Join(layout.Dir, "keys.json")); err != nil {
+		t.Fatalf("expected skipped file to be read from disk: %v", err)
+	}
+	if names, _ := ReadDir(filepath.Join(layout.Dir, "users")); len(names) != 1 || names[0] != "alice.json" {
+		t.Fatalf("unexpected users %v", names)
+	}
+}
@@ -4,8 +4,12 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+// PasswordHashCost is the bcrypt cost of every stored password. Hashes of a
+// lower cost are upgraded on the next successful login.
+const PasswordHashCost = 12
+
 func HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), PasswordHashCost)
 	return string(bytes), err
 }
 
@@ -13,3 +17,10 @@ func CheckPasswordHash(password, hash string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 	return err == nil
 }
+
+// PasswordNeedsRehash reports whether a stored password is plaintext or was
+// hashed with a lower cost than PasswordHashCost.
+func PasswordNeedsRehash(stored string) bool {
+	cost, err := bcrypt.Cost([]byte(stored))
+	return err != nil || cost < PasswordHashCost
+}
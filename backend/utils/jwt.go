@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"errors"
+	"flatnasgo-backend/config"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrUnknownSigningKey = errors.New("unknown signing key")
+
+// SignToken signs claims with the active key of purpose and records its key
+// ID in the kid header so the token keeps verifying after a rotation.
+func SignToken(purpose string, claims jwt.Claims) (string, error) {
+	kid, secret := config.ActiveSigningKey(purpose)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	return token.SignedString(secret)
+}
+
+// ParseToken verifies a token signed by SignToken for the same purpose.
+// Tokens without a kid were signed with the legacy secret.key.
+func ParseToken(purpose, tokenString string, claims jwt.Claims, opts ...jwt.ParserOption) (*jwt.Token, error) {
+	keyFunc := func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		secret, ok := config.VerificationKey(purpose, kid)
+		if !ok {
+			return nil, ErrUnknownSigningKey
+		}
+		return secret, nil
+	}
+	opts = append(opts, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	return jwt.ParseWithClaims(tokenString, claims, keyFunc, opts...)
+}
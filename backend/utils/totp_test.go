@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+func TestTOTPCodeMatchesRFC6238Vectors(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	cases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, c := range cases {
+		code, err := TOTPCodeAt(secret, TOTPStep(time.Unix(c.unix, 0)))
+		if err != nil {
+			t.Fatalf("code at %d: %v", c.unix, err)
+		}
+		if code != c.code {
+			t.Fatalf("unix=%d expected %s, got %s", c.unix, c.code, code)
+		}
+	}
+}
+
+func TestValidateTOTPAcceptsAdjacentStep(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatalf("secret: %v", err)
+	}
+	now := time.Unix(1700000000, 0)
+	prev, _ := TOTPCodeAt(secret, TOTPStep(now)-1)
+	if step, ok := ValidateTOTP(secret, prev, now); !ok || step != TOTPStep(now)-1 {
+		t.Fatalf("expected previous step to validate, got step=%d ok=%v", step, ok)
+	}
+	old, _ := TOTPCodeAt(secret, TOTPStep(now)-3)
+	if _, ok := ValidateTOTP(secret, old, now); ok {
+		t.Fatalf("expected stale code to be rejected")
+	}
+}
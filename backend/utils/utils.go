@@ -2,12 +2,21 @@ package utils
 
 import (
 	"encoding/json"
+	"flatnasgo-backend/storage"
 	"os"
+	"regexp"
 	"sync"
 )
 
 var fileLocks sync.Map
 
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_@-][A-Za-z0-9._@-]{0,63}$`)
+
+// IsValidUsername reports whether name is safe to use as a user file name.
+func IsValidUsername(name string) bool {
+	return usernamePattern.MatchString(name)
+}
+
 func GetLock(filename string) *sync.Mutex {
 	lock, _ := fileLocks.LoadOrStore(filename, &sync.Mutex{})
 	return lock.(*sync.Mutex)
@@ -20,8 +29,11 @@ func WithFileLock(filename string, fn func() error) error {
 	return fn()
 }
 
+// The JSON helpers go through the storage backend, which keeps the files
+// of the data directory either on disk or in the embedded database.
+
 func ReadJSONUnlocked(filename string, v interface{}) error {
-	data, err := os.ReadFile(filename)
+	data, err := storage.ReadFile(filename)
 	if err != nil {
 		return err
 	}
@@ -33,11 +45,7 @@ func WriteJSONUnlocked(filename string, v interface{}) error {
 	if err != nil {
 		return err
 	}
-	tempFile := filename + ".tmp"
-	if err := os.WriteFile(tempFile, data, 0644); err != nil {
-		return err
-	}
-	return os.Rename(tempFile, filename)
+	return storage.WriteFile(filename, data)
 }
 
 func AtomicWriteFile(filename string, data []byte) error {
@@ -59,7 +67,7 @@ func ReadJSON(filename string, v interface{}) error {
 	lock.Lock()
 	defer lock.Unlock()
 
-	data, err := os.ReadFile(filename)
+	data, err := storage.ReadFile(filename)
 	if err != nil {
 		return err
 	}
@@ -67,9 +75,21 @@ func ReadJSON(filename string, v interface{}) error {
 }
 
 func WriteJSON(filename string, v interface{}) error {
+	lock := GetLock(filename)
+	lock.Lock()
+	defer lock.Unlock()
+	return WriteJSONUnlocked(filename, v)
+}
+
+// CreateJSON writes v to filename unless the file exists already, in which
+// case the error satisfies os.IsExist.
+func CreateJSON(filename string, v interface{}) error {
 	data, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
 		return err
 	}
-	return AtomicWriteFile(filename, data)
+	lock := GetLock(filename)
+	lock.Lock()
+	defer lock.Unlock()
+	return storage.CreateFile(filename, data)
 }
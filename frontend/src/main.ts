@@ -5,6 +5,9 @@ import { createPinia } from "pinia";
 import App from "./App.vue";
 import { useMainStore } from "./stores/main";
 import { attachErrorCapture, ensureOverlayHandled } from "./utils/overlay";
+import { installAuthFetch } from "./utils/authFetch";
+
+installAuthFetch();
 
 if (typeof document !== "undefined" && typeof navigator !== "undefined") {
   const ua = navigator.userAgent || "";
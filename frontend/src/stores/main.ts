@@ -10,7 +10,12 @@ import type {
   RssFeed,
   RssCategory,
   LuckyStunData,
+  ShareLink,
 } from "@/types";
+import { REFRESH_TOKEN_KEY, TOKEN_REFRESHED_EVENT, refreshSession } from "@/utils/authFetch";
+import { fetchWithChallenge } from "@/utils/challenge";
+import { getPasskeyAssertion } from "@/utils/webauthn";
+import { useToast } from "@/composables/useToast";
 
 interface BackupData {
   username?: string;
@@ -24,7 +29,25 @@ interface BackupData {
   [key: string]: unknown;
 }
 
+// 密码已验证但登录尚未完成，还需要完成的步骤
+export type LoginStep = "twoFactor" | "passwordChange";
+
+export class LoginStepRequired extends Error {
+  step: LoginStep;
+  challenge: string;
+  methods: string[];
+
+  constructor(message: string, step: LoginStep, challenge: string, methods: string[] = []) {
+    super(message);
+    this.name = "LoginStepRequired";
+    this.step = step;
+    this.challenge = challenge;
+    this.methods = methods;
+  }
+}
+
 export const useMainStore = defineStore("main", () => {
+  const toast = useToast();
   const socket = io({
     transports: ["websocket"],
     reconnection: true,
@@ -139,13 +162,41 @@ export const useMainStore = defineStore("main", () => {
   const items = computed(() => groups.value.flatMap((g) => g.items));
   const rssFeeds = ref<RssFeed[]>([]);
   const rssCategories = ref<RssCategory[]>([]);
-  const systemConfig = ref({ authMode: "single", allowRegistration: false }); // Default
+  const systemConfig = ref<{
+    authMode: string;
+    allowRegistration: boolean;
+    oidc?: { enabled: boolean; buttonText?: string };
+  }>({ authMode: "single", allowRegistration: false }); // Default
+
+  // 访问 /u/<用户名> 时以访客身份查看该用户公开的主页，不使用本机的登录状态与缓存
+  const publicPageUser = (() => {
+    const m = window.location.pathname.match(/^\/u\/([^/]+)\/?$/);
+    return m ? decodeURIComponent(m[1]!) : "";
+  })();
+  // 访问 /s/<令牌> 时查看他人分享的部分分组与组件，同样不使用本机的登录状态
+  const shareToken = (() => {
+    const m = window.location.pathname.match(/^\/s\/([^/]+)\/?$/);
+    return m ? decodeURIComponent(m[1]!) : "";
+  })();
+  const isGuestView = !!(publicPageUser || shareToken);
+  const dataUrl = shareToken
+    ? `/api/share/${encodeURIComponent(shareToken)}/data`
+    : publicPageUser
+      ? `/api/public/${encodeURIComponent(publicPageUser)}/data`
+      : "/api/data";
+  let sharePassword = "";
 
   // Auth State
-  const token = ref(localStorage.getItem("flat-nas-token") || "");
-  const username = ref(localStorage.getItem("flat-nas-username") || "");
+  const token = ref(isGuestView ? "" : localStorage.getItem("flat-nas-token") || "");
+  const username = ref(isGuestView ? "" : localStorage.getItem("flat-nas-username") || "");
   const isLogged = ref(!!token.value);
-  const password = ref(""); // Only used for password change, not auth
+  const publicPage = ref(false);
+  // 服务端看板的版本号，保存时带上，避免旧标签页覆盖其他设备上的修改
+  let revision: number | null = null;
+  window.addEventListener(TOKEN_REFRESHED_EVENT, (e: Event) => {
+    const next = (e as CustomEvent<string>).detail;
+    if (typeof next === "string" && next) token.value = next;
+  });
   const isExpandedMode = ref(false);
   const activeMusicPlayer = ref<"mini-player" | "music-widget" | null>(null);
   const webPaginationActiveGroupId = ref("");
@@ -158,23 +209,40 @@ export const useMainStore = defineStore("main", () => {
     if (token.value) {
       headers["Authorization"] = `Bearer ${token.value}`;
     }
+    if (sharePassword) {
+      headers["X-Share-Password"] = sharePassword;
+    }
     return headers;
   };
 
   const isValidNetworkMode = (mode: string) =>
     mode === "auto" || mode === "lan" || mode === "wan" || mode === "latency";
 
-  const emitNetworkHeartbeat = () => {
+  // socket 事件在负载中携带访问令牌；令牌过期被服务端拒绝时刷新后重发该事件最近一次的内容
+  const lastSocketEmits = new Map<string, Record<string, unknown>>();
+  const emitWithToken = (event: string, payload: Record<string, unknown> = {}) => {
     const t = token.value || localStorage.getItem("flat-nas-token");
     if (!t) return;
-    socket.emit("network:heartbeat", { token: t });
+    lastSocketEmits.set(event, payload);
+    socket.emit(event, { ...payload, token: t });
+  };
+
+  socket.on("auth:error", async ({ event }: { event?: string }) => {
+    const payload = event ? lastSocketEmits.get(event) : undefined;
+    // 每次发送只重试一次，避免令牌始终无效时反复刷新
+    if (event) lastSocketEmits.delete(event);
+    const next = await refreshSession();
+    if (!next || !event || !payload) return;
+    socket.emit(event, { ...payload, token: next });
+  });
+
+  const emitNetworkHeartbeat = () => {
+    emitWithToken("network:heartbeat");
   };
 
   const emitNetworkMode = (mode: string) => {
-    if (!isLogged.value) return;
-    const t = token.value || localStorage.getItem("flat-nas-token");
-    if (!t || !isValidNetworkMode(mode)) return;
-    socket.emit("network:mode", { token: t, mode });
+    if (!isLogged.value || !isValidNetworkMode(mode)) return;
+    emitWithToken("network:mode", { mode });
   };
 
   const scheduleNetworkModeBroadcast = (mode: string) => {
@@ -483,8 +551,10 @@ export const useMainStore = defineStore("main", () => {
     // If we got username back, ensure it matches
     if (data.username && data.username !== username.value) {
       username.value = data.username;
-      localStorage.setItem("flat-nas-username", data.username);
+      if (!isGuestView) localStorage.setItem("flat-nas-username", data.username);
     }
+    publicPage.value = data.publicPage === true;
+    if (typeof data.revision === "number") revision = data.revision;
 
     // Fix: Only restore items if groups is undefined (legacy data).
     // If groups is empty array [], it means user deleted all groups, so don't restore.
@@ -776,8 +846,9 @@ export const useMainStore = defineStore("main", () => {
     try {
       const headers: Record<string, string> = {};
       if (token.value) headers["Authorization"] = `Bearer ${token.value}`;
+      if (sharePassword) headers["X-Share-Password"] = sharePassword;
 
-      const res = await fetch(`/api/data`, { headers });
+      const res = await fetch(dataUrl, { headers });
       if (!res.ok) return;
       const data = await res.json();
 
@@ -792,15 +863,77 @@ export const useMainStore = defineStore("main", () => {
     }
   };
 
+  const applyLoginResult = (data: { token: string; username: string; refreshToken?: string }) => {
+    token.value = data.token;
+    username.value = data.username;
+    isLogged.value = true;
+    localStorage.setItem("flat-nas-token", data.token);
+    localStorage.setItem("flat-nas-username", data.username);
+    if (data.refreshToken) localStorage.setItem(REFRESH_TOKEN_KEY, data.refreshToken);
+  };
+
+  // 部署在认证反向代理（Authelia/Authentik 等）之后时，由代理传递的用户头换取会话
+  const tryProxyLogin = async () => {
+    try {
+      const res = await fetch("/api/login/proxy", { method: "POST" });
+      if (!res.ok) return;
+      const data = await res.json();
+      if (data.token) applyLoginResult(data);
+    } catch {
+      // 未启用代理认证
+    }
+  };
+
+  // 单点登录回调后地址栏带有一次性 code，用它换取会话并从地址栏移除
+  const consumeOidcCode = async () => {
+    const params = new URLSearchParams(window.location.search);
+    const code = params.get("oidc");
+    const error = params.get("oidc_error");
+    if (!code && !error) return;
+    params.delete("oidc");
+    params.delete("oidc_error");
+    const query = params.toString();
+    window.history.replaceState(null, "", window.location.pathname + (query ? `?${query}` : "") + window.location.hash);
+    if (error) {
+      console.error("SSO login failed:", error);
+      return;
+    }
+    try {
+      const res = await fetch("/api/oidc/exchange", {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({ code }),
+      });
+      if (!res.ok) return;
+      const data = await res.json();
+      if (data.token) applyLoginResult(data);
+    } catch (e) {
+      console.error("SSO login failed", e);
+    }
+  };
+
   const init = async () => {
     if (isInitializing) return;
     isInitializing = true;
 
     // Try to load from cache first for better UX (Stale-While-Revalidate)
-    loadFromCache();
+    if (!isGuestView) {
+      loadFromCache();
+      await consumeOidcCode();
+      if (!token.value) await tryProxyLogin();
+    }
 
     try {
-      const res = await fetch("/api/data", { headers: getHeaders() });
+      let res = await fetch(dataUrl, { headers: getHeaders() });
+      // 设置了访问密码的分享链接，先向访客询问密码
+      while (shareToken && res.status === 401) {
+        const body = await res.json().catch(() => null);
+        if (!body || !body.passwordRequired) break;
+        const input = window.prompt(sharePassword ? "密码错误，请重新输入" : "此分享需要访问密码");
+        if (!input) break;
+        sharePassword = input;
+        res = await fetch(dataUrl, { headers: getHeaders() });
+      }
       if (res.ok) {
         const data = await res.json();
         // Handle auth mode from system config
@@ -808,7 +941,7 @@ export const useMainStore = defineStore("main", () => {
           systemConfig.value = data.systemConfig;
         }
 
-        if (data.username) {
+        if (data.username && !isGuestView) {
           username.value = data.username;
           localStorage.setItem("flat-nas-username", data.username);
         }
@@ -818,7 +951,7 @@ export const useMainStore = defineStore("main", () => {
         // Assuming /api/data returns public data if not logged in.
 
         handleDataUpdate(data);
-        saveToCache(data);
+        if (!isGuestView) saveToCache(data);
 
         // Defer non-critical data fetching
         setTimeout(() => {
@@ -828,7 +961,7 @@ export const useMainStore = defineStore("main", () => {
       }
     } catch (e) {
       console.error("Init failed", e);
-      loadFromCache();
+      if (!isGuestView) loadFromCache();
     } finally {
       isInitializing = false;
       if (!socketListenersBound) {
@@ -881,16 +1014,32 @@ export const useMainStore = defineStore("main", () => {
   const isSaving = ref(false);
   let lastSavedJson = "";
 
+  // 读取服务端看板当前的版本号，保存时作为 If-Match 发送
+  const fetchRevision = async () => {
+    try {
+      const res = await fetch("/api/data", { headers: getHeaders() });
+      if (!res.ok) return null;
+      const data = await res.json();
+      return typeof data.revision === "number" ? (data.revision as number) : null;
+    } catch {
+      return null;
+    }
+  };
+
   const saveData = async (immediate = false) => {
     if (saveTimer) {
       clearTimeout(saveTimer);
       saveTimer = null;
     }
 
-    const doSave = async () => {
+    // retried：缺少版本号被拒绝后已补取版本号重试过一次
+    const doSave = async (retried = false): Promise<void> => {
       if (isPageUnloading.value) {
         return;
       }
+      let conflicted = false;
+      let latestRevision: number | null = null;
+      let retry = false;
       isSaving.value = true;
       try {
         if (!isLogged.value) {
@@ -903,9 +1052,6 @@ export const useMainStore = defineStore("main", () => {
           rssFeeds: rssFeeds.value,
           rssCategories: rssCategories.value,
         };
-        if (typeof password.value === "string" && password.value.length > 0) {
-          body.password = password.value;
-        }
         const json = JSON.stringify(body);
 
         if (json === lastSavedJson) {
@@ -915,25 +1061,61 @@ export const useMainStore = defineStore("main", () => {
         // Optimistic cache save to ensure data persistence even if network fails
         saveToCache(body);
 
+        // 尚未从服务端载入过看板（如仅有本地缓存）时先取得版本号
+        if (revision === null) revision = await fetchRevision();
+        const headers = getHeaders();
+        if (revision !== null) headers["If-Match"] = `"${revision}"`;
         const res = await fetch("/api/save", {
           method: "POST",
-          headers: getHeaders(),
+          headers,
           body: json,
         });
 
         if (res.ok) {
           lastSavedJson = json;
-          if (body.password) {
-            password.value = "";
+          const data = await res.json().catch(() => null);
+          if (data && typeof data.revision === "number") revision = data.revision;
+          // 服务端补全或修正了 ID：若保存期间未再修改，则采用服务端版本
+          if (data && Array.isArray(data.groups) && JSON.stringify(body) === json) {
+            groups.value = data.groups;
+            if (Array.isArray(data.widgets)) widgets.value = data.widgets;
+            body.groups = groups.value;
+            body.widgets = widgets.value;
+            lastSavedJson = JSON.stringify(body);
+            saveToCache(body);
           }
         }
 
+        // 其他设备已保存了更新的版本：本地修改仍在内存和缓存中，稍后由用户决定保留哪一份
+        if (res.status === 409) {
+          conflicted = true;
+          const data = await res.json().catch(() => null);
+          if (data && typeof data.revision === "number") latestRevision = data.revision;
+        }
+
+        // 缺少版本号：取得当前版本号后重试一次
+        if (res.status === 428 && !retried) {
+          revision = await fetchRevision();
+          retry = revision !== null;
+        }
+
+        // 服务端校验未通过：提示首个出错字段，本地数据保留在缓存中
+        if (res.status === 400 || res.status === 413) {
+          const data = await res.json().catch(() => null);
+          const field = data?.fields?.[0];
+          toast.error(
+            field ? `保存失败：${field.path} ${field.message}` : data?.error || "保存失败：数据过大",
+            5000,
+          );
+        }
+
         if (res.status === 401) {
           token.value = "";
           username.value = "";
           isLogged.value = false;
           localStorage.removeItem("flat-nas-token");
           localStorage.removeItem("flat-nas-username");
+          localStorage.removeItem(REFRESH_TOKEN_KEY);
         }
       } catch (e) {
         if (isPageUnloading.value) {
@@ -946,6 +1128,26 @@ export const useMainStore = defineStore("main", () => {
       } finally {
         isSaving.value = false;
       }
+      if (retry) {
+        return doSave(true);
+      }
+      if (conflicted) {
+        await resolveConflict(latestRevision);
+      }
+    };
+
+    const resolveConflict = async (latest: number | null) => {
+      if (latest === null) latest = await fetchRevision();
+      const keepLocal =
+        latest !== null &&
+        confirm("看板已在其他设备上修改。\n确定：保留本机的修改并覆盖\n取消：放弃本机的修改，载入最新内容");
+      if (keepLocal) {
+        // 以最新版本号重新保存当前的分组与组件
+        revision = latest;
+        return doSave();
+      }
+      toast.warning("已载入其他设备上的最新内容");
+      await fetchAndProcessData();
     };
 
     if (immediate) {
@@ -1046,44 +1248,96 @@ export const useMainStore = defineStore("main", () => {
     }
   };
 
+  // 登录接口返回 401 时可能只是还差一步：转换为 LoginStepRequired 交给登录窗口继续
+  const finishLoginResponse = async (res: Response) => {
+    const data = await res.json().catch(() => ({}));
+    if (res.ok) {
+      applyLoginResult(data);
+      // Reload data for the new user
+      await init();
+      return true;
+    }
+    if (data.twoFactorRequired && data.challenge) {
+      throw new LoginStepRequired(data.error || "需要二次验证", "twoFactor", data.challenge, data.methods || []);
+    }
+    if (data.passwordChangeRequired && data.challenge) {
+      throw new LoginStepRequired(data.error || "需要修改密码", "passwordChange", data.challenge);
+    }
+    throw new Error(data.error || "Login failed");
+  };
+
   const login = async (usr: string, pwd: string) => {
     try {
-      const res = await fetch("/api/login", {
-        method: "POST",
-        headers: { "Content-Type": "application/json" },
-        body: JSON.stringify({ username: usr, password: pwd }),
-      });
-      if (res.ok) {
-        const data = await res.json();
-        token.value = data.token;
-        username.value = data.username;
-        isLogged.value = true;
-
-        localStorage.setItem("flat-nas-token", data.token);
-        localStorage.setItem("flat-nas-username", data.username);
-
-        // Reload data for the new user
-        await init();
-        return true;
-      }
-      const data = await res.json();
-      throw new Error(data.error || "Login failed");
+      const res = await fetchWithChallenge(
+        "/api/login",
+        {
+          method: "POST",
+          headers: { "Content-Type": "application/json" },
+          body: JSON.stringify({ username: usr, password: pwd }),
+        },
+        "login",
+      );
+      return await finishLoginResponse(res);
     } catch (e: unknown) {
       console.error(e);
       throw e;
     }
   };
 
+  // 第二步：提交动态验证码或恢复码
+  const loginTwoFactor = async (challenge: string, code: string) => {
+    const res = await fetch("/api/login/2fa", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({ challenge, code: code.trim() }),
+    });
+    return finishLoginResponse(res);
+  };
+
+  // 管理员重置密码后首次登录：用 challenge 设置新密码并完成登录
+  const loginChangePassword = async (challenge: string, newPassword: string) => {
+    const res = await fetch("/api/login/password", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({ challenge, newPassword }),
+    });
+    return finishLoginResponse(res);
+  };
+
+  // 通行密钥登录：不带 challenge 时由浏览器选择可发现的通行密钥直接登录，
+  // 带上密码登录返回的 challenge 时作为第二步验证
+  const loginWithPasskey = async (challenge?: string) => {
+    const begin = await fetch("/api/login/passkey/begin", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify(challenge ? { challenge } : {}),
+    });
+    const started = await begin.json().catch(() => ({}));
+    if (!begin.ok) throw new Error(started.error || "无法使用通行密钥登录");
+
+    const credential = await getPasskeyAssertion(started.options);
+    const res = await fetch("/api/login/passkey/finish", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({ session: started.session, credential }),
+    });
+    return finishLoginResponse(res);
+  };
+
   const register = async (usr: string, pwd: string, inviteCode?: string) => {
     try {
       const body: Record<string, string> = { username: usr, password: pwd };
       if (inviteCode) body.inviteCode = inviteCode;
       
-      const res = await fetch("/api/register", {
-        method: "POST",
-        headers: { "Content-Type": "application/json" },
-        body: JSON.stringify(body),
-      });
+      const res = await fetchWithChallenge(
+        "/api/register",
+        {
+          method: "POST",
+          headers: { "Content-Type": "application/json" },
+          body: JSON.stringify(body),
+        },
+        "register",
+      );
       if (res.ok) return true;
       const data = await res.json();
       throw new Error(data.error || "Register failed");
@@ -1193,6 +1447,19 @@ export const useMainStore = defineStore("main", () => {
     }
   };
 
+  const updateInviteCode = async (code: string, changes: Record<string, unknown>) => {
+    const headers: Record<string, string> = { "Content-Type": "application/json" };
+    if (token.value) headers["Authorization"] = `Bearer ${token.value}`;
+    const res = await fetch(`/api/admin/invite-codes/${code}`, {
+      method: "PATCH",
+      headers,
+      body: JSON.stringify(changes),
+    });
+    const data = await res.json();
+    if (!res.ok) throw new Error(data.error || "Update failed");
+    return data.code;
+  };
+
   const deleteInviteCode = async (code: string) => {
     try {
       const headers: Record<string, string> = {};
@@ -1209,6 +1476,17 @@ export const useMainStore = defineStore("main", () => {
   };
 
   const logout = async () => {
+    const refreshToken = localStorage.getItem(REFRESH_TOKEN_KEY);
+    if (refreshToken || token.value) {
+      const headers: Record<string, string> = { "Content-Type": "application/json" };
+      if (token.value) headers["Authorization"] = `Bearer ${token.value}`;
+      fetch("/api/logout", {
+        method: "POST",
+        headers,
+        body: JSON.stringify({ refreshToken: refreshToken || "" }),
+      }).catch(() => {});
+    }
+    localStorage.removeItem(REFRESH_TOKEN_KEY);
     token.value = "";
     username.value = "";
     isLogged.value = false;
@@ -1233,8 +1511,77 @@ export const useMainStore = defineStore("main", () => {
     }
   });
 
-  const changePassword = (newPwd: string) => {
-    password.value = newPwd;
+  // 公开主页：开启后未登录的访客可在 /u/<用户名> 看到标记为公开的项目和组件
+  const setPublicPage = async (enabled: boolean) => {
+    const res = await fetch("/api/public-page", {
+      method: "PUT",
+      headers: getHeaders(),
+      body: JSON.stringify({ enabled }),
+    });
+    const data = await res.json().catch(() => null);
+    if (!res.ok) {
+      throw new Error((data && data.error) || "设置公开主页失败");
+    }
+    publicPage.value = data.publicPage === true;
+  };
+
+  // 分享链接：把部分分组与组件以只读方式分享给未登录的访客，到期或删除后失效
+  const fetchShares = async () => {
+    const res = await fetch("/api/shares", { headers: getHeaders() });
+    const data = await res.json().catch(() => null);
+    if (!res.ok) {
+      throw new Error((data && data.error) || "获取分享列表失败");
+    }
+    return (data.shares || []) as ShareLink[];
+  };
+
+  const createShare = async (options: {
+    name?: string;
+    groups?: string[];
+    widgets?: string[];
+    expiresInDays?: number;
+    password?: string;
+  }) => {
+    const res = await fetch("/api/shares", {
+      method: "POST",
+      headers: getHeaders(),
+      body: JSON.stringify(options),
+    });
+    const data = await res.json().catch(() => null);
+    if (!res.ok) {
+      throw new Error((data && data.error) || "创建分享失败");
+    }
+    return data.share as ShareLink;
+  };
+
+  const deleteShare = async (id: string) => {
+    const res = await fetch(`/api/shares/${encodeURIComponent(id)}`, {
+      method: "DELETE",
+      headers: getHeaders(),
+    });
+    if (!res.ok) {
+      const data = await res.json().catch(() => null);
+      throw new Error((data && data.error) || "删除分享失败");
+    }
+  };
+
+  const shareUrl = (share: ShareLink) => `${window.location.origin}/s/${encodeURIComponent(share.token)}`;
+
+  const changePassword = async (currentPwd: string, newPwd: string) => {
+    const res = await fetch("/api/password", {
+      method: "POST",
+      headers: getHeaders(),
+      body: JSON.stringify({ currentPassword: currentPwd, newPassword: newPwd }),
+    });
+    const data = await res.json().catch(() => null);
+    if (!res.ok) {
+      throw new Error((data && data.error) || "修改密码失败");
+    }
+    // 修改密码后其他设备会被登出，当前设备获得新令牌
+    if (data && typeof data.token === "string") {
+      token.value = data.token;
+      localStorage.setItem("flat-nas-token", data.token);
+    }
   };
 
   const saveWidget = async (id?: string, data?: unknown) => {
@@ -1365,10 +1712,17 @@ export const useMainStore = defineStore("main", () => {
     items,
     widgets,
     appConfig,
-    password,
     isLogged,
     token,
     username, // Export username
+    publicPageUser,
+    publicPage,
+    setPublicPage,
+    shareToken,
+    fetchShares,
+    createShare,
+    deleteShare,
+    shareUrl,
     getHeaders,
     isExpandedMode,
     activeMusicPlayer,
@@ -1386,7 +1740,11 @@ export const useMainStore = defineStore("main", () => {
     addItem,
     updateItem,
     deleteItem,
+    emitWithToken,
     login,
+    loginTwoFactor,
+    loginWithPasskey,
+    loginChangePassword,
     register,
     logout,
     changePassword,
@@ -1408,6 +1766,7 @@ export const useMainStore = defineStore("main", () => {
     uploadLicense,
     fetchInviteCodes,
     generateInviteCode,
+    updateInviteCode,
     deleteInviteCode,
     luckyStunData,
     fetchLuckyStunData,
@@ -243,6 +243,18 @@ export interface RssCategory {
   feeds: RssFeed[];
 }
 
+export interface ShareLink {
+  id: string;
+  username: string;
+  name?: string;
+  groups: string[];
+  widgets: string[];
+  hasPassword: boolean;
+  createdAt: number;
+  expiresAt: number;
+  token: string;
+}
+
 export interface BookmarkItem {
   id: string;
   title: string;
@@ -0,0 +1,78 @@
+// 访问令牌有效期很短：请求返回 401 时用刷新令牌换取新令牌并重试一次
+export const TOKEN_KEY = "flat-nas-token";
+export const REFRESH_TOKEN_KEY = "flat-nas-refresh-token";
+export const TOKEN_REFRESHED_EVENT = "flat-nas-token-refreshed";
+
+const SKIP_PATHS = ["/api/login", "/api/token/refresh", "/api/logout"];
+
+let refreshing: Promise<string | null> | null = null;
+
+const requestPath = (input: RequestInfo | URL) => {
+  const raw = typeof input === "string" ? input : input instanceof URL ? input.href : input.url;
+  try {
+    const url = new URL(raw, window.location.origin);
+    if (url.origin !== window.location.origin) return "";
+    return url.pathname;
+  } catch {
+    return "";
+  }
+};
+
+const refreshAccessToken = async (originalFetch: typeof fetch): Promise<string | null> => {
+  const refreshToken = localStorage.getItem(REFRESH_TOKEN_KEY);
+  if (!refreshToken) return null;
+  try {
+    const res = await originalFetch("/api/token/refresh", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({ refreshToken }),
+    });
+    if (!res.ok) {
+      localStorage.removeItem(REFRESH_TOKEN_KEY);
+      return null;
+    }
+    const data = await res.json();
+    if (!data.token || !data.refreshToken) return null;
+    localStorage.setItem(TOKEN_KEY, data.token);
+    localStorage.setItem(REFRESH_TOKEN_KEY, data.refreshToken);
+    window.dispatchEvent(new CustomEvent(TOKEN_REFRESHED_EVENT, { detail: data.token }));
+    return data.token as string;
+  } catch {
+    return null;
+  }
+};
+
+// 并发请求共用同一次刷新，避免刷新令牌被重复轮换
+const sharedRefresh = (doFetch: typeof fetch) => {
+  if (!refreshing) {
+    refreshing = refreshAccessToken(doFetch).finally(() => {
+      refreshing = null;
+    });
+  }
+  return refreshing;
+};
+
+// 不经过 fetch 的调用方（如 socket 事件）在令牌被拒绝时主动刷新
+export const refreshSession = () => sharedRefresh(window.fetch.bind(window));
+
+export const installAuthFetch = () => {
+  if (typeof window === "undefined" || typeof window.fetch !== "function") return;
+  const originalFetch = window.fetch.bind(window);
+
+  window.fetch = async (input: RequestInfo | URL, init?: RequestInit) => {
+    const res = await originalFetch(input, init);
+    if (res.status !== 401) return res;
+
+    const path = requestPath(input);
+    if (!path.startsWith("/api/") || SKIP_PATHS.some((p) => path.startsWith(p))) return res;
+
+    const headers = new Headers(init?.headers || (input instanceof Request ? input.headers : undefined));
+    if (!headers.get("Authorization")) return res;
+
+    const token = await sharedRefresh(originalFetch);
+    if (!token) return res;
+
+    headers.set("Authorization", `Bearer ${token}`);
+    return originalFetch(input, { ...init, headers });
+  };
+};
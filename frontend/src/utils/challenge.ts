@@ -0,0 +1,95 @@
+// 自托管的工作量证明验证：服务端下发 nonce 与难度，客户端找到一个计数器
+// 使 SHA-256("nonce:计数器") 的前 difficulty 位为 0
+
+const K = new Uint32Array([
+  0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+  0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+  0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+  0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+  0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+  0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+  0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+  0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2,
+]);
+
+const rotr = (x: number, n: number) => (x >>> n) | (x << (32 - n));
+
+// 对 ASCII 字符串做 SHA-256，返回 8 个 32 位字
+function sha256Words(str: string) {
+  const len = str.length;
+  const blocks = ((len + 8) >> 6) + 1;
+  const w = new Uint32Array(blocks * 16);
+  for (let i = 0; i < len; i++) w[i >> 2]! |= (str.charCodeAt(i) & 0xff) << (24 - (i % 4) * 8);
+  w[len >> 2]! |= 0x80 << (24 - (len % 4) * 8);
+  w[blocks * 16 - 1] = len * 8;
+
+  const h = new Uint32Array([
+    0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19,
+  ]);
+  const m = new Uint32Array(64);
+  for (let b = 0; b < blocks; b++) {
+    for (let i = 0; i < 16; i++) m[i] = w[b * 16 + i]!;
+    for (let i = 16; i < 64; i++) {
+      const x = m[i - 15]!;
+      const y = m[i - 2]!;
+      const s0 = rotr(x, 7) ^ rotr(x, 18) ^ (x >>> 3);
+      const s1 = rotr(y, 17) ^ rotr(y, 19) ^ (y >>> 10);
+      m[i] = m[i - 16]! + s0 + m[i - 7]! + s1;
+    }
+    let [a, bb, c, d, e, f, g, hh] = h as unknown as number[];
+    for (let i = 0; i < 64; i++) {
+      const t1 = hh! + (rotr(e!, 6) ^ rotr(e!, 11) ^ rotr(e!, 25)) + ((e! & f!) ^ (~e! & g!)) + K[i]! + m[i]!;
+      const t2 = (rotr(a!, 2) ^ rotr(a!, 13) ^ rotr(a!, 22)) + ((a! & bb!) ^ (a! & c!) ^ (bb! & c!));
+      hh = g;
+      g = f;
+      f = e;
+      e = (d! + t1) | 0;
+      d = c;
+      c = bb;
+      bb = a;
+      a = (t1 + t2) | 0;
+    }
+    h[0]! += a!;
+    h[1]! += bb!;
+    h[2]! += c!;
+    h[3]! += d!;
+    h[4]! += e!;
+    h[5]! += f!;
+    h[6]! += g!;
+    h[7]! += hh!;
+  }
+  return h;
+}
+
+const leadingZeroBits = (h: Uint32Array) => {
+  let n = 0;
+  for (const word of h) {
+    if (word !== 0) return n + Math.clz32(word);
+    n += 32;
+  }
+  return n;
+};
+
+export const solveChallenge = (nonce: string, difficulty: number) => {
+  for (let i = 0; ; i++) {
+    if (leadingZeroBits(sha256Words(`${nonce}:${i}`)) >= difficulty) return String(i);
+  }
+};
+
+// 请求公开接口；服务端返回 428 时获取并解出谜题后重试一次
+export const fetchWithChallenge = async (
+  input: string,
+  init: RequestInit,
+  action: "login" | "register" | "visitor",
+) => {
+  const res = await fetch(input, init);
+  if (res.status !== 428) return res;
+
+  const issued = await fetch(`/api/challenge?action=${action}`);
+  if (!issued.ok) return res;
+  const { challenge, nonce, difficulty } = await issued.json();
+  const headers = new Headers(init.headers);
+  headers.set("X-Challenge", challenge);
+  headers.set("X-Challenge-Solution", solveChallenge(nonce, difficulty));
+  return fetch(input, { ...init, headers });
+};
@@ -0,0 +1,63 @@
+// 通行密钥（WebAuthn）登录：服务端以 base64url 传输二进制字段，浏览器接口需要 ArrayBuffer
+
+interface CredentialDescriptorJSON {
+  type: PublicKeyCredentialType;
+  id: string;
+  transports?: AuthenticatorTransport[];
+}
+
+export interface PasskeyAssertionOptions {
+  publicKey: Omit<PublicKeyCredentialRequestOptions, "challenge" | "allowCredentials"> & {
+    challenge: string;
+    allowCredentials?: CredentialDescriptorJSON[];
+  };
+}
+
+const fromBase64url = (value: string) => {
+  const base64 = value.replace(/-/g, "+").replace(/_/g, "/");
+  const binary = atob(base64.padEnd(base64.length + ((4 - (base64.length % 4)) % 4), "="));
+  const bytes = new Uint8Array(binary.length);
+  for (let i = 0; i < binary.length; i++) bytes[i] = binary.charCodeAt(i);
+  return bytes;
+};
+
+const toBase64url = (buffer: ArrayBuffer) => {
+  let binary = "";
+  new Uint8Array(buffer).forEach((b) => {
+    binary += String.fromCharCode(b);
+  });
+  return btoa(binary).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+};
+
+export const isPasskeySupported = () =>
+  typeof window !== "undefined" && !!window.PublicKeyCredential && !!navigator.credentials;
+
+// 用户在浏览器弹窗中取消或超时
+export const isPasskeyCancelled = (e: unknown) => e instanceof DOMException && e.name === "NotAllowedError";
+
+// 按服务端下发的参数请求浏览器签名，返回可直接提交给服务端的凭据
+export const getPasskeyAssertion = async (options: PasskeyAssertionOptions) => {
+  const { challenge, allowCredentials, ...rest } = options.publicKey;
+  const credential = (await navigator.credentials.get({
+    publicKey: {
+      ...rest,
+      challenge: fromBase64url(challenge),
+      allowCredentials: allowCredentials?.map((c) => ({ ...c, id: fromBase64url(c.id) })),
+    },
+  })) as PublicKeyCredential | null;
+  if (!credential) throw new Error("未选择通行密钥");
+
+  const response = credential.response as AuthenticatorAssertionResponse;
+  return {
+    id: credential.id,
+    rawId: toBase64url(credential.rawId),
+    type: credential.type,
+    response: {
+      clientDataJSON: toBase64url(response.clientDataJSON),
+      authenticatorData: toBase64url(response.authenticatorData),
+      signature: toBase64url(response.signature),
+      userHandle: response.userHandle ? toBase64url(response.userHandle) : undefined,
+    },
+    clientExtensionResults: credential.getClientExtensionResults(),
+  };
+};